@@ -2,12 +2,25 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"flag"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/ZaninAndrea/microdot/internal/db"
-	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/internal/server"
+	"github.com/ZaninAndrea/microdot/internal/stream"
+	"github.com/ZaninAndrea/microdot/internal/syslog"
+	"github.com/ZaninAndrea/microdot/internal/trigram"
+	"github.com/ZaninAndrea/microdot/internal/worker"
 	"github.com/ZaninAndrea/microdot/pkg/blob"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -15,53 +28,242 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
+type options struct {
+	listenAddress    string
+	s3Endpoint       string
+	s3Region         string
+	s3AccessKey      string
+	s3SecretKey      string
+	bucketName       string
+	diskPath         string
+	trigramPath      string
+	syslogTCPAddress string
+	syslogUDPAddress string
+	workers          int
+	nodeID           uint64
+	shutdownTimeout  time.Duration
+	retention        []worker.RetentionPolicy
+	server           server.Config
+}
+
 func main() {
-	myDB, err := db.NewDB(initBucket())
+	opts := parseOptions()
+
+	bucket := initBucket(opts)
+	myDB, err := db.NewDB(bucket, opts.nodeID)
 	if err != nil {
-		panic(err)
+		log.Fatalf("failed to open database: %v", err)
+	}
+
+	// The index is filled by the local workers, so it's complete only if they shard all the documents
+	var trigramIndex *trigram.Index
+	if opts.trigramPath != "" && opts.workers > 0 {
+		trigramIndex = initTrigramIndex(opts.trigramPath, bucket)
+		myDB.SetTrigramIndex(trigramIndex)
+	}
+
+	httpServer := &http.Server{
+		Addr:    opts.listenAddress,
+		Handler: server.NewServer(myDB, opts.server),
 	}
-	defer myDB.Close()
 
-	for i := 0; i < 10; i++ {
-		go func() {
-			err = myDB.AddDocument(types.Labels{"stream": "example"}, types.Document{"msg": "Hello, World!", "ts": time.Now().UnixMilli()})
-			if err != nil {
-				panic(err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("listening on %s", opts.listenAddress)
+		serverErr <- httpServer.ListenAndServe()
+	}()
+
+	// The syslog listeners are stopped together with the HTTP server
+	syslogCtx, stopSyslog := context.WithCancel(context.Background())
+	syslogDone := startSyslog(syslogCtx, myDB, opts)
+
+	// Background jobs are crash-safe, so the workers are not awaited on shutdown
+	if opts.workers > 0 {
+		bgWorker := worker.NewWorker(bucket)
+		if trigramIndex != nil {
+			bgWorker.SetTrigramIndex(trigramIndex)
+		}
+		bgWorker.SetRetentionPolicies(opts.retention)
+		go bgWorker.Plan(ctx)
+		for range opts.workers {
+			go bgWorker.Run(ctx)
+		}
+	}
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("server error: %v", err)
+		}
+	case <-ctx.Done():
+		log.Printf("shutting down")
+	}
+
+	// Stop accepting new requests and wait for the in-flight ones, which are waiting for
+	// their WAL batch to be flushed.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.shutdownTimeout)
+	defer cancel()
+	stopSyslog()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to shutdown the HTTP server: %v", err)
+	}
+	syslogDone.Wait()
+
+	// Flush the documents that are still buffered in the WAL writer
+	if err := myDB.Close(shutdownCtx); err != nil {
+		log.Fatalf("failed to close database: %v", err)
+	}
+}
+
+// startSyslog starts the syslog listeners enabled in the options, the returned WaitGroup is done once
+// all of them have stopped and flushed the received messages.
+func startSyslog(ctx context.Context, database *db.DB, opts options) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	listener := syslog.NewListener(database)
+
+	if opts.syslogTCPAddress != "" {
+		tcpListener, err := net.Listen("tcp", opts.syslogTCPAddress)
+		if err != nil {
+			log.Fatalf("failed to listen for syslog over TCP: %v", err)
+		}
+
+		log.Printf("listening for syslog over TCP on %s", opts.syslogTCPAddress)
+		wg.Go(func() {
+			if err := listener.ServeTCP(ctx, tcpListener); err != nil {
+				log.Printf("syslog TCP listener error: %v", err)
 			}
-		}()
+		})
 	}
 
-	err = myDB.AddDocument(types.Labels{"stream": "example2"}, types.Document{"msg": "Ciao, Mondo!", "ts": time.Now().UnixMilli()})
-	if err != nil {
-		panic(err)
+	if opts.syslogUDPAddress != "" {
+		udpConn, err := net.ListenPacket("udp", opts.syslogUDPAddress)
+		if err != nil {
+			log.Fatalf("failed to listen for syslog over UDP: %v", err)
+		}
+
+		log.Printf("listening for syslog over UDP on %s", opts.syslogUDPAddress)
+		wg.Go(func() {
+			if err := listener.ServeUDP(ctx, udpConn); err != nil {
+				log.Printf("syslog UDP listener error: %v", err)
+			}
+		})
 	}
-	err = myDB.AddDocument(types.Labels{"stream": "example2"}, types.Document{"msg": "Ciao ciao!", "ts": time.Now().UnixMilli()})
-	if err != nil {
-		panic(err)
+
+	return wg
+}
+
+func parseOptions() options {
+	opts := options{server: server.DefaultConfig()}
+	flag.StringVar(&opts.listenAddress, "listen", ":8090", "address of the HTTP ingestion server")
+	flag.StringVar(&opts.s3Endpoint, "s3-endpoint", "http://localhost:8333", "endpoint of the S3 compatible storage")
+	flag.StringVar(&opts.s3Region, "s3-region", "us-east-1", "region of the S3 bucket")
+	flag.StringVar(&opts.s3AccessKey, "s3-access-key", envOr("MICRODOT_S3_ACCESS_KEY", "seaweedfs"), "access key of the S3 storage")
+	flag.StringVar(&opts.s3SecretKey, "s3-secret-key", envOr("MICRODOT_S3_SECRET_KEY", "seaweedfs123"), "secret key of the S3 storage")
+	flag.StringVar(&opts.bucketName, "bucket", "microdot", "name of the bucket storing the data")
+	flag.StringVar(&opts.syslogTCPAddress, "syslog-tcp", "", "address of the syslog TCP listener, disabled if empty")
+	flag.StringVar(&opts.syslogUDPAddress, "syslog-udp", "", "address of the syslog UDP listener, disabled if empty")
+	flag.IntVar(&opts.workers, "workers", 1, "number of background jobs processed concurrently, 0 disables the background jobs")
+	flag.Uint64Var(&opts.nodeID, "node-id", 0, "ID of this instance, used in the document IDs: instances sharing a bucket need different IDs")
+	flag.StringVar(&opts.diskPath, "disk-path", "", "store the data in this local folder instead of S3")
+	flag.StringVar(&opts.trigramPath, "trigram-path", "", "store a trigram index of the sharded documents in this local folder, only for new buckets of single instance deployments")
+	flag.DurationVar(&opts.shutdownTimeout, "shutdown-timeout", 30*time.Second, "maximum time to wait for in-flight requests on shutdown")
+	flag.StringVar(&opts.server.Logfmt.MessageKey, "logfmt-msg-key", opts.server.Logfmt.MessageKey, "logfmt key stored as the document message")
+	flag.StringVar(&opts.server.Logfmt.TimestampKey, "logfmt-ts-key", opts.server.Logfmt.TimestampKey, "logfmt key stored as the document timestamp")
+	flag.Func("logfmt-label-keys", "comma-separated logfmt keys stored as stream labels", func(value string) error {
+		opts.server.Logfmt.LabelKeys = splitList(value)
+		return nil
+	})
+	flag.Func("elastic-label-fields", "comma-separated Elasticsearch source fields stored as stream labels", func(value string) error {
+		opts.server.Elastic.LabelFields = splitList(value)
+		return nil
+	})
+	flag.Func("retention", "retention period of the streams matching a selector, as app=api,env=prod:720h (repeatable, an empty selector matches all the streams)", func(value string) error {
+		policy, err := worker.ParseRetentionPolicy(value)
+		if err != nil {
+			return err
+		}
+		opts.retention = append(opts.retention, policy)
+		return nil
+	})
+	flag.Parse()
+
+	return opts
+}
+
+// splitList splits a comma-separated flag value, trimming the spaces around the items and dropping the
+// empty ones.
+func splitList(value string) []string {
+	items := []string{}
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func envOr(key, defaultValue string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+
+	return defaultValue
+}
+
+// TRIGRAM_MARKER_FILE is created in the trigram index folder when the index is attached to a bucket without
+// sharded documents. The index doesn't contain the documents sharded before it was attached, so the queries
+// would miss them.
+const TRIGRAM_MARKER_FILE = "attached"
+
+func initTrigramIndex(path string, bucket blob.Bucket) *trigram.Index {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		log.Fatalf("failed to create trigram index folder: %v", err)
 	}
 
-	results := myDB.Query(types.Labels{"stream": "example2"}, "Ciao")
-	fmt.Println("Query results:")
-	for res := range results {
-		if res.IsErr() {
-			println("Error:", res.Error().Error())
-			continue
+	marker := filepath.Join(path, TRIGRAM_MARKER_FILE)
+	if _, err := os.Stat(marker); os.IsNotExist(err) {
+		streams, err := stream.NewReader(bucket).ListStreams(context.Background())
+		if err != nil {
+			log.Fatalf("failed to list the streams: %v", err)
 		}
+		if len(streams) > 0 {
+			log.Fatalf("the bucket already contains sharded documents, which are missing from the trigram index: -trigram-path can only be set on a new bucket")
+		}
+		if err := os.WriteFile(marker, nil, 0644); err != nil {
+			log.Fatalf("failed to create the trigram index marker: %v", err)
+		}
+	} else if err != nil {
+		log.Fatalf("failed to read the trigram index marker: %v", err)
+	}
 
-		// Print the stream labels
-		fmt.Printf("[%d] %d: %s\n", res.Value.StreamID, res.Value.DocumentID, res.Value.Document["msg"])
+	index, err := trigram.NewIndex(path)
+	if err != nil {
+		log.Fatalf("failed to open trigram index: %v", err)
 	}
+	return index
 }
 
-func initBucket() blob.Bucket {
+func initBucket(opts options) blob.Bucket {
+	if opts.diskPath != "" {
+		diskBucket, err := blob.NewDiskBucket(opts.diskPath)
+		if err != nil {
+			log.Fatalf("failed to open disk bucket: %v", err)
+		}
+		return diskBucket
+	}
+
 	ctx := context.Background()
 
 	// Create S3 client configured for Seaweed
 	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithRegion("us-east-1"),
+		config.WithRegion(opts.s3Region),
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			"seaweedfs",
-			"seaweedfs123",
+			opts.s3AccessKey,
+			opts.s3SecretKey,
 			"",
 		)),
 	)
@@ -70,13 +272,13 @@ func initBucket() blob.Bucket {
 	}
 
 	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-		o.BaseEndpoint = aws.String("http://localhost:8333")
+		o.BaseEndpoint = aws.String(opts.s3Endpoint)
 		o.UsePathStyle = true
 	})
 
 	s3Bucket := blob.NewS3Bucket(
 		client,
-		"microdot",
+		opts.bucketName,
 	)
 	return s3Bucket
 }
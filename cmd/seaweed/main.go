@@ -40,14 +40,14 @@ func main() {
 	)
 
 	// Put an object
-	err = s3Bucket.PutObject(ctx, "test.txt", bytes.NewReader([]byte("Hello, SeaweedFS!")))
+	err = s3Bucket.PutObject(ctx, "test.txt", bytes.NewReader([]byte("Hello, SeaweedFS!")), true)
 	if err != nil {
 		log.Fatalf("failed to put object: %v", err)
 	}
 	fmt.Println("Object uploaded successfully")
 
 	// Get the object
-	body, err := s3Bucket.GetObject(ctx, "test.txt")
+	body, _, err := s3Bucket.GetObject(ctx, "test.txt")
 	if err != nil {
 		log.Fatalf("failed to get object: %v", err)
 	}
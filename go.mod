@@ -8,7 +8,11 @@ require (
 	github.com/aws/aws-sdk-go-v2/credentials v1.19.12
 	github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager v0.1.10
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.97.1
+	github.com/aws/smithy-go v1.24.2
+	github.com/golang/snappy v1.0.0
 	github.com/pierrec/lz4/v4 v4.1.25
+	golang.org/x/sync v0.20.0
+	google.golang.org/protobuf v1.36.12
 )
 
 require (
@@ -26,6 +30,4 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/sso v1.30.13 // indirect
 	github.com/aws/aws-sdk-go-v2/service/ssooidc v1.35.17 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sts v1.41.9 // indirect
-	github.com/aws/smithy-go v1.24.2 // indirect
-	golang.org/x/sync v0.20.0 // indirect
 )
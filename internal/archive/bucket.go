@@ -0,0 +1,29 @@
+package archive
+
+import (
+	"context"
+	"io"
+
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+// NewBucketReader creates a reader on an archive stored in the bucket. The metadata file is downloaded
+// when the reader is created, while only the byte ranges of the data file containing the chunks that are
+// read are fetched, so scanning a few columns of a large archive doesn't download the whole data file.
+func NewBucketReader(ctx context.Context, bucket blob.Bucket, dataKey, metadataKey string) (*Reader, error) {
+	metadataFile, _, err := bucket.GetObject(ctx, metadataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := NewRangeReader(metadataFile, func(offset, length uint64) (io.ReadCloser, error) {
+		// The end of the range is inclusive
+		return bucket.GetObjectRange(ctx, dataKey, int(offset), int(offset+length)-1)
+	})
+	if err != nil {
+		metadataFile.Close()
+		return nil, err
+	}
+
+	return reader, nil
+}
@@ -166,10 +166,10 @@ func (sw *StructuredWriter) WriteLZ4(p []byte) error {
 }
 
 type StructuredReader struct {
-	r io.ReadSeekCloser
+	r io.ReadCloser
 }
 
-func NewStructuredReader(r io.ReadSeekCloser) *StructuredReader {
+func NewStructuredReader(r io.ReadCloser) *StructuredReader {
 	return &StructuredReader{r: r}
 }
 
@@ -178,8 +178,14 @@ func (sr *StructuredReader) Read(p []byte) (n int, err error) {
 	return sr.r.Read(p)
 }
 
+// Seek seeks the underlying reader, which must implement io.Seeker.
 func (sr *StructuredReader) Seek(offset int64, whence int) (int64, error) {
-	return sr.r.Seek(offset, whence)
+	seeker, ok := sr.r.(io.Seeker)
+	if !ok {
+		return 0, ErrNotSeekable
+	}
+
+	return seeker.Seek(offset, whence)
 }
 
 // Close closes the underlying reader.
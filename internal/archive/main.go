@@ -6,7 +6,9 @@ import "fmt"
 // - The data file
 // 	- For each block:
 // 		- For each column:
-// 			- The compressed chunk data (bytes)
+// 			- The validity bitmap (bytes), with a bit-packed flag for each row indicating whether the value
+// 			  is present. It's empty if all the values are present.
+// 			- The compressed chunk data of the present values (bytes)
 //  	- A checksum for the block
 // - The metadata file:
 //  - The format version (uint32)
@@ -23,17 +25,31 @@ import "fmt"
 // 			- For each column:
 //	 			- The chunk offset in the file (uint64)
 //	 			- The length of the compressed chunk (uint64)
-//	 			- In the future we may also add metadata, such as min/max values for the chunk
+//	 			- The encoding of the chunk values (uint8)
+//	 			- The statistics of the chunk:
+//	 				- The number of missing values (uvarint)
+//	 				- Whether the bounds are stored (uint8)
+//	 				- The min and max values, encoded according to the column type
 //
 // Each column data is split into BLOCK_SIZE row blocks, each chunk (block-column pair) is compressed separately.
+// The block size isn't stored in the file, so archives written with a different block size can be read as well.
 
 var ErrUnsupportedColumnType = fmt.Errorf("unsupported column type")
 var ErrUnsupportedFormatVersion = fmt.Errorf("unsupported format version")
 var ErrNoColumns = fmt.Errorf("at least one column is required")
+var ErrNotSeekable = fmt.Errorf("the underlying reader is not seekable")
+var ErrInvalidBlockSize = fmt.Errorf("the block size must be positive")
 
-const FORMAT_VERSION uint32 = 1
+// FORMAT_VERSION is the version of the written archives. Version 1 archives can still be read: they have
+// no validity bitmaps, so they can't contain missing values, they store all the chunks with the default
+// encoding of their column type and they have no chunk statistics.
+const FORMAT_VERSION uint32 = 2
+const FORMAT_VERSION_LEGACY uint32 = 1
 const BLOCK_SIZE int = 1000
 
+// MAX_DICTIONARY_SIZE is the maximum number of distinct values of a dictionary encoded string chunk.
+var MAX_DICTIONARY_SIZE = 4096
+
 type ColumnType uint16
 
 var (
@@ -43,11 +59,27 @@ var (
 	ColumnTypeBool    ColumnType = 3
 )
 
+// ChunkEncoding is the encoding of the values of a chunk, the writer chooses it for each chunk.
+// The default encoding depends on the column type: delta-of-delta and LZ4 for int64 columns, bit
+// packing and LZ4 for bool columns, and the raw values for float64 and string columns.
+type ChunkEncoding uint8
+
+var (
+	ChunkEncodingDefault ChunkEncoding = 0
+	// ChunkEncodingDictionary stores the distinct strings once, followed by the index of each value
+	ChunkEncodingDictionary ChunkEncoding = 1
+	// ChunkEncodingLZ4 compresses the raw strings with LZ4
+	ChunkEncodingLZ4 ChunkEncoding = 2
+	// ChunkEncodingGorilla stores each float XORed with the previous one, as in Gorilla
+	ChunkEncodingGorilla ChunkEncoding = 3
+)
+
 type ColumnDef struct {
 	Key  string
 	Type ColumnType
 }
 
+// Row contains a value for each column of the archive, the missing values are nil.
 type Row []any
 
 type blockMetadata struct {
@@ -55,6 +87,8 @@ type blockMetadata struct {
 }
 
 type chunkMetadata struct {
-	Offset uint64
-	Length uint64
+	Offset   uint64
+	Length   uint64
+	Encoding ChunkEncoding
+	Stats    ChunkStats
 }
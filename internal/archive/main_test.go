@@ -2,10 +2,16 @@ package archive
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"testing"
+
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+	"github.com/ZaninAndrea/microdot/pkg/compression"
 )
 
 type nopWriteCloser struct {
@@ -76,6 +82,125 @@ func TestReadWriteCycle(t *testing.T) {
 
 		checkReadWriteCycle(t, columns, rows)
 	})
+
+	t.Run("Sparse columns", func(t *testing.T) {
+		columns := []ColumnDef{
+			{Key: "ts", Type: ColumnTypeInt64},
+			{Key: "value", Type: ColumnTypeFloat64},
+			{Key: "meta", Type: ColumnTypeString},
+			{Key: "flag", Type: ColumnTypeBool},
+		}
+
+		// The second block has no values in the value column
+		rows := make([]Row, 0, 1500)
+		for i := 0; i < 1500; i++ {
+			row := Row{int64(2000 + i), nil, nil, nil}
+			if i%3 == 0 && i < BLOCK_SIZE {
+				row[1] = float64(i) * 0.1
+			}
+			if i%2 == 0 {
+				row[2] = fmt.Sprintf("generated_%d", i)
+				row[3] = i%4 == 0
+			}
+			rows = append(rows, row)
+		}
+
+		checkReadWriteCycle(t, columns, rows)
+	})
+}
+
+func TestReadLegacyVersion(t *testing.T) {
+	// Version 1 archives have no validity bitmaps, no chunk encodings and no chunk statistics
+	var dataBuf, metaBuf bytes.Buffer
+	data := StructuredWriter{w: NopWriteCloser(&dataBuf)}
+	data.WriteLZ4(compression.EncodeDeltaOfDelta([]int64{10, 20, 30}))
+	stringsOffset := data.Offset()
+	for _, str := range []string{"a", "", "c"} {
+		data.WriteString(str)
+	}
+
+	meta := StructuredWriter{w: NopWriteCloser(&metaBuf)}
+	meta.WriteUInt32(FORMAT_VERSION_LEGACY)
+	meta.WriteUvarint(0)
+	meta.WriteUvarint(2)
+	meta.WriteString("ts")
+	meta.WriteUInt16(uint16(ColumnTypeInt64))
+	meta.WriteString("msg")
+	meta.WriteUInt16(uint16(ColumnTypeString))
+	meta.WriteUvarint(1)
+	for _, chunk := range [][2]uint64{{0, stringsOffset}, {stringsOffset, data.Offset() - stringsOffset}} {
+		meta.WriteUInt64(chunk[0])
+		meta.WriteUInt64(chunk[1])
+	}
+
+	reader, err := NewReader(NopReadSeekCloser(bytes.NewReader(dataBuf.Bytes())), NopReadSeekCloser(bytes.NewReader(metaBuf.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	rows := []Row{}
+	for row := range reader.Rows() {
+		if row.IsErr() {
+			t.Fatal(row.Error())
+		}
+		rows = append(rows, row.Value)
+	}
+	if expected := []Row{{int64(10), "a"}, {int64(20), ""}, {int64(30), "c"}}; fmt.Sprint(rows) != fmt.Sprint(expected) {
+		t.Errorf("Rows() = %v, want %v", rows, expected)
+	}
+	if stats, err := reader.ChunkStats(0, 0); err != nil || stats != (ChunkStats{}) {
+		t.Errorf("ChunkStats() = %v, %v, want no bounds", stats, err)
+	}
+}
+
+func TestStringChunkEncoding(t *testing.T) {
+	columns := []ColumnDef{{Key: "level", Type: ColumnTypeString}, {Key: "msg", Type: ColumnTypeString}}
+	rows := make([]Row, 0, 2*BLOCK_SIZE)
+	for i := range 2 * BLOCK_SIZE {
+		rows = append(rows, Row{[]string{"info", "warn", "error"}[i%3], fmt.Sprintf("request %d", i)})
+	}
+
+	var dataBuf, metaBuf bytes.Buffer
+	writer, err := NewWriter(columns, nil, NopWriteCloser(&dataBuf), NopWriteCloser(&metaBuf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewReader(NopReadSeekCloser(bytes.NewReader(dataBuf.Bytes())), NopReadSeekCloser(bytes.NewReader(metaBuf.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// The low-cardinality column is dictionary encoded, the other one is compressed with LZ4
+	block, err := reader.blockMetadata(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Chunks[0].Encoding != ChunkEncodingDictionary || block.Chunks[1].Encoding != ChunkEncodingLZ4 {
+		t.Errorf("unexpected chunk encodings %v", block.Chunks)
+	}
+
+	i := 0
+	for row := range reader.Rows() {
+		if row.IsErr() {
+			t.Fatal(row.Error())
+		}
+		if fmt.Sprint(row.Value) != fmt.Sprint(rows[i]) {
+			t.Errorf("row %d = %v, want %v", i, row.Value, rows[i])
+		}
+		i++
+	}
+	if i != len(rows) {
+		t.Errorf("read %d rows, want %d", i, len(rows))
+	}
 }
 
 func checkReadWriteCycle(t *testing.T, columns []ColumnDef, rows []Row) {
@@ -144,14 +269,10 @@ func checkReadWriteCycle(t *testing.T, columns []ColumnDef, rows []Row) {
 			t.Fatalf("Row %d length mismatch", i)
 		}
 
-		if row[0] != expectedRow[0] {
-			t.Errorf("Row %d col 0 mismatch: got %v, want %v", i, row[0], expectedRow[0])
-		}
-		if row[1] != expectedRow[1] {
-			t.Errorf("Row %d col 1 mismatch: got %v, want %v", i, row[1], expectedRow[1])
-		}
-		if row[2] != expectedRow[2] {
-			t.Errorf("Row %d col 2 mismatch: got %v, want %v", i, row[2], expectedRow[2])
+		for j := range expectedRow {
+			if row[j] != expectedRow[j] {
+				t.Errorf("Row %d col %d mismatch: got %v, want %v", i, j, row[j], expectedRow[j])
+			}
 		}
 
 		i++
@@ -163,21 +284,59 @@ func checkReadWriteCycle(t *testing.T, columns []ColumnDef, rows []Row) {
 }
 
 func BenchmarkCompression(b *testing.B) {
-	columns := []ColumnDef{
-		{Key: "ts", Type: ColumnTypeInt64},
-		{Key: "value", Type: ColumnTypeFloat64},
-		{Key: "meta", Type: ColumnTypeString},
-	}
+	b.Run("Generated", func(b *testing.B) {
+		columns := []ColumnDef{
+			{Key: "ts", Type: ColumnTypeInt64},
+			{Key: "value", Type: ColumnTypeFloat64},
+			{Key: "meta", Type: ColumnTypeString},
+		}
 
-	rows := make([]Row, 0, 100000)
-	for i := 0; i < 100000; i++ {
-		rows = append(rows, Row{
-			int64(2000 + i),
-			float64(i) * 0.1,
-			fmt.Sprintf("generated_%d", i),
-		})
-	}
+		rows := make([]Row, 0, 100000)
+		for i := 0; i < 100000; i++ {
+			rows = append(rows, Row{
+				int64(2000 + i),
+				float64(i) * 0.1,
+				fmt.Sprintf("generated_%d", i),
+			})
+		}
 
+		benchmarkCompression(b, columns, rows)
+	})
+
+	b.Run("Metrics", func(b *testing.B) {
+		// Request logs with a latency and a duration that drift slowly, a few distinct values of the status
+		// and a gauge that changes rarely
+		columns := []ColumnDef{
+			{Key: "ts", Type: ColumnTypeInt64},
+			{Key: "latency", Type: ColumnTypeFloat64},
+			{Key: "duration", Type: ColumnTypeFloat64},
+			{Key: "connections", Type: ColumnTypeFloat64},
+			{Key: "status", Type: ColumnTypeString},
+		}
+
+		rng := rand.New(rand.NewSource(12345))
+		rows := make([]Row, 0, 100000)
+		latency, duration, connections := 50.0, 1.5, 100.0
+		for i := 0; i < 100000; i++ {
+			latency = math.Max(0, latency+rng.NormFloat64())
+			duration = math.Max(0, duration+rng.NormFloat64()*0.01)
+			if rng.Intn(100) == 0 {
+				connections += float64(rng.Intn(11) - 5)
+			}
+			rows = append(rows, Row{
+				int64(1_700_000_000_000 + i*10 + rng.Intn(5)),
+				math.Round(latency*100) / 100,
+				math.Round(duration*1000) / 1000,
+				connections,
+				[]string{"200", "200", "200", "201", "404", "500"}[rng.Intn(6)],
+			})
+		}
+
+		benchmarkCompression(b, columns, rows)
+	})
+}
+
+func benchmarkCompression(b *testing.B, columns []ColumnDef, rows []Row) {
 	inputBytes := benchmarkEstimateInputBytes(columns, rows)
 	var totalOutputBytes uint64
 
@@ -238,3 +397,273 @@ func benchmarkUvarintLen(value uint64) int {
 	var buf [binary.MaxVarintLen64]byte
 	return binary.PutUvarint(buf[:], value)
 }
+
+func TestRangeReader(t *testing.T) {
+	columns := []ColumnDef{
+		{Key: "ts", Type: ColumnTypeInt64},
+		{Key: "value", Type: ColumnTypeFloat64},
+		{Key: "meta", Type: ColumnTypeString},
+		{Key: "flag", Type: ColumnTypeBool},
+	}
+	rows := make([]Row, 0, 2500)
+	for i := range 2500 {
+		rows = append(rows, Row{int64(2000 + i), float64(i) * 0.1, fmt.Sprintf("generated_%d", i), i%2 == 0})
+	}
+
+	var dataBuf, metaBuf bytes.Buffer
+	writer, err := NewWriter(columns, nil, NopWriteCloser(&dataBuf), NopWriteCloser(&metaBuf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the chunks of the requested columns are fetched, the adjacent chunks with a single read
+	reads := 0
+	fetched := uint64(0)
+	reader, err := NewRangeReader(NopReadSeekCloser(bytes.NewReader(metaBuf.Bytes())), func(offset, length uint64) (io.ReadCloser, error) {
+		reads++
+		fetched += length
+		return io.NopCloser(bytes.NewReader(dataBuf.Bytes()[offset : offset+length])), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if reader.BlockCount() != 3 {
+		t.Fatalf("BlockCount() = %d, want 3", reader.BlockCount())
+	}
+	values, err := reader.ReadColumns(1, []int{2, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || len(values[0]) != BLOCK_SIZE || len(values[1]) != BLOCK_SIZE {
+		t.Fatalf("unexpected values shape")
+	}
+	if values[0][0] != "generated_1000" || values[1][BLOCK_SIZE-1] != int64(3999) {
+		t.Errorf("unexpected values %v, %v", values[0][0], values[1][BLOCK_SIZE-1])
+	}
+	if reads != 2 || fetched >= uint64(dataBuf.Len()) {
+		t.Errorf("fetched %d bytes in %d reads, the data file has %d bytes", fetched, reads, dataBuf.Len())
+	}
+
+	reads = 0
+	values, err = reader.ReadColumns(2, []int{2, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0][0] != "generated_2000" || values[1][0] != 200.0 {
+		t.Errorf("unexpected values %v, %v", values[0][0], values[1][0])
+	}
+	if reads != 1 {
+		t.Errorf("fetched the adjacent chunks in %d reads, want 1", reads)
+	}
+}
+
+func TestRowsWhere(t *testing.T) {
+	columns := []ColumnDef{
+		{Key: "ts", Type: ColumnTypeInt64},
+		{Key: "latency", Type: ColumnTypeFloat64},
+		{Key: "level", Type: ColumnTypeString},
+	}
+	rows := make([]Row, 0, 5*BLOCK_SIZE)
+	for i := range 5 * BLOCK_SIZE {
+		row := Row{int64(i), nil, "info"}
+		if i%2 == 0 {
+			row[1] = float64(i) / 10
+		}
+		if i >= 4*BLOCK_SIZE {
+			row[2] = "error"
+		}
+		rows = append(rows, row)
+	}
+
+	var dataBuf, metaBuf bytes.Buffer
+	writer, err := NewWriter(columns, nil, NopWriteCloser(&dataBuf), NopWriteCloser(&metaBuf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fetched := []uint64{}
+	reader, err := NewRangeReader(NopReadSeekCloser(bytes.NewReader(metaBuf.Bytes())), func(offset, length uint64) (io.ReadCloser, error) {
+		fetched = append(fetched, offset)
+		return io.NopCloser(bytes.NewReader(dataBuf.Bytes()[offset : offset+length])), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	stats, err := reader.ChunkStats(2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (ChunkStats{Min: 200.0, Max: 299.8, NullCount: BLOCK_SIZE / 2}); stats != expected {
+		t.Errorf("ChunkStats() = %v, want %v", stats, expected)
+	}
+
+	// Only the blocks overlapping the time range are fetched, with one read for each block
+	matches := 0
+	for row := range reader.RowsWhere([]Predicate{{Column: 0, Min: int64(2500), Max: int64(3499)}}) {
+		if row.IsErr() {
+			t.Fatal(row.Error())
+		}
+		if ts := row.Value[0].(int64); ts < 2500 || ts > 3499 {
+			t.Errorf("unexpected row %v", row.Value)
+		}
+		matches++
+	}
+	if matches != 1000 {
+		t.Errorf("RowsWhere() returned %d rows, want 1000", matches)
+	}
+	if len(fetched) != 2 {
+		t.Errorf("fetched the data in %d reads, want one read for each of the 2 blocks", len(fetched))
+	}
+
+	// The sequential readers read past the skipped blocks
+	sequential, err := NewReader(NopReadSeekCloser(bytes.NewReader(dataBuf.Bytes())), NopReadSeekCloser(bytes.NewReader(metaBuf.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sequential.Close()
+	first, last := int64(-1), int64(-1)
+	for row := range sequential.RowsWhere([]Predicate{{Column: 0, Min: int64(2500), Max: int64(3499)}}) {
+		if row.IsErr() {
+			t.Fatal(row.Error())
+		}
+		if first < 0 {
+			first = row.Value[0].(int64)
+		}
+		last = row.Value[0].(int64)
+	}
+	if first != 2500 || last != 3499 {
+		t.Errorf("RowsWhere() returned the rows from %d to %d, want from 2500 to 3499", first, last)
+	}
+
+	// The predicates on the strings and on the sparse columns prune the blocks as well
+	fetched = fetched[:0]
+	matches = 0
+	predicates := []Predicate{{Column: 2, Min: "error", Max: "error"}, {Column: 1, Min: 450.0}}
+	for row := range reader.RowsWhere(predicates) {
+		if row.IsErr() {
+			t.Fatal(row.Error())
+		}
+		matches++
+	}
+	if matches != 250 || len(fetched) != 1 {
+		t.Errorf("RowsWhere() returned %d rows in %d reads, want 250 rows from a single block", matches, len(fetched))
+	}
+}
+
+// rangeBucket counts the range reads of the objects and the bytes they fetch.
+type rangeBucket struct {
+	*blob.DiskBucket
+	reads   int
+	fetched int
+}
+
+func (b *rangeBucket) GetObjectRange(ctx context.Context, key string, start, end int) (io.ReadCloser, error) {
+	b.reads++
+	b.fetched += end - start + 1
+	return b.DiskBucket.GetObjectRange(ctx, key, start, end)
+}
+
+func TestBucketReader(t *testing.T) {
+	ctx := context.Background()
+	diskBucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := &rangeBucket{DiskBucket: diskBucket}
+
+	columns := []ColumnDef{
+		{Key: "ts", Type: ColumnTypeInt64},
+		{Key: "msg", Type: ColumnTypeString},
+		{Key: "latency", Type: ColumnTypeFloat64},
+	}
+	rows := make([]Row, 0, 3*BLOCK_SIZE)
+	for i := range 3 * BLOCK_SIZE {
+		rows = append(rows, Row{int64(i), fmt.Sprintf("request %d served", rand.Int63()), float64(i) / 10})
+	}
+
+	var dataBuf, metaBuf bytes.Buffer
+	writer, err := NewWriter(columns, nil, NopWriteCloser(&dataBuf), NopWriteCloser(&metaBuf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dataSize := dataBuf.Len()
+	if err := bucket.PutObject(ctx, "archive.data.bin", &dataBuf, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.PutObject(ctx, "archive.metadata.bin", &metaBuf, false); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewBucketReader(ctx, bucket, "archive.data.bin", "archive.metadata.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// Scanning a single column fetches only its chunks, leaving out the messages
+	i := 0
+	for row := range reader.Scan([]int{2}, nil) {
+		if row.IsErr() {
+			t.Fatal(row.Error())
+		}
+		if len(row.Value) != 1 || row.Value[0] != rows[i][2] {
+			t.Fatalf("row %d = %v, want [%v]", i, row.Value, rows[i][2])
+		}
+		i++
+	}
+	if i != len(rows) {
+		t.Errorf("Scan() returned %d rows, want %d", i, len(rows))
+	}
+	if bucket.reads != 3 || bucket.fetched >= dataSize/2 {
+		t.Errorf("fetched %d bytes in %d reads, the data file has %d bytes", bucket.fetched, bucket.reads, dataSize)
+	}
+
+	// The projected columns are returned in the given order, and the adjacent chunks of the projected and
+	// filtered columns are fetched with a single read
+	bucket.reads, bucket.fetched = 0, 0
+	i = 0
+	for row := range reader.Scan([]int{1, 0}, []Predicate{{Column: 2, Min: 150.0}}) {
+		if row.IsErr() {
+			t.Fatal(row.Error())
+		}
+		expected := rows[1500+i]
+		if len(row.Value) != 2 || row.Value[0] != expected[1] || row.Value[1] != expected[0] {
+			t.Fatalf("row %d = %v, want [%v %v]", i, row.Value, expected[1], expected[0])
+		}
+		i++
+	}
+	if i != len(rows)-1500 {
+		t.Errorf("Scan() returned %d rows, want %d", i, len(rows)-1500)
+	}
+	if bucket.reads != 2 {
+		t.Errorf("fetched the data in %d reads, want one read for each of the 2 matching blocks", bucket.reads)
+	}
+
+	for row := range reader.Scan([]int{3}, nil) {
+		if row.IsOk() {
+			t.Fatalf("Scan() of a missing column returned %v", row.Value)
+		}
+	}
+}
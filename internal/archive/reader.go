@@ -2,24 +2,30 @@ package archive
 
 import (
 	"bytes"
+	"cmp"
 	"fmt"
 	"io"
 	"iter"
 	"maps"
 	"os"
 	"path"
+	"slices"
 
 	"github.com/ZaninAndrea/microdot/pkg/compression"
 	"github.com/ZaninAndrea/microdot/pkg/containers"
 )
 
 type Reader struct {
-	dataFile     StructuredReader
+	dataFile StructuredReader
+	// readRange, if set, fetches a byte range of the data file, which is used instead of dataFile
+	readRange    func(offset, length uint64) (io.ReadCloser, error)
 	metadataFile StructuredReader
-	labels       map[string]string
-	columnDefs   []ColumnDef
-	blockCount   uint64
-	blocks       []blockMetadata
+	// formatVersion is the version of the archive, the chunks of version 1 archives have no validity bitmap
+	formatVersion uint32
+	labels        map[string]string
+	columnDefs    []ColumnDef
+	blockCount    uint64
+	blocks        []blockMetadata
 }
 
 func NewReader(dataFile, metadataFile io.ReadCloser) (*Reader, error) {
@@ -36,6 +42,24 @@ func NewReader(dataFile, metadataFile io.ReadCloser) (*Reader, error) {
 	return reader, nil
 }
 
+// NewRangeReader creates a reader that doesn't stream the data file, instead it fetches only the byte ranges
+// containing the chunks that are read. This is useful when the data file is in a remote storage and only
+// a few blocks are needed.
+func NewRangeReader(metadataFile io.ReadCloser, readRange func(offset, length uint64) (io.ReadCloser, error)) (*Reader, error) {
+	reader := &Reader{
+		dataFile:     StructuredReader{r: io.NopCloser(bytes.NewReader(nil))},
+		readRange:    readRange,
+		metadataFile: StructuredReader{r: metadataFile},
+	}
+
+	err := reader.readMetadataHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
 func NewReaderFS(folder, name string) (*Reader, error) {
 	// Open the data and metadata files for reading
 	dataFile, err := os.Open(path.Join(folder, name+".data.bin"))
@@ -57,9 +81,10 @@ func (r *Reader) readMetadataHeader() error {
 		return err
 	}
 
-	if formatVersion != FORMAT_VERSION {
+	if formatVersion != FORMAT_VERSION_LEGACY && formatVersion != FORMAT_VERSION {
 		return ErrUnsupportedFormatVersion
 	}
+	r.formatVersion = formatVersion
 
 	numLabels, err := r.metadataFile.ReadUvarint()
 	if err != nil {
@@ -118,6 +143,11 @@ func (r *Reader) Columns() []ColumnDef {
 	return r.columnDefs
 }
 
+// BlockCount returns the number of blocks in the archive.
+func (r *Reader) BlockCount() int {
+	return int(r.blockCount)
+}
+
 func (r *Reader) Labels() map[string]string {
 	return maps.Clone(r.labels)
 }
@@ -161,9 +191,21 @@ func (r *Reader) blockMetadata(i int) (blockMetadata, error) {
 				return blockMetadata{}, err
 			}
 
-			blockMeta.Chunks[j] = chunkMetadata{
-				Offset: offset,
-				Length: length,
+			blockMeta.Chunks[j] = chunkMetadata{Offset: offset, Length: length}
+			if r.formatVersion == FORMAT_VERSION_LEGACY {
+				// The legacy chunks have the default encoding and no statistics
+				continue
+			}
+
+			encoding, err := r.metadataFile.ReadUint8()
+			if err != nil {
+				return blockMetadata{}, err
+			}
+			blockMeta.Chunks[j].Encoding = ChunkEncoding(encoding)
+
+			blockMeta.Chunks[j].Stats, err = r.readChunkStats(r.columnDefs[j].Type)
+			if err != nil {
+				return blockMetadata{}, err
 			}
 		}
 
@@ -173,11 +215,97 @@ func (r *Reader) blockMetadata(i int) (blockMetadata, error) {
 	return r.blocks[i], nil
 }
 
+func (r *Reader) readChunkStats(columnType ColumnType) (ChunkStats, error) {
+	nullCount, err := r.metadataFile.ReadUvarint()
+	if err != nil {
+		return ChunkStats{}, err
+	}
+	stats := ChunkStats{NullCount: int(nullCount)}
+
+	hasBounds, err := r.metadataFile.ReadUint8()
+	if err != nil || hasBounds == 0 {
+		return stats, err
+	}
+
+	bounds := make([]any, 2)
+	for i := range bounds {
+		switch columnType {
+		case ColumnTypeInt64:
+			bounds[i], err = r.metadataFile.ReadVarint()
+		case ColumnTypeFloat64:
+			bounds[i], err = r.metadataFile.ReadFloat64()
+		case ColumnTypeString:
+			bounds[i], err = r.metadataFile.ReadString()
+		case ColumnTypeBool:
+			var rank uint8
+			rank, err = r.metadataFile.ReadUint8()
+			bounds[i] = rank == 1
+		default:
+			err = ErrUnsupportedColumnType
+		}
+		if err != nil {
+			return ChunkStats{}, err
+		}
+	}
+	stats.Min, stats.Max = bounds[0], bounds[1]
+
+	return stats, nil
+}
+
+// ChunkStats returns the statistics of the values of the column in the i-th block.
+func (r *Reader) ChunkStats(i int, column int) (ChunkStats, error) {
+	blockMeta, err := r.blockMetadata(i)
+	if err != nil {
+		return ChunkStats{}, err
+	}
+	if column < 0 || column >= len(r.columnDefs) {
+		return ChunkStats{}, fmt.Errorf("column index out of range")
+	}
+
+	return blockMeta.Chunks[column].Stats, nil
+}
+
 // Rows returns an iterator over the rows in the archive.
 //
 // It reads the data one block at a time and buffers the rows in memory.
 func (r *Reader) Rows() iter.Seq[containers.Result[Row]] {
+	return r.Scan(nil, nil)
+}
+
+// RowsWhere returns an iterator over the rows in the archive matching all the predicates.
+func (r *Reader) RowsWhere(predicates []Predicate) iter.Seq[containers.Result[Row]] {
+	return r.Scan(nil, predicates)
+}
+
+// Scan returns an iterator over the rows in the archive matching all the predicates, each row contains
+// only the values of the projected columns, in the given order. A nil projection selects all the columns.
+//
+// Only the chunks of the projected columns and of the columns of the predicates are decoded, and the blocks
+// whose statistics show that none of their rows can match are skipped. The readers created with
+// NewRangeReader or NewBucketReader don't fetch the other chunks at all, while the other readers still have
+// to read past them.
+func (r *Reader) Scan(projection []int, predicates []Predicate) iter.Seq[containers.Result[Row]] {
 	return func(yield func(containers.Result[Row]) bool) {
+		if projection == nil {
+			projection = make([]int, len(r.columnDefs))
+			for i := range projection {
+				projection[i] = i
+			}
+		}
+
+		needed := slices.Clone(projection)
+		for _, predicate := range predicates {
+			needed = append(needed, predicate.Column)
+		}
+		for _, column := range needed {
+			if column < 0 || column >= len(r.columnDefs) {
+				yield(containers.Err[Row](fmt.Errorf("column index out of range")))
+				return
+			}
+		}
+		slices.Sort(needed)
+		needed = slices.Compact(needed)
+
 		for blockIndex := 0; blockIndex < int(r.blockCount); blockIndex++ {
 			blockMeta, err := r.blockMetadata(blockIndex)
 			if err != nil {
@@ -185,19 +313,34 @@ func (r *Reader) Rows() iter.Seq[containers.Result[Row]] {
 				return
 			}
 
-			// Read a whole block of columns
-			columns, err := r.readBlockColumns(blockMeta)
+			if !blockMayMatch(blockMeta, predicates) {
+				if err := r.skipBlock(blockMeta); err != nil {
+					yield(containers.Err[Row](err))
+					return
+				}
+				continue
+			}
+
+			// Read a whole block of the needed columns
+			columns, err := r.readBlockColumns(blockMeta, needed)
 			if err != nil {
 				yield(containers.Err[Row](err))
 				return
 			}
 
 			// Return the rows one by one, building them as we go
-			numRows := len(columns[0])
+			numRows := 0
+			if len(needed) > 0 {
+				numRows = len(columns[needed[0]])
+			}
 			for i := 0; i < numRows; i++ {
-				row := make(Row, len(r.columnDefs))
-				for j := range r.columnDefs {
-					row[j] = columns[j][i]
+				if !rowMatches(columns, i, predicates) {
+					continue
+				}
+
+				row := make(Row, len(projection))
+				for j, column := range projection {
+					row[j] = columns[column][i]
 				}
 
 				if !yield(containers.Ok(row)) {
@@ -208,85 +351,115 @@ func (r *Reader) Rows() iter.Seq[containers.Result[Row]] {
 	}
 }
 
-// readBlockColumns reads the columns of a block and returns them as a 2D slice of any ([][]any).
-// The outer slice represents the columns, while the inner slices represent the values of each column.
-func (r *Reader) readBlockColumns(blockMeta blockMetadata) ([][]any, error) {
-	columns := make([][]any, len(r.columnDefs))
-	for i, columnDef := range r.columnDefs {
-		switch columnDef.Type {
-		case ColumnTypeInt64:
-			data, err := r.readInt64Column(blockMeta.Chunks[i])
-			if err != nil {
-				return nil, err
-			}
-			columns[i] = data
-		case ColumnTypeFloat64:
-			data, err := r.readFloat64Column(blockMeta.Chunks[i])
-			if err != nil {
-				return nil, err
-			}
-			columns[i] = data
-		case ColumnTypeString:
-			data, err := r.readStringColumn(blockMeta.Chunks[i])
-			if err != nil {
-				return nil, err
-			}
-			columns[i] = data
-		case ColumnTypeBool:
-			data, err := r.readBoolColumn(blockMeta.Chunks[i])
-			if err != nil {
-				return nil, err
-			}
-			columns[i] = data
-		default:
-			return nil, ErrUnsupportedColumnType
+func blockMayMatch(blockMeta blockMetadata, predicates []Predicate) bool {
+	for _, predicate := range predicates {
+		if !predicate.mayMatch(blockMeta.Chunks[predicate.Column].Stats) {
+			return false
 		}
 	}
 
-	return columns, nil
+	return true
 }
 
-func (r *Reader) readInt64Column(chunkMetadata chunkMetadata) ([]any, error) {
-	chunkReader, err := r.getChunkReader(chunkMetadata)
-	if err != nil {
-		return nil, err
+func rowMatches(columns [][]any, row int, predicates []Predicate) bool {
+	for _, predicate := range predicates {
+		if !predicate.Matches(columns[predicate.Column][row]) {
+			return false
+		}
 	}
-	defer chunkReader.Close()
 
-	data, err := chunkReader.ReadLZ4()
-	if err != nil {
-		return nil, err
+	return true
+}
+
+// skipBlock moves the sequential reader of the data file past the chunks of the block.
+func (r *Reader) skipBlock(blockMeta blockMetadata) error {
+	if r.readRange != nil {
+		return nil
 	}
 
-	return compression.DecodeDeltaOfDelta(data)
+	length := uint64(0)
+	for _, chunk := range blockMeta.Chunks {
+		length += chunk.Length
+	}
+	_, err := io.CopyN(io.Discard, &r.dataFile, int64(length))
+	return err
 }
 
-func (r *Reader) readBoolColumn(chunkMetadata chunkMetadata) ([]any, error) {
-	chunkReader, err := r.getChunkReader(chunkMetadata)
+// ReadColumns reads the values of the given columns in the i-th block, returning one slice of values for each
+// requested column. The adjacent chunks are fetched with a single read of the data file, so the reader must
+// have been created with NewRangeReader, with NewBucketReader or with a seekable data file.
+func (r *Reader) ReadColumns(i int, columns []int) ([][]any, error) {
+	blockMeta, err := r.blockMetadata(i)
 	if err != nil {
 		return nil, err
 	}
-	defer chunkReader.Close()
+	for _, column := range columns {
+		if column < 0 || column >= len(r.columnDefs) {
+			return nil, fmt.Errorf("column index out of range")
+		}
+	}
 
-	data, err := chunkReader.ReadLZ4()
+	blockColumns, err := r.readChunkRanges(blockMeta, columns)
 	if err != nil {
 		return nil, err
 	}
 
-	return compression.DecodeBitPacking(data)
+	values := make([][]any, len(columns))
+	for j, column := range columns {
+		values[j] = blockColumns[column]
+	}
+	return values, nil
 }
 
-func (r *Reader) readFloat64Column(chunkMetadata chunkMetadata) ([]any, error) {
-	chunkReader, err := r.getChunkReader(chunkMetadata)
-	if err != nil {
+// readDataRange reads length bytes of the data file starting from offset.
+func (r *Reader) readDataRange(offset, length uint64) ([]byte, error) {
+	data := make([]byte, length)
+	if length == 0 {
+		return data, nil
+	}
+
+	if r.readRange != nil {
+		rangeReader, err := r.readRange(offset, length)
+		if err != nil {
+			return nil, err
+		}
+		defer rangeReader.Close()
+
+		if _, err := io.ReadFull(rangeReader, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	if _, err := r.dataFile.Seek(int64(offset), io.SeekStart); err != nil {
 		return nil, err
 	}
-	defer chunkReader.Close()
+	if _, err := io.ReadFull(&r.dataFile, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readBlockColumns reads the given columns of a block and returns them as a 2D slice of any ([][]any).
+// The outer slice is indexed by column, and contains nil for the columns that weren't read, while the inner
+// slices represent the values of each column.
+func (r *Reader) readBlockColumns(blockMeta blockMetadata, columns []int) ([][]any, error) {
+	if r.readRange != nil {
+		return r.readChunkRanges(blockMeta, columns)
+	}
 
-	// Read the float64 values from the byte slice
-	values := make([]any, chunkMetadata.Length/8)
-	for i := 0; i < len(values); i++ {
-		values[i], err = chunkReader.ReadFloat64()
+	// The data file is read sequentially, so all the chunks are read but only the needed ones are decoded
+	values := make([][]any, len(r.columnDefs))
+	for i, columnDef := range r.columnDefs {
+		data, err := r.readChunk(blockMeta.Chunks[i])
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(columns, i) {
+			continue
+		}
+
+		values[i], err = r.decodeChunk(columnDef.Type, blockMeta.Chunks[i].Encoding, data)
 		if err != nil {
 			return nil, err
 		}
@@ -295,36 +468,184 @@ func (r *Reader) readFloat64Column(chunkMetadata chunkMetadata) ([]any, error) {
 	return values, nil
 }
 
-func (r *Reader) readStringColumn(chunkMetadata chunkMetadata) ([]any, error) {
-	chunkReader, err := r.getChunkReader(chunkMetadata)
-	if err != nil {
-		return nil, err
+// byteRange is a range of the data file containing some adjacent chunks.
+type byteRange struct {
+	offset  uint64
+	length  uint64
+	columns []int
+}
+
+// coalesceChunks groups the chunks of the given columns in the ranges of the data file to fetch, merging
+// the adjacent chunks in a single range.
+func coalesceChunks(blockMeta blockMetadata, columns []int) []byteRange {
+	columns = slices.Clone(columns)
+	slices.SortFunc(columns, func(a, b int) int {
+		return cmp.Compare(blockMeta.Chunks[a].Offset, blockMeta.Chunks[b].Offset)
+	})
+
+	ranges := []byteRange{}
+	for _, column := range slices.Compact(columns) {
+		chunk := blockMeta.Chunks[column]
+		if last := len(ranges) - 1; last >= 0 && ranges[last].offset+ranges[last].length == chunk.Offset {
+			ranges[last].length += chunk.Length
+			ranges[last].columns = append(ranges[last].columns, column)
+			continue
+		}
+
+		ranges = append(ranges, byteRange{offset: chunk.Offset, length: chunk.Length, columns: []int{column}})
 	}
-	defer chunkReader.Close()
 
-	// Read the string values from the byte slice
-	values := make([]any, 0)
-	for {
-		str, err := chunkReader.ReadString()
-		if err == io.EOF {
-			break
-		} else if err != nil {
+	return ranges
+}
+
+// readChunkRanges fetches the chunks of the given columns with one read for each group of adjacent chunks,
+// the result is indexed as readBlockColumns.
+func (r *Reader) readChunkRanges(blockMeta blockMetadata, columns []int) ([][]any, error) {
+	values := make([][]any, len(r.columnDefs))
+	for _, dataRange := range coalesceChunks(blockMeta, columns) {
+		data, err := r.readDataRange(dataRange.offset, dataRange.length)
+		if err != nil {
 			return nil, err
 		}
-		values = append(values, str)
+
+		for _, column := range dataRange.columns {
+			chunk := blockMeta.Chunks[column]
+			start := chunk.Offset - dataRange.offset
+			values[column], err = r.decodeChunk(r.columnDefs[column].Type, chunk.Encoding, data[start:start+chunk.Length])
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return values, nil
 }
 
-func (r *Reader) getChunkReader(chunkMetadata chunkMetadata) (*StructuredReader, error) {
+// readChunk reads the next chunk of the data file, which is read sequentially, so the chunks must be read
+// in the order they were written.
+func (r *Reader) readChunk(chunkMetadata chunkMetadata) ([]byte, error) {
+	// The data file may be a network stream, which can return less bytes than requested
 	data := make([]byte, chunkMetadata.Length)
-	_, err := r.dataFile.Read(data)
+	if _, err := io.ReadFull(&r.dataFile, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// decodeChunk decodes the values of a chunk of a column with the given type, the missing values are nil.
+func (r *Reader) decodeChunk(columnType ColumnType, encoding ChunkEncoding, data []byte) ([]any, error) {
+	dataReader := bytes.NewReader(data)
+	chunkReader := &StructuredReader{r: byteReadCloser{Reader: dataReader}}
+	if r.formatVersion == FORMAT_VERSION_LEGACY {
+		return decodeValues(columnType, encoding, chunkReader, len(data))
+	}
+
+	validity, err := chunkReader.ReadBytes()
+	if err != nil {
+		return nil, err
+	}
+	values, err := decodeValues(columnType, encoding, chunkReader, dataReader.Len())
+	if err != nil || len(validity) == 0 {
+		return values, err
+	}
+
+	return expandNulls(values, validity)
+}
+
+// expandNulls places the present values at the rows flagged in the validity bitmap, leaving nil in
+// the other rows.
+func expandNulls(values []any, validity []byte) ([]any, error) {
+	present, err := compression.DecodeBitPacking(validity)
 	if err != nil {
 		return nil, err
 	}
 
-	return &StructuredReader{r: byteReadCloser{Reader: bytes.NewReader(data)}}, nil
+	expanded := make([]any, len(present))
+	next := 0
+	for i, isPresent := range present {
+		if !isPresent.(bool) {
+			continue
+		}
+		if next >= len(values) {
+			return nil, fmt.Errorf("the validity bitmap has more present values than the chunk")
+		}
+		expanded[i] = values[next]
+		next++
+	}
+	if next != len(values) {
+		return nil, fmt.Errorf("the validity bitmap has less present values than the chunk")
+	}
+
+	return expanded, nil
+}
+
+// decodeValues decodes the encoded values of a column with the given type, which take the remaining
+// length bytes of the chunk.
+func decodeValues(columnType ColumnType, encoding ChunkEncoding, chunkReader *StructuredReader, length int) ([]any, error) {
+	switch encoding {
+	case ChunkEncodingDefault:
+		// The values are decoded below according to the column type
+	case ChunkEncodingDictionary:
+		encoded, err := chunkReader.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		return compression.DecodeDictionary(encoded)
+	case ChunkEncodingGorilla:
+		encoded, err := chunkReader.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		return compression.DecodeGorilla(encoded)
+	case ChunkEncodingLZ4:
+		decompressed, err := chunkReader.ReadLZ4()
+		if err != nil {
+			return nil, err
+		}
+		return decodeValues(columnType, ChunkEncodingDefault, &StructuredReader{r: byteReadCloser{Reader: bytes.NewReader(decompressed)}}, len(decompressed))
+	default:
+		return nil, fmt.Errorf("unsupported chunk encoding %d", encoding)
+	}
+
+	switch columnType {
+	case ColumnTypeInt64:
+		decompressed, err := chunkReader.ReadLZ4()
+		if err != nil {
+			return nil, err
+		}
+		return compression.DecodeDeltaOfDelta(decompressed)
+	case ColumnTypeBool:
+		decompressed, err := chunkReader.ReadLZ4()
+		if err != nil {
+			return nil, err
+		}
+		return compression.DecodeBitPacking(decompressed)
+	case ColumnTypeFloat64:
+		values := make([]any, length/8)
+		for i := range values {
+			value, err := chunkReader.ReadFloat64()
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	case ColumnTypeString:
+		values := make([]any, 0)
+		for {
+			str, err := chunkReader.ReadString()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			values = append(values, str)
+		}
+		return values, nil
+	default:
+		return nil, ErrUnsupportedColumnType
+	}
 }
 
 type byteReadCloser struct {
@@ -0,0 +1,151 @@
+package archive
+
+import (
+	"cmp"
+	"math"
+	"strings"
+)
+
+// MAX_STATS_STRING_LENGTH is the maximum length of the string bounds stored in the chunk statistics, the
+// chunks with longer bounds, such as the ones of the messages, have no bounds.
+var MAX_STATS_STRING_LENGTH = 64
+
+// ChunkStats are the statistics of the values of a column in a block.
+type ChunkStats struct {
+	// Min and Max are the bounds of the present values, NaN floats excluded. They are nil if the chunk
+	// has no values, or if the bounds weren't stored.
+	Min any
+	Max any
+	// NullCount is the number of missing values
+	NullCount int
+}
+
+// Predicate restricts the values of a column to an inclusive range, a nil bound is unbounded.
+// The rows with a missing value in the column don't match.
+type Predicate struct {
+	Column int
+	Min    any
+	Max    any
+}
+
+// Matches reports whether the value satisfies the predicate.
+func (p Predicate) Matches(value any) bool {
+	if value == nil {
+		return false
+	}
+	if p.Min != nil {
+		if c, ok := compareValues(value, p.Min); !ok || c < 0 {
+			return false
+		}
+	}
+	if p.Max != nil {
+		if c, ok := compareValues(value, p.Max); !ok || c > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mayMatch reports whether some values of a chunk with the given statistics may satisfy the predicate.
+func (p Predicate) mayMatch(stats ChunkStats) bool {
+	if stats.Min == nil || stats.Max == nil {
+		return true
+	}
+
+	if p.Min != nil {
+		if c, ok := compareValues(stats.Max, p.Min); ok && c < 0 {
+			return false
+		}
+	}
+	if p.Max != nil {
+		if c, ok := compareValues(stats.Min, p.Max); ok && c > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// computeStats returns the statistics of the present values of a chunk of a column with the given type.
+func computeStats(columnType ColumnType, values []any, nullCount int) ChunkStats {
+	stats := ChunkStats{NullCount: nullCount}
+	for _, value := range values {
+		if f, ok := value.(float64); ok && math.IsNaN(f) {
+			continue
+		}
+		if !hasColumnType(value, columnType) {
+			// The writer converts the values with other types, which are not worth tracking
+			return ChunkStats{NullCount: nullCount}
+		}
+
+		if c, ok := compareValues(value, stats.Min); stats.Min == nil || (ok && c < 0) {
+			stats.Min = value
+		}
+		if c, ok := compareValues(value, stats.Max); stats.Max == nil || (ok && c > 0) {
+			stats.Max = value
+		}
+	}
+
+	// The long strings would bloat the metadata file
+	minStr, minIsString := stats.Min.(string)
+	maxStr, _ := stats.Max.(string)
+	if minIsString && max(len(minStr), len(maxStr)) > MAX_STATS_STRING_LENGTH {
+		stats.Min, stats.Max = nil, nil
+	}
+
+	return stats
+}
+
+func hasColumnType(value any, columnType ColumnType) bool {
+	switch value.(type) {
+	case int64:
+		return columnType == ColumnTypeInt64
+	case float64:
+		return columnType == ColumnTypeFloat64
+	case string:
+		return columnType == ColumnTypeString
+	case bool:
+		return columnType == ColumnTypeBool
+	}
+
+	return false
+}
+
+// compareValues compares two values of the same column type, the int64 and float64 values can be compared
+// with each other. It returns false if the values can't be compared.
+func compareValues(a, b any) (int, bool) {
+	switch a := a.(type) {
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return cmp.Compare(a, b), true
+		case float64:
+			return cmp.Compare(float64(a), b), true
+		}
+	case float64:
+		switch b := b.(type) {
+		case int64:
+			return cmp.Compare(a, float64(b)), true
+		case float64:
+			return cmp.Compare(a, b), true
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			return cmp.Compare(boolRank(a), boolRank(b)), true
+		}
+	}
+
+	return 0, false
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
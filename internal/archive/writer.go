@@ -1,6 +1,8 @@
 package archive
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"maps"
@@ -17,21 +19,32 @@ type Writer struct {
 	metadataFile StructuredWriter
 	columns      []ColumnDef
 	labels       map[string]string
+	blockSize    int
 
 	bufferedRows []Row
 	blocks       []blockMetadata
 }
 
 func NewWriter(columns []ColumnDef, labels types.Labels, dataFile, metadataFile io.WriteCloser) (*Writer, error) {
+	return NewWriterWithBlockSize(columns, labels, dataFile, metadataFile, BLOCK_SIZE)
+}
+
+// NewWriterWithBlockSize creates a writer that splits the rows in blocks of blockSize rows. Larger blocks
+// compress better, but the readers need to decode a whole block to read any of its rows.
+func NewWriterWithBlockSize(columns []ColumnDef, labels types.Labels, dataFile, metadataFile io.WriteCloser, blockSize int) (*Writer, error) {
 	if len(columns) == 0 {
 		return nil, ErrNoColumns
 	}
+	if blockSize <= 0 {
+		return nil, ErrInvalidBlockSize
+	}
 
 	writer := &Writer{
 		dataFile:     StructuredWriter{w: dataFile},
 		metadataFile: StructuredWriter{w: metadataFile},
 		columns:      columns,
 		labels:       maps.Clone(labels),
+		blockSize:    blockSize,
 		bufferedRows: []Row{},
 		blocks:       []blockMetadata{},
 	}
@@ -104,19 +117,19 @@ func (w *Writer) writeMetadataHeader() error {
 func (w *Writer) Write(rows []Row) error {
 	w.bufferedRows = append(w.bufferedRows, rows...)
 
-	for len(w.bufferedRows) >= BLOCK_SIZE {
+	for len(w.bufferedRows) >= w.blockSize {
 		if err := w.writeChunk(); err != nil {
 			return err
 		}
-		w.bufferedRows = w.bufferedRows[BLOCK_SIZE:]
+		w.bufferedRows = w.bufferedRows[w.blockSize:]
 	}
 
 	return nil
 }
 
 func (w *Writer) writeChunk() error {
-	chunkEnd := BLOCK_SIZE
-	if len(w.bufferedRows) < BLOCK_SIZE {
+	chunkEnd := w.blockSize
+	if len(w.bufferedRows) < w.blockSize {
 		chunkEnd = len(w.bufferedRows)
 	}
 
@@ -124,32 +137,38 @@ func (w *Writer) writeChunk() error {
 	rows := w.bufferedRows[:chunkEnd]
 	for i := range w.columns {
 		startOffset := w.dataFile.Offset()
+
+		// Only the present values are encoded, the validity bitmap tells the reader where they belong
+		values, validity := splitNulls(rows, i)
+		if err := w.dataFile.WriteBytes(validity); err != nil {
+			return err
+		}
+
+		encoding := ChunkEncodingDefault
+		var err error
 		switch w.columns[i].Type {
 		case ColumnTypeInt64:
-			if err := w.writeInt64Column(rows, i); err != nil {
-				return err
-			}
+			err = w.writeInt64Column(values)
 		case ColumnTypeFloat64:
-			if err := w.writeFloat64Column(rows, i); err != nil {
-				return err
-			}
+			encoding, err = ChunkEncodingGorilla, w.writeFloat64Column(values)
 		case ColumnTypeString:
-			if err := w.writeStringColumn(rows, i); err != nil {
-				return err
-			}
+			encoding, err = w.writeStringColumn(values)
 		case ColumnTypeBool:
-			if err := w.writeBoolColumn(rows, i); err != nil {
-				return err
-			}
+			err = w.writeBoolColumn(values)
 		default:
 			return ErrUnsupportedColumnType
 		}
+		if err != nil {
+			return err
+		}
 
 		chunkLength := w.dataFile.Offset() - startOffset
 
 		chunks = append(chunks, chunkMetadata{
-			Offset: startOffset,
-			Length: chunkLength,
+			Offset:   startOffset,
+			Length:   chunkLength,
+			Encoding: encoding,
+			Stats:    computeStats(w.columns[i].Type, values, len(rows)-len(values)),
 		})
 	}
 
@@ -160,21 +179,41 @@ func (w *Writer) writeChunk() error {
 	return nil
 }
 
-func (w *Writer) writeInt64Column(rows []Row, columnIndex int) error {
-	values := make([]int64, len(rows))
+// splitNulls returns the present values of a column and the encoded validity bitmap of the rows,
+// which is empty if no value is missing.
+func splitNulls(rows []Row, columnIndex int) ([]any, []byte) {
+	values := make([]any, 0, len(rows))
+	validity := make([]bool, len(rows))
 	for i, row := range rows {
-		switch v := row[columnIndex].(type) {
+		if row[columnIndex] == nil {
+			continue
+		}
+
+		values = append(values, row[columnIndex])
+		validity[i] = true
+	}
+
+	if len(values) == len(rows) {
+		return values, []byte{}
+	}
+	return values, compression.EncodeBitPacking(validity)
+}
+
+func (w *Writer) writeInt64Column(values []any) error {
+	encodedValues := make([]int64, len(values))
+	for i, value := range values {
+		switch v := value.(type) {
 		case float64:
-			values[i] = int64(v)
+			encodedValues[i] = int64(v)
 		case int, int8, int16, int32, int64:
-			values[i] = v.(int64)
+			encodedValues[i] = v.(int64)
 		case uint, uint8, uint16, uint32, uint64:
-			values[i] = int64(v.(uint64))
+			encodedValues[i] = int64(v.(uint64))
 		default:
-			return fmt.Errorf("invalid value type for int64 column: %T", row[columnIndex])
+			return fmt.Errorf("invalid value type for int64 column: %T", value)
 		}
 	}
-	encoded := compression.EncodeDeltaOfDelta(values)
+	encoded := compression.EncodeDeltaOfDelta(encodedValues)
 
 	err := w.dataFile.WriteLZ4(encoded)
 	if err != nil {
@@ -184,32 +223,58 @@ func (w *Writer) writeInt64Column(rows []Row, columnIndex int) error {
 	return nil
 }
 
-func (w *Writer) writeFloat64Column(rows []Row, columnIndex int) error {
-	for _, row := range rows {
-		if err := w.dataFile.WriteFloat64(row[columnIndex].(float64)); err != nil {
-			return err
+func (w *Writer) writeFloat64Column(values []any) error {
+	floats := make([]float64, len(values))
+	for i, value := range values {
+		v, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("invalid value type for float64 column: %T", value)
 		}
+		floats[i] = v
 	}
 
-	return nil
+	return w.dataFile.WriteBytes(compression.EncodeGorilla(floats))
 }
 
-func (w *Writer) writeStringColumn(rows []Row, columnIndex int) error {
-	for _, row := range rows {
-		if err := w.dataFile.WriteString(row[columnIndex].(string)); err != nil {
-			return err
+// writeStringColumn writes the values with dictionary encoding if they have few distinct values, otherwise
+// it compresses them with LZ4. It returns the chosen encoding.
+func (w *Writer) writeStringColumn(values []any) (ChunkEncoding, error) {
+	strs := make([]string, len(values))
+	for i, value := range values {
+		v, ok := value.(string)
+		if !ok {
+			return 0, fmt.Errorf("invalid value type for string column: %T", value)
 		}
+		strs[i] = v
 	}
 
-	return nil
+	// The dictionary is worth it only if the values repeat
+	encoded, err := compression.EncodeDictionary(strs, min(len(strs)/2, MAX_DICTIONARY_SIZE))
+	if err == nil {
+		return ChunkEncodingDictionary, w.dataFile.WriteBytes(encoded)
+	}
+	if !errors.Is(err, compression.ErrHighCardinality) {
+		return 0, err
+	}
+
+	raw := []byte{}
+	for _, str := range strs {
+		raw = binary.AppendUvarint(raw, uint64(len(str)))
+		raw = append(raw, str...)
+	}
+	return ChunkEncodingLZ4, w.dataFile.WriteLZ4(raw)
 }
 
-func (w *Writer) writeBoolColumn(rows []Row, columnIndex int) error {
-	values := make([]bool, len(rows))
-	for i, row := range rows {
-		values[i] = row[columnIndex].(bool)
+func (w *Writer) writeBoolColumn(values []any) error {
+	encodedValues := make([]bool, len(values))
+	for i, value := range values {
+		v, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("invalid value type for bool column: %T", value)
+		}
+		encodedValues[i] = v
 	}
-	encoded := compression.EncodeBitPacking(values)
+	encoded := compression.EncodeBitPacking(encodedValues)
 
 	err := w.dataFile.WriteLZ4(encoded)
 	if err != nil {
@@ -225,7 +290,7 @@ func (w *Writer) writeMetadataChunks() error {
 	}
 
 	for _, block := range w.blocks {
-		for _, chunk := range block.Chunks {
+		for j, chunk := range block.Chunks {
 			if err := w.metadataFile.WriteUInt64(uint64(chunk.Offset)); err != nil {
 				return err
 			}
@@ -233,6 +298,48 @@ func (w *Writer) writeMetadataChunks() error {
 			if err := w.metadataFile.WriteUInt64(uint64(chunk.Length)); err != nil {
 				return err
 			}
+
+			if err := w.metadataFile.WriteUint8(uint8(chunk.Encoding)); err != nil {
+				return err
+			}
+
+			if err := w.writeChunkStats(w.columns[j].Type, chunk.Stats); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) writeChunkStats(columnType ColumnType, stats ChunkStats) error {
+	if err := w.metadataFile.WriteUvarint(uint64(stats.NullCount)); err != nil {
+		return err
+	}
+
+	if stats.Min == nil || stats.Max == nil {
+		return w.metadataFile.WriteUint8(0)
+	}
+	if err := w.metadataFile.WriteUint8(1); err != nil {
+		return err
+	}
+
+	for _, value := range []any{stats.Min, stats.Max} {
+		var err error
+		switch columnType {
+		case ColumnTypeInt64:
+			err = w.metadataFile.WriteVarint(value.(int64))
+		case ColumnTypeFloat64:
+			err = w.metadataFile.WriteFloat64(value.(float64))
+		case ColumnTypeString:
+			err = w.metadataFile.WriteString(value.(string))
+		case ColumnTypeBool:
+			err = w.metadataFile.WriteUint8(uint8(boolRank(value.(bool))))
+		default:
+			err = ErrUnsupportedColumnType
+		}
+		if err != nil {
+			return err
 		}
 	}
 
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Document IDs are 64-bit integers composed of, from the most significant bits:
+// - The ingestion time in milliseconds since the Unix epoch
+// - The ID of the node that ingested the document (ID_NODE_BITS)
+// - A sequence number distinguishing the documents ingested in the same millisecond (ID_SEQUENCE_BITS)
+//
+// The IDs are unique as long as each node has a different ID, and they are increasing on each node, so
+// sorting by ID approximately sorts by ingestion time across nodes.
+// The IDs are stored as int64 in the _id column of the archives, so they must not use the sign bit: the
+// timestamp fits in the remaining 43 bits until the year 2248, after which the IDs would become negative.
+const ID_NODE_BITS = 10
+const ID_SEQUENCE_BITS = 10
+
+const MAX_NODE_ID = 1<<ID_NODE_BITS - 1
+const MAX_ID_SEQUENCE = 1<<ID_SEQUENCE_BITS - 1
+
+var ErrInvalidNodeID = fmt.Errorf("the node ID must be between 0 and %d", MAX_NODE_ID)
+
+type IDGenerator struct {
+	nodeID uint64
+	clock  func() time.Time
+
+	mu       sync.Mutex
+	millis   uint64
+	sequence uint64
+}
+
+func NewIDGenerator(nodeID uint64) (*IDGenerator, error) {
+	if nodeID > MAX_NODE_ID {
+		return nil, ErrInvalidNodeID
+	}
+
+	return &IDGenerator{
+		nodeID: nodeID,
+		clock:  time.Now,
+	}, nil
+}
+
+// Next returns a new ID, greater than all the IDs previously returned by the generator.
+// If the clock goes backwards or the sequence of the current millisecond is exhausted, the IDs are
+// generated as if in the following millisecond, until the clock catches up.
+func (g *IDGenerator) Next() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := uint64(g.clock().UnixMilli())
+	if now > g.millis {
+		g.millis = now
+		g.sequence = 0
+	} else if g.sequence < MAX_ID_SEQUENCE {
+		g.sequence++
+	} else {
+		g.millis++
+		g.sequence = 0
+	}
+
+	return g.millis<<(ID_NODE_BITS+ID_SEQUENCE_BITS) | g.nodeID<<ID_SEQUENCE_BITS | g.sequence
+}
+
+// IDTime returns the ingestion time encoded in a document ID.
+func IDTime(id uint64) time.Time {
+	return time.UnixMilli(int64(id >> (ID_NODE_BITS + ID_SEQUENCE_BITS)))
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIDGenerator(t *testing.T) {
+	if _, err := NewIDGenerator(MAX_NODE_ID + 1); err != ErrInvalidNodeID {
+		t.Errorf("NewIDGenerator() error = %v, want %v", err, ErrInvalidNodeID)
+	}
+
+	now := time.UnixMilli(1_700_000_000_000)
+	first, _ := NewIDGenerator(1)
+	second, _ := NewIDGenerator(2)
+	first.clock = func() time.Time { return now }
+	second.clock = func() time.Time { return now }
+
+	// The IDs of different nodes never collide, and they are increasing on each node even if the
+	// sequence is exhausted or the clock goes backwards
+	seen := map[uint64]bool{}
+	var last uint64
+	for i := range 3 * (MAX_ID_SEQUENCE + 1) {
+		if i == MAX_ID_SEQUENCE*2 {
+			now = now.Add(-time.Second)
+		}
+
+		id := first.Next()
+		if id <= last {
+			t.Fatalf("ID %d is not greater than the previous one %d", id, last)
+		}
+		last = id
+
+		other := second.Next()
+		if seen[id] || seen[other] || id == other {
+			t.Fatalf("duplicate ID %d", id)
+		}
+		seen[id], seen[other] = true, true
+	}
+
+	if actual := IDTime(last); actual.Before(time.UnixMilli(1_700_000_000_000)) {
+		t.Errorf("IDTime() = %v, want a time after the start of the test", actual)
+	}
+	if int64(last) < 0 {
+		t.Errorf("the IDs should fit in an int64, got %d", last)
+	}
+}
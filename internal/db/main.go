@@ -4,30 +4,97 @@ import (
 	"context"
 	"fmt"
 	"iter"
+	"maps"
 	"strings"
+	"time"
 
 	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/internal/stream"
+	"github.com/ZaninAndrea/microdot/internal/trigram"
 	"github.com/ZaninAndrea/microdot/internal/wal"
 	"github.com/ZaninAndrea/microdot/pkg/blob"
 	"github.com/ZaninAndrea/microdot/pkg/containers"
 )
 
 type DB struct {
-	walWriter *wal.Writer
-	walReader *wal.Reader
+	walWriter    *wal.Writer
+	walReader    *wal.Reader
+	streamReader *stream.Reader
+	streamWriter *stream.Writer
+	trigramIndex *trigram.Index
+	idGenerator  *IDGenerator
 }
 
-func NewDB(bucket blob.Bucket) (*DB, error) {
+// NewDB opens the database stored in the bucket. Each instance sharing the bucket must have a different
+// nodeID, which makes the document IDs assigned by the instances unique.
+func NewDB(bucket blob.Bucket, nodeID uint64) (*DB, error) {
+	idGenerator, err := NewIDGenerator(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
 	walWriter := wal.NewWriter(bucket)
-	walReader := wal.NewReader(bucket)
+	// Queries skip the corrupted WAL files, which are quarantined by the background jobs
+	walReader := wal.NewReader(bucket, wal.CORRUPTION_SKIP)
 	return &DB{
-		walWriter: walWriter,
-		walReader: walReader,
+		walWriter:    walWriter,
+		walReader:    walReader,
+		streamReader: stream.NewReader(bucket),
+		streamWriter: stream.NewWriter(bucket),
+		idGenerator:  idGenerator,
 	}, nil
 }
 
-func (d *DB) AddDocument(streamLabels types.Labels, data types.Document) error {
-	// Check mandatory fields
+// SetTrigramIndex makes the queries look up the documents of the streams in the index, instead of scanning
+// all the archives of the matching streams. The streams without postings are skipped, so the index must
+// contain all the sharded documents: it must be filled by all the workers since the bucket was created.
+func (d *DB) SetTrigramIndex(index *trigram.Index) {
+	d.trigramIndex = index
+}
+
+// AddDocument validates the document and appends it to the WAL, it returns the ID assigned to the document.
+func (d *DB) AddDocument(ctx context.Context, streamLabels types.Labels, data types.Document) (uint64, error) {
+	if err := ValidateDocument(data); err != nil {
+		return 0, err
+	}
+
+	doc := d.identify(types.LabeledDocument{Labels: streamLabels, Document: data})
+	return doc.ID, d.walWriter.AddDocuments(ctx, []types.LabeledDocument{doc})
+}
+
+// AddDocuments validates a batch of documents and appends the valid ones to the WAL with a single write.
+// It returns the validation error of each document, indexed as the input slice (nil for the accepted documents),
+// and the error of the WAL flush, which is nil once the accepted documents are durably persisted.
+// The IDs assigned to the accepted documents are stored in the ID field of the input slice.
+func (d *DB) AddDocuments(ctx context.Context, docs []types.LabeledDocument) ([]error, error) {
+	docErrors := make([]error, len(docs))
+	accepted := make([]types.LabeledDocument, 0, len(docs))
+	for i, doc := range docs {
+		if err := ValidateDocument(doc.Document); err != nil {
+			docErrors[i] = err
+			continue
+		}
+
+		docs[i] = d.identify(doc)
+		accepted = append(accepted, docs[i])
+	}
+
+	if len(accepted) == 0 {
+		return docErrors, nil
+	}
+
+	return docErrors, d.walWriter.AddDocuments(ctx, accepted)
+}
+
+// identify assigns a new document ID and the ID of its stream to the document.
+func (d *DB) identify(doc types.LabeledDocument) types.LabeledDocument {
+	doc.ID = d.idGenerator.Next()
+	doc.StreamID = stream.StreamID(doc.Labels)
+	return doc
+}
+
+// ValidateDocument checks that the document contains the mandatory fields and no reserved ones.
+func ValidateDocument(data types.Document) error {
 	if _, ok := data["msg"]; !ok {
 		return fmt.Errorf("missing 'msg' field in document")
 	}
@@ -44,7 +111,7 @@ func (d *DB) AddDocument(streamLabels types.Labels, data types.Document) error {
 		return fmt.Errorf("document cannot contain '_id' field")
 	}
 
-	return d.walWriter.AddDocument(context.Background(), streamLabels, data)
+	return nil
 }
 
 type QueryResult struct {
@@ -53,9 +120,34 @@ type QueryResult struct {
 	Document   types.Document
 }
 
-func (d *DB) Query(streamLabels types.Labels, query string) iter.Seq[containers.Result[QueryResult]] {
+// Query returns the documents matching the labels and the query, the scan stops with the context error
+// if the context is cancelled.
+//
+// The documents that are still in the WAL are read before the ones in the streams: a WAL file is consumed
+// only after its documents have been published in the streams, so the documents sharded while the query is
+// running are found in the streams. A document may be found in both places, so the documents of the streams
+// are deduplicated against the IDs found in the WAL. The legacy documents without ID can't be deduplicated.
+func (d *DB) Query(ctx context.Context, streamLabels types.Labels, query string) iter.Seq[containers.Result[QueryResult]] {
 	return func(yield func(containers.Result[QueryResult]) bool) {
-		for record := range d.walReader.Iter(context.Background()) {
+		walIDs := make(map[uint64]struct{})
+
+		// The truncation points of the streams are loaded lazily, since most WAL records don't match
+		truncatedBefore := make(map[uint64]int64)
+		isTruncated := func(streamID uint64, document types.Document) (bool, error) {
+			before, ok := truncatedBefore[streamID]
+			if !ok {
+				manifest, err := d.streamReader.LoadManifest(ctx, streamID)
+				if err != nil {
+					return false, err
+				}
+				before = manifest.TruncatedBefore
+				truncatedBefore[streamID] = before
+			}
+
+			return stream.IsTruncated(document, before), nil
+		}
+
+		for record := range d.walReader.Iter(ctx) {
 			if record.IsErr() {
 				err := record.Error()
 				if !yield(containers.Err[QueryResult](err)) {
@@ -64,70 +156,140 @@ func (d *DB) Query(streamLabels types.Labels, query string) iter.Seq[containers.
 				continue
 			}
 
-			if matchesLabels(record.Value.StreamLabels, streamLabels) && matchesQuery(record.Value.Data, query) {
+			if record.Value.StreamLabels.Matches(streamLabels) && matchesQuery(record.Value.Data, query) {
+				truncated, err := isTruncated(record.Value.StreamID, record.Value.Data)
+				if err != nil {
+					if !yield(containers.Err[QueryResult](err)) {
+						return
+					}
+					continue
+				}
+				if truncated {
+					continue
+				}
+
+				// A file compacted while it's being read may return its records twice
+				if id := record.Value.ID; id != 0 {
+					if _, ok := walIDs[id]; ok {
+						continue
+					}
+					walIDs[id] = struct{}{}
+				}
+
 				queryResult := QueryResult{
-					Document: record.Value.Data,
+					StreamID:   record.Value.StreamID,
+					DocumentID: record.Value.ID,
+					Document:   record.Value.Data,
 				}
 				if !yield(containers.Ok(queryResult)) {
 					return
 				}
 			}
 		}
-	}
 
-	// 	matches, err := d.trigramIndex.Search(query)
-	// 	if err != nil {
-	// 		return func(yield func(containers.Result[QueryResult]) bool) {
-	// 			yield(containers.Err[QueryResult](err))
-	// 		}
-	// 	}
-
-	// 	// Group matches by stream ID
-	// 	var streamToDocIDs = make(map[uint64][]uint64)
-	// 	for _, match := range matches {
-	// 		if _, ok := streamToDocIDs[uint64(match.StreamID)]; !ok {
-	// 			streamToDocIDs[uint64(match.StreamID)] = make([]uint64, 0)
-	// 		}
-
-	// 		streamToDocIDs[uint64(match.StreamID)] = append(streamToDocIDs[uint64(match.StreamID)], uint64(match.DocumentID))
-	// 	}
-
-	// 	return func(yield func(containers.Result[QueryResult]) bool) {
-	// 		for streamID, docIDs := range streamToDocIDs {
-	// 			for result := range d.bufferManager.GetDocuments(streamID, docIDs) {
-	// 				if result.IsErr() {
-	// 					if !yield(containers.Err[QueryResult](result.Error())) {
-	// 						return
-	// 					}
-	// 					continue
-	// 				}
-
-	// 				queryResult := QueryResult{
-	// 					StreamID:   streamID,
-	// 					DocumentID: result.Value.ID,
-	// 					Document:   result.Value.Document,
-	// 				}
-
-	//				if !yield(containers.Ok(queryResult)) {
-	//					return
-	//				}
-	//			}
-	//		}
-	//	}
+		for result := range d.queryStreams(ctx, streamLabels, query) {
+			if result.IsOk() && result.Value.DocumentID != 0 {
+				if _, ok := walIDs[result.Value.DocumentID]; ok {
+					continue
+				}
+			}
+			if !yield(result) {
+				return
+			}
+		}
+	}
 }
 
-func (d *DB) Close() error {
-	return nil
+// queryStreams returns the documents of the streams matching the labels and the query.
+func (d *DB) queryStreams(ctx context.Context, streamLabels types.Labels, query string) iter.Seq[containers.Result[QueryResult]] {
+	return func(yield func(containers.Result[QueryResult]) bool) {
+		streams, err := d.streamReader.MatchStreams(ctx, streamLabels)
+		if err != nil {
+			yield(containers.Err[QueryResult](err))
+			return
+		}
+
+		// Group the matches of the index by stream
+		var indexMatches map[uint64][]uint64
+		if d.trigramIndex != nil && len(query) >= trigram.MIN_QUERY_LENGTH {
+			postings, err := d.trigramIndex.Search(query)
+			if err != nil {
+				yield(containers.Err[QueryResult](err))
+				return
+			}
+
+			indexMatches = make(map[uint64][]uint64)
+			for _, posting := range postings {
+				streamID := uint64(posting.StreamID)
+				indexMatches[streamID] = append(indexMatches[streamID], uint64(posting.DocumentID))
+			}
+		}
+
+		for _, streamID := range streams {
+			documents := d.streamReader.ScanDocuments(ctx, streamID)
+			if indexMatches != nil {
+				if len(indexMatches[streamID]) == 0 {
+					continue
+				}
+				documents = d.streamReader.FindDocuments(ctx, streamID, indexMatches[streamID])
+			}
+
+			for result := range documents {
+				if result.IsErr() {
+					if !yield(containers.Err[QueryResult](result.Error())) {
+						return
+					}
+					continue
+				}
+				if !matchesQuery(result.Value.Document, query) {
+					continue
+				}
+
+				// The ID is stored in the archives as a column, but it's not part of the document
+				document := maps.Clone(result.Value.Document)
+				delete(document, "_id")
+				queryResult := QueryResult{
+					StreamID:   streamID,
+					DocumentID: result.Value.ID,
+					Document:   document,
+				}
+				if !yield(containers.Ok(queryResult)) {
+					return
+				}
+			}
+		}
+	}
 }
 
-func matchesLabels(recordLabels, queryLabels types.Labels) bool {
-	for key, value := range queryLabels {
-		if recordValue, ok := recordLabels[key]; !ok || recordValue != value {
-			return false
+// Truncate deletes the documents of the streams matching the labels with a timestamp before the given time,
+// and removes them from the trigram index if one is set. The documents still in the WAL are hidden from
+// the queries and are discarded when they are sharded.
+func (d *DB) Truncate(ctx context.Context, streamLabels types.Labels, before time.Time) error {
+	streams, err := d.streamReader.MatchStreams(ctx, streamLabels)
+	if err != nil {
+		return err
+	}
+
+	for _, streamID := range streams {
+		deleted, err := d.streamWriter.Truncate(ctx, streamID, before.UnixMilli())
+		if err != nil {
+			return err
+		}
+
+		if d.trigramIndex != nil && len(deleted) > 0 {
+			if err := d.trigramIndex.Purge(trigram.DocumentFilter(streamID, deleted)); err != nil {
+				return err
+			}
 		}
 	}
 
-	return true
+	return nil
+}
+
+// Close flushes the documents buffered in the WAL writer and waits for them to be persisted, or until
+// the context is cancelled.
+func (d *DB) Close(ctx context.Context) error {
+	return d.walWriter.Close(ctx)
 }
 
 func matchesQuery(document types.Document, query string) bool {
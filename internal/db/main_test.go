@@ -0,0 +1,225 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"iter"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/internal/stream"
+	"github.com/ZaninAndrea/microdot/internal/trigram"
+	"github.com/ZaninAndrea/microdot/internal/wal"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+	"github.com/ZaninAndrea/microdot/pkg/containers"
+)
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDB(bucket, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := types.Labels{"app": "api", "env": "prod"}
+	web := types.Labels{"app": "web", "env": "prod"}
+	walID, err := db.AddDocument(ctx, api, types.Document{"msg": "request failed", "ts": int64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AddDocument(ctx, web, types.Document{"msg": "page failed", "ts": int64(2)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first document is being sharded, so it's both in the WAL and in the stream
+	streamDocuments := []types.Document{
+		{"_id": int64(walID), "msg": "request failed", "ts": int64(1)},
+		{"_id": int64(7), "msg": "request succeeded", "ts": int64(0)},
+		{"_id": int64(8), "msg": "old request failed", "ts": int64(0)},
+	}
+	_, err = stream.NewWriter(bucket).AppendDocuments(ctx, stream.StreamID(api), 1, api, iterDocuments(streamDocuments))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []QueryResult{
+		{StreamID: stream.StreamID(api), DocumentID: 8, Document: types.Document{"msg": "old request failed", "ts": int64(0)}},
+		{StreamID: stream.StreamID(api), DocumentID: walID, Document: types.Document{"msg": "request failed", "ts": int64(1)}},
+	}
+	if results := collectResults(t, db.Query(ctx, types.Labels{"app": "api"}, "failed")); !equalResults(results, expected) {
+		t.Errorf("Query() = %v, want %v", results, expected)
+	}
+
+	// With a trigram index the streams are not scanned, so only the indexed documents are found
+	index, err := trigram.NewIndex(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Add(int64(stream.StreamID(api)), 8, "old request failed"); err != nil {
+		t.Fatal(err)
+	}
+	db.SetTrigramIndex(index)
+	if results := collectResults(t, db.Query(ctx, types.Labels{"app": "api"}, "failed")); !equalResults(results, expected) {
+		t.Errorf("Query() with index = %v, want %v", results, expected)
+	}
+	if results := collectResults(t, db.Query(ctx, types.Labels{"env": "prod"}, "succeeded")); len(results) != 0 {
+		t.Errorf("Query() with index = %v, want no results", results)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDB(bucket, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := trigram.NewIndex(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetTrigramIndex(index)
+
+	api := types.Labels{"app": "api"}
+	apiID := stream.StreamID(api)
+	_, err = stream.NewWriter(bucket).AppendDocuments(ctx, apiID, 1, api, iterDocuments([]types.Document{
+		{"_id": int64(1), "msg": "old request", "ts": int64(1_000)},
+		{"_id": int64(2), "msg": "new request", "ts": int64(3_000)},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, msg := range map[int64]string{1: "old request", 2: "new request"} {
+		if err := index.Add(int64(apiID), id, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.AddDocument(ctx, api, types.Document{"msg": "old unsharded request", "ts": int64(1_500)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Truncate(ctx, api, time.UnixMilli(2_000)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both the archived and the WAL documents before the truncation are hidden
+	expected := []QueryResult{
+		{StreamID: apiID, DocumentID: 2, Document: types.Document{"msg": "new request", "ts": int64(3_000)}},
+	}
+	if results := collectResults(t, db.Query(ctx, api, "request")); !equalResults(results, expected) {
+		t.Errorf("Query() = %v, want %v", results, expected)
+	}
+	postings, err := index.Search("request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(postings) != 1 || postings[0].DocumentID != 2 {
+		t.Errorf("Search() = %v, want only document 2", postings)
+	}
+}
+
+func TestAddDocuments(t *testing.T) {
+	oldInterval := wal.FLUSH_INTERVAL
+	wal.FLUSH_INTERVAL = 10 * time.Millisecond
+	defer func() { wal.FLUSH_INTERVAL = oldInterval }()
+
+	ctx := context.Background()
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDB(bucket, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := types.Labels{"app": "api"}
+	docs := []types.LabeledDocument{
+		{Labels: api, Document: types.Document{"msg": "first", "ts": int64(1)}},
+		{Labels: api, Document: types.Document{"ts": int64(2)}},
+		{Labels: api, Document: types.Document{"msg": "third", "ts": int64(3)}},
+	}
+	docErrors, err := db.AddDocuments(ctx, docs)
+	if err != nil {
+		t.Fatalf("AddDocuments() error = %v", err)
+	}
+	if docErrors[0] != nil || docErrors[1] == nil || docErrors[2] != nil {
+		t.Fatalf("AddDocuments() document errors = %v, want only the second document rejected", docErrors)
+	}
+	if docs[0].ID == 0 || docs[2].ID == 0 || docs[1].ID != 0 {
+		t.Errorf("AddDocuments() assigned IDs %d, %d, %d, want IDs only for the accepted documents", docs[0].ID, docs[1].ID, docs[2].ID)
+	}
+
+	// The accepted documents are written as a single batch, so they are persisted in the same WAL file
+	files := 0
+	for obj := range bucket.ListObjects(ctx, wal.WAL_FILE_PREFIX) {
+		if obj.Err != nil {
+			t.Fatal(obj.Err)
+		}
+		files++
+	}
+	if files != 1 {
+		t.Errorf("AddDocuments() wrote %d WAL files, want 1", files)
+	}
+
+	expected := []QueryResult{
+		{StreamID: stream.StreamID(api), DocumentID: docs[0].ID, Document: types.Document{"msg": "first", "ts": int64(1)}},
+		{StreamID: stream.StreamID(api), DocumentID: docs[2].ID, Document: types.Document{"msg": "third", "ts": int64(3)}},
+	}
+	if results := collectResults(t, db.Query(ctx, api, "")); !equalResults(results, expected) {
+		t.Errorf("Query() = %v, want %v", results, expected)
+	}
+}
+
+func iterDocuments(documents []types.Document) iter.Seq[containers.Result[types.Document]] {
+	return func(yield func(containers.Result[types.Document]) bool) {
+		for _, doc := range documents {
+			if !yield(containers.Ok(doc)) {
+				return
+			}
+		}
+	}
+}
+
+func collectResults(t *testing.T, results iter.Seq[containers.Result[QueryResult]]) []QueryResult {
+	t.Helper()
+
+	collected := []QueryResult{}
+	for result := range results {
+		if result.IsErr() {
+			t.Fatal(result.Error())
+		}
+		collected = append(collected, result.Value)
+	}
+	return collected
+}
+
+// equalResults compares the results ignoring their order.
+func equalResults(a, b []QueryResult) bool {
+	compare := func(x, y QueryResult) int {
+		return cmp.Compare(x.DocumentID, y.DocumentID)
+	}
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.SortFunc(a, compare)
+	slices.SortFunc(b, compare)
+
+	return slices.EqualFunc(a, b, func(x, y QueryResult) bool {
+		return x.StreamID == y.StreamID && x.DocumentID == y.DocumentID && x.Document["msg"] == y.Document["msg"] &&
+			x.Document["ts"] == y.Document["ts"] && len(x.Document) == len(y.Document)
+	})
+}
@@ -2,3 +2,23 @@ package types
 
 type Document map[string]any
 type Labels map[string]string
+
+// LabeledDocument is a document together with the labels of the stream it belongs to.
+// The IDs are assigned by the DB when the document is ingested, they are zero before.
+type LabeledDocument struct {
+	Labels   Labels
+	Document Document
+	ID       uint64
+	StreamID uint64
+}
+
+// Matches reports whether the labels contain all the key-value pairs of the selector.
+func (l Labels) Matches(selector Labels) bool {
+	for key, value := range selector {
+		if labelValue, ok := l[key]; !ok || labelValue != value {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,170 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+)
+
+// ElasticBulkItem is a single operation of an Elasticsearch bulk request.
+type ElasticBulkItem struct {
+	// Action is the bulk action, e.g. "index" or "create"
+	Action string
+	Index  string
+	ID     string
+	// Document is the parsed source, it is valid only if Err is nil
+	Document types.LabeledDocument
+	// Err is set if the item could not be parsed or the action is not supported
+	Err error
+}
+
+// ElasticBulkParser parses the NDJSON body of an Elasticsearch bulk request, where each action line is
+// followed by a source line.
+//
+// The index name is stored in the 'index' label, '@timestamp' in the 'ts' field and 'message' in the 'msg' field.
+type ElasticBulkParser struct {
+	// LabelFields are the source fields that are stored as stream labels instead of document fields.
+	// Nested fields are referenced with dot-separated paths, e.g. "host.name".
+	LabelFields []string
+}
+
+const ELASTIC_INDEX_LABEL = "index"
+
+// Parse parses a bulk request body, defaultIndex is used for the actions that don't specify an index.
+// A malformed action line makes the whole body invalid, while errors in the single sources are reported
+// in the Err field of the corresponding item.
+func (p *ElasticBulkParser) Parse(body io.Reader, defaultIndex string) ([]ElasticBulkItem, error) {
+	items := []ElasticBulkItem{}
+
+	reader := bufio.NewReader(body)
+	for {
+		actionLine, err := readNonEmptyLine(reader)
+		if err == io.EOF {
+			return items, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		var action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		if err := json.Unmarshal(actionLine, &action); err != nil {
+			return nil, fmt.Errorf("invalid action line: %w", err)
+		}
+		if len(action) != 1 {
+			return nil, fmt.Errorf("invalid action line: expected exactly one action, got %d", len(action))
+		}
+
+		for name, metadata := range action {
+			item := ElasticBulkItem{Action: name, Index: metadata.Index, ID: metadata.ID}
+			if item.Index == "" {
+				item.Index = defaultIndex
+			}
+
+			// Delete actions are the only ones without a source line
+			if name != "delete" {
+				sourceLine, err := readNonEmptyLine(reader)
+				if err == io.EOF {
+					return nil, fmt.Errorf("missing source line for action %q", name)
+				} else if err != nil {
+					return nil, err
+				}
+
+				if name == "index" || name == "create" {
+					item.Document, item.Err = p.parseSource(sourceLine, item.Index)
+				}
+			}
+
+			if name != "index" && name != "create" {
+				item.Err = fmt.Errorf("unsupported bulk action %q", name)
+			} else if item.Index == "" {
+				item.Err = fmt.Errorf("missing index name")
+			}
+
+			items = append(items, item)
+		}
+	}
+}
+
+func (p *ElasticBulkParser) parseSource(line []byte, index string) (types.LabeledDocument, error) {
+	var raw map[string]any
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return types.LabeledDocument{}, err
+	}
+
+	flattened := types.Document{}
+	for key, value := range raw {
+		if err := setField(flattened, key, value); err != nil {
+			return types.LabeledDocument{}, err
+		}
+	}
+
+	labels := types.Labels{ELASTIC_INDEX_LABEL: index}
+	doc := types.Document{}
+	for key, value := range flattened {
+		switch {
+		case slices.Contains(p.LabelFields, key):
+			labels[key] = fmt.Sprint(value)
+		case key == "@timestamp":
+			ts, err := parseElasticTimestamp(value)
+			if err != nil {
+				return types.LabeledDocument{}, err
+			}
+			doc["ts"] = ts
+		case key == "message":
+			doc["msg"] = value
+		case key == "msg" || key == "ts" || key == "_id":
+			// Avoid clashes with the reserved fields
+			doc["_source."+key] = value
+		default:
+			doc[key] = value
+		}
+	}
+
+	if _, ok := doc["ts"]; !ok {
+		doc["ts"] = time.Now().UnixMilli()
+	}
+
+	return types.LabeledDocument{Labels: labels, Document: doc}, nil
+}
+
+// parseElasticTimestamp parses a date as accepted by the default Elasticsearch date mapping:
+// either an RFC3339 string or a number of milliseconds since the epoch.
+func parseElasticTimestamp(value any) (int64, error) {
+	switch v := value.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid @timestamp %q: %w", v, err)
+		}
+		return t.UnixMilli(), nil
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	default:
+		return 0, fmt.Errorf("invalid @timestamp type %T", value)
+	}
+}
+
+// readNonEmptyLine returns the next line of the reader that is not blank, without the trailing newline.
+func readNonEmptyLine(reader *bufio.Reader) ([]byte, error) {
+	for {
+		line, err := reader.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package ingest
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+)
+
+func TestElasticBulkParser(t *testing.T) {
+	body := strings.Join([]string{
+		`{"index": {"_index": "logs", "_id": "1"}}`,
+		`{"@timestamp": "2023-11-14T22:13:20.5Z", "message": "hello", "host": {"name": "web-1"}, "status": 200}`,
+		`{"create": {}}`,
+		`{"@timestamp": 1700000000000, "message": "world", "host": {"name": "web-2"}}`,
+		`{"delete": {"_index": "logs", "_id": "1"}}`,
+		`{"index": {"_index": "logs"}}`,
+		`{"@timestamp": "yesterday", "message": "invalid"}`,
+	}, "\n")
+
+	parser := ElasticBulkParser{LabelFields: []string{"host.name"}}
+	items, err := parser.Parse(strings.NewReader(body), "default")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if len(items) != 4 {
+		t.Fatalf("Expected 4 items, got %d", len(items))
+	}
+
+	expected := []types.LabeledDocument{
+		{
+			Labels:   types.Labels{"index": "logs", "host.name": "web-1"},
+			Document: types.Document{"ts": int64(1700000000500), "msg": "hello", "status": int64(200)},
+		},
+		{
+			Labels:   types.Labels{"index": "default", "host.name": "web-2"},
+			Document: types.Document{"ts": int64(1700000000000), "msg": "world"},
+		},
+	}
+	for i, exp := range expected {
+		if items[i].Err != nil {
+			t.Fatalf("Unexpected error for item %d: %v", i, items[i].Err)
+		}
+		if !reflect.DeepEqual(items[i].Document, exp) {
+			t.Errorf("Item %d mismatch: got %v, want %v", i, items[i].Document, exp)
+		}
+	}
+
+	if items[0].ID != "1" || items[0].Action != "index" || items[1].Action != "create" {
+		t.Errorf("Unexpected action metadata: %+v, %+v", items[0], items[1])
+	}
+	if items[2].Action != "delete" || items[2].Err == nil {
+		t.Errorf("Expected unsupported delete action, got %+v", items[2])
+	}
+	if items[3].Err == nil {
+		t.Errorf("Expected invalid timestamp error")
+	}
+}
+
+func TestElasticBulkParser_MissingSource(t *testing.T) {
+	parser := ElasticBulkParser{}
+	if _, err := parser.Parse(strings.NewReader(`{"index": {"_index": "logs"}}`), ""); err == nil {
+		t.Errorf("Expected error for missing source line")
+	}
+}
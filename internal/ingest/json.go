@@ -0,0 +1,51 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+)
+
+// ParseJSON parses a single JSON encoded document of the form `{"labels": {...}, "msg": "...", "ts": 123, ...}`.
+// The labels object is returned separately from the other fields, which make up the document.
+func ParseJSON(line []byte) (types.Labels, types.Document, error) {
+	// UseNumber() is needed to preserve the full precision of int64 values, which would otherwise
+	// be degraded if decoded as float64.
+	var raw map[string]any
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+	if dec.More() {
+		return nil, nil, fmt.Errorf("unexpected data after the JSON object")
+	}
+
+	labels := types.Labels{}
+	if rawLabels, ok := raw[LABELS_KEY]; ok {
+		labelsMap, ok := rawLabels.(map[string]any)
+		if !ok {
+			return nil, nil, fmt.Errorf("'%s' field must be an object", LABELS_KEY)
+		}
+
+		for key, value := range labelsMap {
+			str, ok := value.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("label %q must be a string", key)
+			}
+			labels[key] = str
+		}
+		delete(raw, LABELS_KEY)
+	}
+
+	doc := types.Document{}
+	for key, value := range raw {
+		if err := setField(doc, key, value); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return labels, doc, nil
+}
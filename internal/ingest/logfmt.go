@@ -0,0 +1,209 @@
+package ingest
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+)
+
+// LogfmtParser parses logfmt lines (e.g. `level=info msg="request served" duration=1.5`) into documents.
+//
+// Unquoted values are converted to int64, float64 or bool when possible, while quoted values are always
+// kept as strings. A key without a value is interpreted as a true boolean.
+type LogfmtParser struct {
+	// MessageKey is the logfmt key that is stored in the 'msg' field of the document.
+	MessageKey string
+	// TimestampKey is the logfmt key that is stored in the 'ts' field of the document.
+	// The value can be an RFC3339 timestamp or a unix epoch in seconds, milliseconds, microseconds or nanoseconds.
+	// If the key is missing the time of ingestion is used.
+	TimestampKey string
+	// LabelKeys are the logfmt keys that are stored as stream labels instead of document fields.
+	LabelKeys []string
+}
+
+func NewLogfmtParser() *LogfmtParser {
+	return &LogfmtParser{
+		MessageKey:   "msg",
+		TimestampKey: "ts",
+	}
+}
+
+// Parse parses a single logfmt line, returning the stream labels and the document.
+func (p *LogfmtParser) Parse(line []byte) (types.Labels, types.Document, error) {
+	pairs, err := splitLogfmt(string(line))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	labels := types.Labels{}
+	doc := types.Document{}
+	for _, pair := range pairs {
+		switch {
+		case slices.Contains(p.LabelKeys, pair.key):
+			labels[pair.key] = pair.value
+		case pair.key == p.MessageKey:
+			doc["msg"] = pair.value
+		case pair.key == p.TimestampKey:
+			ts, err := ParseTimestamp(pair.value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid timestamp %q: %w", pair.value, err)
+			}
+			doc["ts"] = ts
+		case pair.quoted:
+			doc[pair.key] = pair.value
+		default:
+			doc[pair.key] = inferLogfmtValue(pair.value, pair.hasValue)
+		}
+	}
+
+	if _, ok := doc["ts"]; !ok {
+		doc["ts"] = time.Now().UnixMilli()
+	}
+
+	return labels, doc, nil
+}
+
+// ParseTimestamp parses an RFC3339 timestamp or a unix epoch and returns it as unix milliseconds.
+// The unit of the epoch is inferred from its magnitude, so that seconds, milliseconds, microseconds and
+// nanoseconds are all supported.
+func ParseTimestamp(value string) (int64, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t.UnixMilli(), nil
+	}
+
+	epoch, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("expected an RFC3339 timestamp or a unix epoch")
+	}
+
+	return epochToMillis(epoch), nil
+}
+
+// epochToMillis converts a unix epoch of unknown unit to milliseconds.
+// Timestamps up to 1e11 are considered seconds (i.e. until year 5138), up to 1e14 milliseconds,
+// up to 1e17 microseconds, and nanoseconds otherwise.
+func epochToMillis(epoch float64) int64 {
+	abs := math.Abs(epoch)
+	switch {
+	case abs < 1e11:
+		return int64(epoch * 1e3)
+	case abs < 1e14:
+		return int64(epoch)
+	case abs < 1e17:
+		return int64(epoch / 1e3)
+	default:
+		return int64(epoch / 1e6)
+	}
+}
+
+func inferLogfmtValue(value string, hasValue bool) any {
+	if !hasValue {
+		return true
+	}
+
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return f
+	}
+	if value == "true" || value == "false" {
+		return value == "true"
+	}
+
+	return value
+}
+
+type logfmtPair struct {
+	key      string
+	value    string
+	hasValue bool
+	quoted   bool
+}
+
+// splitLogfmt splits a logfmt line into its key-value pairs.
+func splitLogfmt(line string) ([]logfmtPair, error) {
+	pairs := []logfmtPair{}
+
+	i := 0
+	for {
+		// Skip the whitespace between pairs
+		for i < len(line) && isLogfmtSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return pairs, nil
+		}
+
+		// Read the key
+		start := i
+		for i < len(line) && line[i] != '=' && !isLogfmtSpace(line[i]) {
+			if line[i] == '"' {
+				return nil, fmt.Errorf("unexpected '\"' in key at position %d", i)
+			}
+			i++
+		}
+		if start == i {
+			return nil, fmt.Errorf("empty key at position %d", i)
+		}
+		pair := logfmtPair{key: line[start:i]}
+
+		if i >= len(line) || line[i] != '=' {
+			pairs = append(pairs, pair)
+			continue
+		}
+
+		// Read the value, which is either quoted or ends at the first whitespace
+		i++
+		pair.hasValue = true
+		if i < len(line) && line[i] == '"' {
+			value, n, err := readQuotedValue(line[i:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for key %q: %w", pair.key, err)
+			}
+			pair.value = value
+			pair.quoted = true
+			i += n
+		} else {
+			start = i
+			for i < len(line) && !isLogfmtSpace(line[i]) {
+				i++
+			}
+			pair.value = line[start:i]
+		}
+
+		pairs = append(pairs, pair)
+	}
+}
+
+// readQuotedValue reads a double quoted string at the beginning of s, it returns the unquoted value
+// and the number of bytes consumed.
+func readQuotedValue(s string) (string, int, error) {
+	escaped := false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			value, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				// Fallback for escape sequences that are not valid in Go, which are kept verbatim
+				value = strings.ReplaceAll(s[1:i], `\"`, `"`)
+			}
+			return value, i + 1, nil
+		}
+	}
+
+	return "", 0, fmt.Errorf("unterminated quoted string")
+}
+
+func isLogfmtSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
@@ -0,0 +1,112 @@
+package ingest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLogfmtParser(t *testing.T) {
+	tests := []struct {
+		name           string
+		line           string
+		expectedLabels map[string]string
+		expectedDoc    map[string]any
+	}{
+		{
+			name:           "Type inference",
+			line:           `ts=1700000000000 msg=hello count=3 ratio=0.5 ok=true name=abc`,
+			expectedLabels: map[string]string{},
+			expectedDoc: map[string]any{
+				"ts":    int64(1700000000000),
+				"msg":   "hello",
+				"count": int64(3),
+				"ratio": 0.5,
+				"ok":    true,
+				"name":  "abc",
+			},
+		},
+		{
+			name:           "Quoted values",
+			line:           `ts=1700000000 msg="request \"served\"" code="200" empty=""`,
+			expectedLabels: map[string]string{},
+			expectedDoc: map[string]any{
+				"ts":    int64(1700000000000),
+				"msg":   `request "served"`,
+				"code":  "200",
+				"empty": "",
+			},
+		},
+		{
+			name:           "RFC3339 timestamp and bare key",
+			line:           `ts=2023-11-14T22:13:20.5Z msg=hi debug`,
+			expectedLabels: map[string]string{},
+			expectedDoc: map[string]any{
+				"ts":    int64(1700000000500),
+				"msg":   "hi",
+				"debug": true,
+			},
+		},
+		{
+			name:           "Label keys",
+			line:           `ts=1700000000000000000 service=api msg=hi level=info`,
+			expectedLabels: map[string]string{"service": "api"},
+			expectedDoc: map[string]any{
+				"ts":    int64(1700000000000),
+				"msg":   "hi",
+				"level": "info",
+			},
+		},
+	}
+
+	parser := NewLogfmtParser()
+	parser.LabelKeys = []string{"service"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels, doc, err := parser.Parse([]byte(tt.line))
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+
+			if !reflect.DeepEqual(map[string]string(labels), tt.expectedLabels) {
+				t.Errorf("Labels mismatch: got %v, want %v", labels, tt.expectedLabels)
+			}
+			if !reflect.DeepEqual(map[string]any(doc), tt.expectedDoc) {
+				t.Errorf("Document mismatch: got %v, want %v", doc, tt.expectedDoc)
+			}
+		})
+	}
+}
+
+func TestLogfmtParser_KeyMapping(t *testing.T) {
+	parser := NewLogfmtParser()
+	parser.MessageKey = "message"
+	parser.TimestampKey = "time"
+
+	_, doc, err := parser.Parse([]byte(`time=1700000000 message="hello world"`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if doc["msg"] != "hello world" {
+		t.Errorf("Expected msg %q, got %v", "hello world", doc["msg"])
+	}
+	if doc["ts"] != int64(1700000000000) {
+		t.Errorf("Expected ts %d, got %v", int64(1700000000000), doc["ts"])
+	}
+}
+
+func TestLogfmtParser_Errors(t *testing.T) {
+	lines := []string{
+		`msg="unterminated`,
+		`=value`,
+		`ts=yesterday msg=hi`,
+	}
+
+	parser := NewLogfmtParser()
+	for _, line := range lines {
+		if _, _, err := parser.Parse([]byte(line)); err == nil {
+			t.Errorf("Expected error parsing %q", line)
+		}
+	}
+}
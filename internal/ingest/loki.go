@@ -0,0 +1,266 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The Loki push API accepts a list of streams, each one with its labels and a list of entries.
+// Each entry is mapped to a document where the timestamp is stored in the 'ts' field (in milliseconds),
+// the line in the 'msg' field and the structured metadata, if any, as additional fields.
+
+type lokiJSONPushRequest struct {
+	Streams []lokiJSONStream `json:"streams"`
+}
+
+type lokiJSONStream struct {
+	Stream map[string]string   `json:"stream"`
+	Values [][]json.RawMessage `json:"values"`
+}
+
+// ParseLokiJSON parses the JSON body of a Loki push request.
+func ParseLokiJSON(body []byte) ([]types.LabeledDocument, error) {
+	var request lokiJSONPushRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+
+	documents := []types.LabeledDocument{}
+	for _, stream := range request.Streams {
+		labels := types.Labels(stream.Stream)
+		if labels == nil {
+			labels = types.Labels{}
+		}
+
+		for _, value := range stream.Values {
+			if len(value) < 2 || len(value) > 3 {
+				return nil, fmt.Errorf("invalid entry: expected [timestamp, line] or [timestamp, line, metadata]")
+			}
+
+			var timestamp, line string
+			if err := json.Unmarshal(value[0], &timestamp); err != nil {
+				return nil, fmt.Errorf("invalid entry timestamp: %w", err)
+			}
+			if err := json.Unmarshal(value[1], &line); err != nil {
+				return nil, fmt.Errorf("invalid entry line: %w", err)
+			}
+
+			nanos, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid entry timestamp %q: %w", timestamp, err)
+			}
+
+			doc := types.Document{
+				"msg": line,
+				"ts":  nanos / 1e6,
+			}
+
+			if len(value) == 3 {
+				var metadata map[string]string
+				if err := json.Unmarshal(value[2], &metadata); err != nil {
+					return nil, fmt.Errorf("invalid entry structured metadata: %w", err)
+				}
+				for key, value := range metadata {
+					setMetadataField(doc, key, value)
+				}
+			}
+
+			documents = append(documents, types.LabeledDocument{Labels: labels, Document: doc})
+		}
+	}
+
+	return documents, nil
+}
+
+var ErrDecodedBodyTooLarge = fmt.Errorf("the decoded body is too large")
+
+// ParseLokiProtobuf parses the snappy-compressed protobuf body of a Loki push request. The bodies whose
+// decoded size is larger than maxDecodedSize bytes are rejected with ErrDecodedBodyTooLarge before decoding
+// them, since the size is declared in the snappy header.
+//
+// The relevant part of the Loki protobuf schema is:
+//
+//	message PushRequest { repeated StreamAdapter streams = 1; }
+//	message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	message EntryAdapter { google.protobuf.Timestamp timestamp = 1; string line = 2; repeated LabelPairAdapter structuredMetadata = 3; }
+//	message LabelPairAdapter { string name = 1; string value = 2; }
+func ParseLokiProtobuf(body []byte, maxDecodedSize int64) ([]types.LabeledDocument, error) {
+	decodedSize, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy body: %w", err)
+	}
+	if int64(decodedSize) > maxDecodedSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrDecodedBodyTooLarge, decodedSize)
+	}
+
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy body: %w", err)
+	}
+
+	documents := []types.LabeledDocument{}
+	err = walkProtobuf(decoded, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+
+		streamDocuments, err := parseLokiProtobufStream(value)
+		if err != nil {
+			return err
+		}
+		documents = append(documents, streamDocuments...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return documents, nil
+}
+
+func parseLokiProtobufStream(data []byte) ([]types.LabeledDocument, error) {
+	var rawLabels string
+	var entries [][]byte
+	err := walkProtobuf(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			rawLabels = string(value)
+		case num == 2 && typ == protowire.BytesType:
+			entries = append(entries, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := ParseLokiLabels(rawLabels)
+	if err != nil {
+		return nil, err
+	}
+
+	documents := make([]types.LabeledDocument, 0, len(entries))
+	for _, entry := range entries {
+		doc, err := parseLokiProtobufEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, types.LabeledDocument{Labels: labels, Document: doc})
+	}
+
+	return documents, nil
+}
+
+func parseLokiProtobufEntry(data []byte) (types.Document, error) {
+	doc := types.Document{"msg": ""}
+	err := walkProtobuf(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			seconds, nanos, err := parseProtobufTimestamp(value)
+			if err != nil {
+				return err
+			}
+			doc["ts"] = seconds*1e3 + nanos/1e6
+		case num == 2 && typ == protowire.BytesType:
+			doc["msg"] = string(value)
+		case num == 3 && typ == protowire.BytesType:
+			var name, labelValue string
+			err := walkProtobuf(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					name = string(value)
+				case num == 2 && typ == protowire.BytesType:
+					labelValue = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			setMetadataField(doc, name, labelValue)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// parseProtobufTimestamp parses a google.protobuf.Timestamp message.
+func parseProtobufTimestamp(data []byte) (int64, int64, error) {
+	var seconds, nanos int64
+	err := walkProtobuf(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if typ != protowire.VarintType {
+			return nil
+		}
+
+		v, _ := protowire.ConsumeVarint(value)
+		switch num {
+		case 1:
+			seconds = int64(v)
+		case 2:
+			nanos = int64(int32(v))
+		}
+		return nil
+	})
+
+	return seconds, nanos, err
+}
+
+// setMetadataField stores a structured metadata entry in the document, without overwriting
+// the mandatory fields.
+func setMetadataField(doc types.Document, key, value string) {
+	if key == "msg" || key == "ts" || key == "_id" {
+		key = "metadata." + key
+	}
+	doc[key] = value
+}
+
+// ParseLokiLabels parses a label set in the Prometheus text format, e.g. `{job="api", env="prod"}`.
+func ParseLokiLabels(s string) (types.Labels, error) {
+	labels := types.Labels{}
+
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("invalid labels %q: expected them to be enclosed in braces", s)
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid labels: expected name=\"value\" at %q", s)
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = strings.TrimSpace(s[eq+1:])
+
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for label %q: %w", name, err)
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for label %q: %w", name, err)
+		}
+		labels[name] = value
+
+		s = strings.TrimSpace(s[len(quoted):])
+		if s == "" {
+			break
+		}
+		if s[0] != ',' {
+			return nil, fmt.Errorf("invalid labels: expected ',' at %q", s)
+		}
+		s = strings.TrimSpace(s[1:])
+	}
+
+	return labels, nil
+}
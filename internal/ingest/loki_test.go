@@ -0,0 +1,99 @@
+package ingest
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestParseLokiJSON(t *testing.T) {
+	body := `{"streams": [{
+		"stream": {"job": "api"},
+		"values": [
+			["1700000000123456789", "first line"],
+			["1700000001000000000", "second line", {"trace_id": "abc"}]
+		]
+	}]}`
+
+	documents, err := ParseLokiJSON([]byte(body))
+	if err != nil {
+		t.Fatalf("ParseLokiJSON failed: %v", err)
+	}
+
+	expected := []types.LabeledDocument{
+		{Labels: types.Labels{"job": "api"}, Document: types.Document{"msg": "first line", "ts": int64(1700000000123)}},
+		{Labels: types.Labels{"job": "api"}, Document: types.Document{"msg": "second line", "ts": int64(1700000001000), "trace_id": "abc"}},
+	}
+	if !reflect.DeepEqual(documents, expected) {
+		t.Errorf("Documents mismatch: got %v, want %v", documents, expected)
+	}
+}
+
+func TestParseLokiProtobuf(t *testing.T) {
+	var timestamp []byte
+	timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+	timestamp = protowire.AppendVarint(timestamp, 1700000000)
+	timestamp = protowire.AppendTag(timestamp, 2, protowire.VarintType)
+	timestamp = protowire.AppendVarint(timestamp, 5_000_000)
+
+	var metadata []byte
+	metadata = protowire.AppendTag(metadata, 1, protowire.BytesType)
+	metadata = protowire.AppendString(metadata, "user")
+	metadata = protowire.AppendTag(metadata, 2, protowire.BytesType)
+	metadata = protowire.AppendString(metadata, "alice")
+
+	var entry []byte
+	entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+	entry = protowire.AppendBytes(entry, timestamp)
+	entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+	entry = protowire.AppendString(entry, "hello loki")
+	entry = protowire.AppendTag(entry, 3, protowire.BytesType)
+	entry = protowire.AppendBytes(entry, metadata)
+
+	var stream []byte
+	stream = protowire.AppendTag(stream, 1, protowire.BytesType)
+	stream = protowire.AppendString(stream, `{job="api", env="prod\"uction"}`)
+	stream = protowire.AppendTag(stream, 2, protowire.BytesType)
+	stream = protowire.AppendBytes(stream, entry)
+
+	var request []byte
+	request = protowire.AppendTag(request, 1, protowire.BytesType)
+	request = protowire.AppendBytes(request, stream)
+
+	documents, err := ParseLokiProtobuf(snappy.Encode(nil, request), 1<<20)
+	if err != nil {
+		t.Fatalf("ParseLokiProtobuf failed: %v", err)
+	}
+	if _, err := ParseLokiProtobuf(snappy.Encode(nil, request), int64(len(request)-1)); !errors.Is(err, ErrDecodedBodyTooLarge) {
+		t.Errorf("ParseLokiProtobuf() with a small limit returned %v, want ErrDecodedBodyTooLarge", err)
+	}
+
+	expected := []types.LabeledDocument{
+		{
+			Labels:   types.Labels{"job": "api", "env": `prod"uction`},
+			Document: types.Document{"msg": "hello loki", "ts": int64(1700000000005), "user": "alice"},
+		},
+	}
+	if !reflect.DeepEqual(documents, expected) {
+		t.Errorf("Documents mismatch: got %v, want %v", documents, expected)
+	}
+}
+
+func TestParseLokiLabels_Errors(t *testing.T) {
+	inputs := []string{
+		`job="api"`,
+		`{job=api}`,
+		`{job="api" env="prod"}`,
+		`{="api"}`,
+	}
+
+	for _, input := range inputs {
+		if _, err := ParseLokiLabels(input); err == nil {
+			t.Errorf("Expected error parsing %q", input)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+)
+
+// LABELS_KEY is the key of the object containing the stream labels in JSON documents.
+const LABELS_KEY = "labels"
+
+// setField stores value in the document under key, converting it to one of the types supported by the
+// storage engine (int64, float64, string and bool).
+// Nested objects are flattened using dot-separated keys, arrays are stored as their JSON encoding and
+// null values are dropped.
+func setField(doc types.Document, key string, value any) error {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string, bool, int64, float64:
+		doc[key] = v
+	case int:
+		doc[key] = int64(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			doc[key] = i
+		} else if f, err := v.Float64(); err == nil {
+			doc[key] = f
+		} else {
+			return fmt.Errorf("invalid number for key %q: %s", key, v)
+		}
+	case map[string]any:
+		for nestedKey, nestedValue := range v {
+			if err := setField(doc, key+"."+nestedKey, nestedValue); err != nil {
+				return err
+			}
+		}
+	case []any:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		doc[key] = string(encoded)
+	default:
+		return fmt.Errorf("unsupported value type for key %q: %T", key, value)
+	}
+
+	return nil
+}
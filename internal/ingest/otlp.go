@@ -0,0 +1,533 @@
+package ingest
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// OpenTelemetry log records are mapped to documents as follows:
+//   - the resource attributes are flattened into the stream labels (e.g. service.name)
+//   - the body is stored in the 'msg' field, non-string bodies are JSON encoded
+//   - time_unix_nano is stored in the 'ts' field in milliseconds, falling back to observed_time_unix_nano
+//   - severity_text, severity_number, trace_id and span_id are stored in the fields with the OTLP_FIELD_PREFIX
+//     (e.g. otel.severity), the ids are hex encoded
+//   - the log attributes are stored as additional fields, the ones that would overwrite the fields above are
+//     stored with the 'attributes.' prefix (e.g. attributes.msg)
+
+// OTLP_FIELD_PREFIX is the prefix of the document fields storing the OTLP fields of the log records, so that
+// they don't clash with the log attributes.
+const OTLP_FIELD_PREFIX = "otel."
+
+// OTLPLogRecord is a log record of an OTLP request.
+type OTLPLogRecord struct {
+	// Document is the converted log record, it is valid only if Err is nil
+	Document types.LabeledDocument
+	// Err is set if the log record can't be stored as a document
+	Err error
+}
+
+// otlpRecord is the decoded form of an OTLP LogRecord, shared by the JSON and protobuf decoders.
+type otlpRecord struct {
+	timeUnixNano         uint64
+	observedTimeUnixNano uint64
+	severityNumber       int64
+	severityText         string
+	body                 any
+	attributes           map[string]any
+	traceID              []byte
+	spanID               []byte
+}
+
+func (r otlpRecord) toDocument(resource map[string]any) (types.LabeledDocument, error) {
+	labels := types.Labels{}
+	for key, value := range resource {
+		flattenLabel(labels, key, value)
+	}
+
+	attributes := types.Document{}
+	for key, value := range r.attributes {
+		if err := setField(attributes, key, normalizeAnyValue(value)); err != nil {
+			return types.LabeledDocument{}, err
+		}
+	}
+
+	// The attributes are checked after flattening them, since a nested attribute can clash as well
+	doc := types.Document{}
+	for key, value := range attributes {
+		if isOTLPReservedField(key) {
+			key = "attributes." + key
+			if _, ok := attributes[key]; ok {
+				return types.LabeledDocument{}, fmt.Errorf("attribute %q conflicts with the attribute renamed from %q", key, strings.TrimPrefix(key, "attributes."))
+			}
+		}
+		doc[key] = value
+	}
+
+	switch body := r.body.(type) {
+	case nil:
+		doc["msg"] = ""
+	case string:
+		doc["msg"] = body
+	default:
+		encoded, err := json.Marshal(normalizeAnyValue(body))
+		if err != nil {
+			return types.LabeledDocument{}, err
+		}
+		doc["msg"] = string(encoded)
+	}
+
+	switch {
+	case r.timeUnixNano != 0:
+		doc["ts"] = int64(r.timeUnixNano / 1e6)
+	case r.observedTimeUnixNano != 0:
+		doc["ts"] = int64(r.observedTimeUnixNano / 1e6)
+	default:
+		doc["ts"] = time.Now().UnixMilli()
+	}
+
+	if r.severityText != "" {
+		doc[OTLP_FIELD_PREFIX+"severity"] = r.severityText
+	}
+	if r.severityNumber != 0 {
+		doc[OTLP_FIELD_PREFIX+"severity_number"] = r.severityNumber
+	}
+	if len(r.traceID) > 0 {
+		doc[OTLP_FIELD_PREFIX+"trace_id"] = hex.EncodeToString(r.traceID)
+	}
+	if len(r.spanID) > 0 {
+		doc[OTLP_FIELD_PREFIX+"span_id"] = hex.EncodeToString(r.spanID)
+	}
+
+	return types.LabeledDocument{Labels: labels, Document: doc}, nil
+}
+
+// isOTLPReservedField reports whether the field is set by the receiver, so an attribute can't be stored in it.
+func isOTLPReservedField(key string) bool {
+	return key == "msg" || key == "ts" || key == "_id" || strings.HasPrefix(key, OTLP_FIELD_PREFIX)
+}
+
+// flattenLabel stores an attribute value in the labels, nested key-value lists are flattened using
+// dot-separated keys and the other values are converted to their string representation.
+func flattenLabel(labels types.Labels, key string, value any) {
+	switch v := value.(type) {
+	case nil:
+	case string:
+		labels[key] = v
+	case map[string]any:
+		for nestedKey, nestedValue := range v {
+			flattenLabel(labels, key+"."+nestedKey, nestedValue)
+		}
+	case []any:
+		encoded, _ := json.Marshal(normalizeAnyValue(v))
+		labels[key] = string(encoded)
+	case []byte:
+		labels[key] = base64.StdEncoding.EncodeToString(v)
+	default:
+		labels[key] = fmt.Sprint(v)
+	}
+}
+
+// normalizeAnyValue converts the byte slices contained in a decoded AnyValue to base64 strings,
+// as done by the OTLP JSON encoding.
+func normalizeAnyValue(value any) any {
+	switch v := value.(type) {
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case []any:
+		normalized := make([]any, len(v))
+		for i := range v {
+			normalized[i] = normalizeAnyValue(v[i])
+		}
+		return normalized
+	case map[string]any:
+		normalized := make(map[string]any, len(v))
+		for key := range v {
+			normalized[key] = normalizeAnyValue(v[key])
+		}
+		return normalized
+	default:
+		return value
+	}
+}
+
+// ParseOTLPProtobuf parses the protobuf body of an OTLP ExportLogsServiceRequest.
+// It returns the log records in the same order as the request, a malformed body makes the whole request
+// invalid while the records that can't be stored as documents are reported in their Err field.
+//
+// The relevant part of the OTLP protobuf schema is:
+//
+//	message ExportLogsServiceRequest { repeated ResourceLogs resource_logs = 1; }
+//	message ResourceLogs { Resource resource = 1; repeated ScopeLogs scope_logs = 2; }
+//	message Resource { repeated KeyValue attributes = 1; }
+//	message ScopeLogs { repeated LogRecord log_records = 2; }
+//	message LogRecord {
+//		fixed64 time_unix_nano = 1; fixed64 observed_time_unix_nano = 11;
+//		SeverityNumber severity_number = 2; string severity_text = 3;
+//		AnyValue body = 5; repeated KeyValue attributes = 6;
+//		bytes trace_id = 9; bytes span_id = 10;
+//	}
+func ParseOTLPProtobuf(body []byte) ([]OTLPLogRecord, error) {
+	records := []OTLPLogRecord{}
+	err := walkProtobuf(body, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+
+		resource := map[string]any{}
+		var scopeLogs [][]byte
+		err := walkProtobuf(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+			switch {
+			case num == 1 && typ == protowire.BytesType:
+				return walkProtobuf(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+					if num == 1 && typ == protowire.BytesType {
+						return parseOTLPKeyValue(value, resource)
+					}
+					return nil
+				})
+			case num == 2 && typ == protowire.BytesType:
+				scopeLogs = append(scopeLogs, value)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, scope := range scopeLogs {
+			err := walkProtobuf(scope, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				if num != 2 || typ != protowire.BytesType {
+					return nil
+				}
+
+				record, err := parseOTLPLogRecord(value)
+				if err != nil {
+					return err
+				}
+
+				document, err := record.toDocument(resource)
+				records = append(records, OTLPLogRecord{Document: document, Err: err})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func parseOTLPLogRecord(data []byte) (otlpRecord, error) {
+	record := otlpRecord{attributes: map[string]any{}}
+	err := walkProtobuf(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			record.timeUnixNano = binary.LittleEndian.Uint64(value)
+		case num == 11 && typ == protowire.Fixed64Type:
+			record.observedTimeUnixNano = binary.LittleEndian.Uint64(value)
+		case num == 2 && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			record.severityNumber = int64(v)
+		case num == 3 && typ == protowire.BytesType:
+			record.severityText = string(value)
+		case num == 5 && typ == protowire.BytesType:
+			body, err := parseOTLPAnyValue(value)
+			if err != nil {
+				return err
+			}
+			record.body = body
+		case num == 6 && typ == protowire.BytesType:
+			return parseOTLPKeyValue(value, record.attributes)
+		case num == 9 && typ == protowire.BytesType:
+			record.traceID = value
+		case num == 10 && typ == protowire.BytesType:
+			record.spanID = value
+		}
+		return nil
+	})
+
+	return record, err
+}
+
+// parseOTLPKeyValue parses a KeyValue message { string key = 1; AnyValue value = 2; } into the target map.
+func parseOTLPKeyValue(data []byte, target map[string]any) error {
+	var key string
+	var value any
+	err := walkProtobuf(data, func(num protowire.Number, typ protowire.Type, raw []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			key = string(raw)
+		case num == 2 && typ == protowire.BytesType:
+			v, err := parseOTLPAnyValue(raw)
+			if err != nil {
+				return err
+			}
+			value = v
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	target[key] = value
+	return nil
+}
+
+// parseOTLPAnyValue parses an AnyValue message, whose oneof fields are:
+// string_value = 1, bool_value = 2, int_value = 3, double_value = 4, array_value = 5,
+// kvlist_value = 6 and bytes_value = 7.
+func parseOTLPAnyValue(data []byte) (any, error) {
+	var result any
+	err := walkProtobuf(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			result = string(value)
+		case num == 2 && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			result = v != 0
+		case num == 3 && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			result = int64(v)
+		case num == 4 && typ == protowire.Fixed64Type:
+			result = math.Float64frombits(binary.LittleEndian.Uint64(value))
+		case num == 5 && typ == protowire.BytesType:
+			values := []any{}
+			err := walkProtobuf(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				if num != 1 || typ != protowire.BytesType {
+					return nil
+				}
+				v, err := parseOTLPAnyValue(value)
+				if err != nil {
+					return err
+				}
+				values = append(values, v)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			result = values
+		case num == 6 && typ == protowire.BytesType:
+			values := map[string]any{}
+			err := walkProtobuf(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				if num == 1 && typ == protowire.BytesType {
+					return parseOTLPKeyValue(value, values)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			result = values
+		case num == 7 && typ == protowire.BytesType:
+			result = value
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+type otlpJSONRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []otlpJSONKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			LogRecords []struct {
+				TimeUnixNano         otlpJSONUint64     `json:"timeUnixNano"`
+				ObservedTimeUnixNano otlpJSONUint64     `json:"observedTimeUnixNano"`
+				SeverityNumber       int64              `json:"severityNumber"`
+				SeverityText         string             `json:"severityText"`
+				Body                 *otlpJSONAnyValue  `json:"body"`
+				Attributes           []otlpJSONKeyValue `json:"attributes"`
+				TraceID              string             `json:"traceId"`
+				SpanID               string             `json:"spanId"`
+			} `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+type otlpJSONKeyValue struct {
+	Key   string           `json:"key"`
+	Value otlpJSONAnyValue `json:"value"`
+}
+
+type otlpJSONAnyValue struct {
+	StringValue *string        `json:"stringValue"`
+	BoolValue   *bool          `json:"boolValue"`
+	IntValue    *otlpJSONInt64 `json:"intValue"`
+	DoubleValue *float64       `json:"doubleValue"`
+	BytesValue  *[]byte        `json:"bytesValue"`
+	ArrayValue  *struct {
+		Values []otlpJSONAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []otlpJSONKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+}
+
+func (v otlpJSONAnyValue) value() any {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.BytesValue != nil:
+		return *v.BytesValue
+	case v.ArrayValue != nil:
+		values := make([]any, len(v.ArrayValue.Values))
+		for i := range v.ArrayValue.Values {
+			values[i] = v.ArrayValue.Values[i].value()
+		}
+		return values
+	case v.KvlistValue != nil:
+		return otlpJSONAttributes(v.KvlistValue.Values)
+	default:
+		return nil
+	}
+}
+
+func otlpJSONAttributes(keyValues []otlpJSONKeyValue) map[string]any {
+	attributes := make(map[string]any, len(keyValues))
+	for _, kv := range keyValues {
+		attributes[kv.Key] = kv.Value.value()
+	}
+	return attributes
+}
+
+// otlpJSONInt64 decodes 64-bit integers, which the protobuf JSON mapping encodes as strings
+// but some clients send as numbers.
+type otlpJSONInt64 int64
+
+func (v *otlpJSONInt64) UnmarshalJSON(data []byte) error {
+	unquoted, err := strconv.Unquote(string(data))
+	if err != nil {
+		unquoted = string(data)
+	}
+
+	i, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil {
+		return err
+	}
+	*v = otlpJSONInt64(i)
+	return nil
+}
+
+type otlpJSONUint64 uint64
+
+func (v *otlpJSONUint64) UnmarshalJSON(data []byte) error {
+	unquoted, err := strconv.Unquote(string(data))
+	if err != nil {
+		unquoted = string(data)
+	}
+
+	i, err := strconv.ParseUint(unquoted, 10, 64)
+	if err != nil {
+		return err
+	}
+	*v = otlpJSONUint64(i)
+	return nil
+}
+
+// ParseOTLPJSON parses the JSON body of an OTLP ExportLogsServiceRequest.
+// It returns the log records as ParseOTLPProtobuf.
+func ParseOTLPJSON(body []byte) ([]OTLPLogRecord, error) {
+	var request otlpJSONRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+
+	records := []OTLPLogRecord{}
+	for _, resourceLogs := range request.ResourceLogs {
+		resource := otlpJSONAttributes(resourceLogs.Resource.Attributes)
+
+		for _, scopeLogs := range resourceLogs.ScopeLogs {
+			for _, jsonRecord := range scopeLogs.LogRecords {
+				record := otlpRecord{
+					timeUnixNano:         uint64(jsonRecord.TimeUnixNano),
+					observedTimeUnixNano: uint64(jsonRecord.ObservedTimeUnixNano),
+					severityNumber:       jsonRecord.SeverityNumber,
+					severityText:         jsonRecord.SeverityText,
+					attributes:           otlpJSONAttributes(jsonRecord.Attributes),
+				}
+				if jsonRecord.Body != nil {
+					record.body = jsonRecord.Body.value()
+				}
+
+				// Trace and span ids are hex encoded in the OTLP JSON encoding
+				var err error
+				if record.traceID, err = hex.DecodeString(jsonRecord.TraceID); err != nil {
+					records = append(records, OTLPLogRecord{Err: fmt.Errorf("invalid traceId: %w", err)})
+					continue
+				}
+				if record.spanID, err = hex.DecodeString(jsonRecord.SpanID); err != nil {
+					records = append(records, OTLPLogRecord{Err: fmt.Errorf("invalid spanId: %w", err)})
+					continue
+				}
+
+				document, err := record.toDocument(resource)
+				records = append(records, OTLPLogRecord{Document: document, Err: err})
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// EncodeOTLPResponseProtobuf encodes an ExportLogsServiceResponse, which contains a partial success
+// message only if some log records were rejected.
+//
+//	message ExportLogsServiceResponse { ExportLogsPartialSuccess partial_success = 1; }
+//	message ExportLogsPartialSuccess { int64 rejected_log_records = 1; string error_message = 2; }
+func EncodeOTLPResponseProtobuf(rejected int64, errorMessage string) []byte {
+	if rejected == 0 && errorMessage == "" {
+		return []byte{}
+	}
+
+	var partialSuccess []byte
+	partialSuccess = protowire.AppendTag(partialSuccess, 1, protowire.VarintType)
+	partialSuccess = protowire.AppendVarint(partialSuccess, uint64(rejected))
+	partialSuccess = protowire.AppendTag(partialSuccess, 2, protowire.BytesType)
+	partialSuccess = protowire.AppendString(partialSuccess, errorMessage)
+
+	var response []byte
+	response = protowire.AppendTag(response, 1, protowire.BytesType)
+	response = protowire.AppendBytes(response, partialSuccess)
+	return response
+}
+
+// EncodeOTLPResponseJSON is the JSON counterpart of EncodeOTLPResponseProtobuf.
+func EncodeOTLPResponseJSON(rejected int64, errorMessage string) []byte {
+	if rejected == 0 && errorMessage == "" {
+		return []byte("{}")
+	}
+
+	encoded, _ := json.Marshal(map[string]any{
+		"partialSuccess": map[string]any{
+			"rejectedLogRecords": strconv.FormatInt(rejected, 10),
+			"errorMessage":       errorMessage,
+		},
+	})
+	return encoded
+}
@@ -0,0 +1,148 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestParseOTLPJSON(t *testing.T) {
+	body := `{"resourceLogs": [{
+		"resource": {"attributes": [
+			{"key": "service.name", "value": {"stringValue": "checkout"}},
+			{"key": "k8s", "value": {"kvlistValue": {"values": [{"key": "pod", "value": {"stringValue": "pod-1"}}]}}}
+		]},
+		"scopeLogs": [{"logRecords": [{
+			"timeUnixNano": "1700000000123456789",
+			"severityNumber": 9,
+			"severityText": "INFO",
+			"body": {"stringValue": "order placed"},
+			"attributes": [
+				{"key": "order.id", "value": {"intValue": "42"}},
+				{"key": "amount", "value": {"doubleValue": 9.5}},
+				{"key": "severity", "value": {"stringValue": "high"}},
+				{"key": "msg", "value": {"stringValue": "shadowed"}}
+			],
+			"traceId": "5b8efff798038103d269b633813fc60c",
+			"spanId": "eee19b7ec3c1b174"
+		}, {
+			"body": {"stringValue": "conflicting attributes"},
+			"attributes": [
+				{"key": "msg", "value": {"stringValue": "a"}},
+				{"key": "attributes", "value": {"kvlistValue": {"values": [{"key": "msg", "value": {"stringValue": "b"}}]}}}
+			]
+		}, {
+			"body": {"stringValue": "invalid trace"},
+			"traceId": "not hex"
+		}]}]
+	}]}`
+
+	records, err := ParseOTLPJSON([]byte(body))
+	if err != nil {
+		t.Fatalf("ParseOTLPJSON failed: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("ParseOTLPJSON returned %d records, want 3", len(records))
+	}
+
+	// The attributes are kept, the ones clashing with the fields set by the receiver are renamed
+	expected := types.LabeledDocument{
+		Labels: types.Labels{"service.name": "checkout", "k8s.pod": "pod-1"},
+		Document: types.Document{
+			"ts":                   int64(1700000000123),
+			"msg":                  "order placed",
+			"otel.severity":        "INFO",
+			"otel.severity_number": int64(9),
+			"otel.trace_id":        "5b8efff798038103d269b633813fc60c",
+			"otel.span_id":         "eee19b7ec3c1b174",
+			"order.id":             int64(42),
+			"amount":               9.5,
+			"severity":             "high",
+			"attributes.msg":       "shadowed",
+		},
+	}
+	if records[0].Err != nil || !reflect.DeepEqual(records[0].Document, expected) {
+		t.Errorf("Record mismatch: got %v (%v), want %v", records[0].Document, records[0].Err, expected)
+	}
+
+	// The records that can't be stored are reported without failing the request
+	if records[1].Err == nil {
+		t.Errorf("Expected an error for the conflicting attributes")
+	}
+	if records[2].Err == nil {
+		t.Errorf("Expected an error for the invalid trace id")
+	}
+}
+
+func TestParseOTLPProtobuf(t *testing.T) {
+	anyString := func(s string) []byte {
+		var b []byte
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		return protowire.AppendString(b, s)
+	}
+	keyValue := func(key string, value []byte) []byte {
+		var b []byte
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, key)
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		return protowire.AppendBytes(b, value)
+	}
+
+	var intValue []byte
+	intValue = protowire.AppendTag(intValue, 3, protowire.VarintType)
+	intValue = protowire.AppendVarint(intValue, 7)
+
+	var resource []byte
+	resource = protowire.AppendTag(resource, 1, protowire.BytesType)
+	resource = protowire.AppendBytes(resource, keyValue("service.name", anyString("checkout")))
+
+	var record []byte
+	record = protowire.AppendTag(record, 1, protowire.Fixed64Type)
+	record = protowire.AppendFixed64(record, 1700000000123456789)
+	record = protowire.AppendTag(record, 3, protowire.BytesType)
+	record = protowire.AppendString(record, "WARN")
+	record = protowire.AppendTag(record, 5, protowire.BytesType)
+	record = protowire.AppendBytes(record, anyString("low stock"))
+	record = protowire.AppendTag(record, 6, protowire.BytesType)
+	record = protowire.AppendBytes(record, keyValue("remaining", intValue))
+	record = protowire.AppendTag(record, 10, protowire.BytesType)
+	record = protowire.AppendBytes(record, binary.BigEndian.AppendUint64(nil, 0xeee19b7ec3c1b174))
+
+	var scopeLogs []byte
+	scopeLogs = protowire.AppendTag(scopeLogs, 2, protowire.BytesType)
+	scopeLogs = protowire.AppendBytes(scopeLogs, record)
+
+	var resourceLogs []byte
+	resourceLogs = protowire.AppendTag(resourceLogs, 1, protowire.BytesType)
+	resourceLogs = protowire.AppendBytes(resourceLogs, resource)
+	resourceLogs = protowire.AppendTag(resourceLogs, 2, protowire.BytesType)
+	resourceLogs = protowire.AppendBytes(resourceLogs, scopeLogs)
+
+	var request []byte
+	request = protowire.AppendTag(request, 1, protowire.BytesType)
+	request = protowire.AppendBytes(request, resourceLogs)
+
+	records, err := ParseOTLPProtobuf(request)
+	if err != nil {
+		t.Fatalf("ParseOTLPProtobuf failed: %v", err)
+	}
+
+	expected := []OTLPLogRecord{{
+		Document: types.LabeledDocument{
+			Labels: types.Labels{"service.name": "checkout"},
+			Document: types.Document{
+				"ts":            int64(1700000000123),
+				"msg":           "low stock",
+				"otel.severity": "WARN",
+				"otel.span_id":  "eee19b7ec3c1b174",
+				"remaining":     int64(7),
+			},
+		},
+	}}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Records mismatch: got %v, want %v", records, expected)
+	}
+}
@@ -0,0 +1,45 @@
+package ingest
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// walkProtobuf iterates over the fields of a protobuf encoded message, calling fn for each field.
+// For length-delimited fields value contains the field content, for the other wire types it
+// contains the raw encoding of the value (e.g. the varint bytes).
+//
+// The push protocols only need a small subset of their schemas, so messages are decoded by hand
+// instead of depending on the generated code.
+func walkProtobuf(data []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var value []byte
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value = v
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			value = data[:n]
+			data = data[n:]
+		}
+
+		if err := fn(num, typ, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -8,14 +8,17 @@ import (
 	"github.com/ZaninAndrea/microdot/pkg/backoff"
 )
 
-func (q *Queue) Pull(claimDuration time.Duration) Item {
-	ctx := context.Background()
+// Pull claims a job for claimDuration, waiting until one is available. It returns the context error if
+// the context is cancelled before a job is claimed.
+func (q *Queue) Pull(ctx context.Context, claimDuration time.Duration) (Item, error) {
 	bo := backoff.NewExponential(MinBackoff, MaxBackoff)
 
 	for {
 		fileIDs, err := q.listFileIDs(ctx)
 		if err != nil || len(fileIDs) == 0 {
-			bo.Wait()
+			if err := bo.Wait(ctx); err != nil {
+				return Item{}, err
+			}
 			continue
 		}
 
@@ -69,38 +72,42 @@ func (q *Queue) Pull(claimDuration time.Duration) Item {
 				fileID:  loaded.ID,
 				jobID:   next.Jobs[jobIndex].ID,
 				payload: maps.Clone(next.Jobs[jobIndex].Payload),
-			}
+			}, nil
 		}
 
-		bo.Wait()
+		if err := bo.Wait(ctx); err != nil {
+			return Item{}, err
+		}
 	}
 }
 
-func (q *Queue) ExtendClaim(item Item, duration time.Duration) {
+// ExtendClaim extends the claim of a pulled job, retrying until it succeeds or the context is cancelled.
+func (q *Queue) ExtendClaim(ctx context.Context, item Item, duration time.Duration) error {
 	if item.fileID == "" || item.jobID == "" {
-		return
+		return nil
 	}
 
 	if duration <= 0 {
-		return
+		return nil
 	}
 
-	ctx := context.Background()
 	bo := backoff.NewExponential(MinBackoff, MaxBackoff)
 
 	for {
 		loaded, exists, err := q.readFile(ctx, item.fileID)
 		if err != nil {
-			bo.Wait()
+			if err := bo.Wait(ctx); err != nil {
+				return err
+			}
 			continue
 		}
 		if !exists {
-			return
+			return nil
 		}
 
 		jobIndex := findJobIndex(loaded.State.Jobs, item.jobID)
 		if jobIndex < 0 {
-			return
+			return nil
 		}
 
 		next := cloneQueueFileState(loaded.State)
@@ -110,53 +117,63 @@ func (q *Queue) ExtendClaim(item Item, duration time.Duration) {
 
 		ok, err := q.replaceFileIfNotChanged(ctx, loaded, next)
 		if err != nil {
-			bo.Wait()
+			if err := bo.Wait(ctx); err != nil {
+				return err
+			}
 			continue
 		}
 		if !ok {
-			bo.Wait()
+			if err := bo.Wait(ctx); err != nil {
+				return err
+			}
 			continue
 		}
 
-		return
+		return nil
 	}
 }
 
-func (q *Queue) Remove(item Item) {
+// Remove deletes a completed job from the queue, retrying until it succeeds or the context is cancelled.
+func (q *Queue) Remove(ctx context.Context, item Item) error {
 	if item.fileID == "" || item.jobID == "" {
-		return
+		return nil
 	}
 
-	ctx := context.Background()
 	bo := backoff.NewExponential(MinBackoff, MaxBackoff)
 
 	for {
 		loaded, exists, err := q.readFile(ctx, item.fileID)
 		if err != nil {
-			bo.Wait()
+			if err := bo.Wait(ctx); err != nil {
+				return err
+			}
 			continue
 		}
 		if !exists {
-			return
+			return nil
 		}
 
 		jobIndex := findJobIndex(loaded.State.Jobs, item.jobID)
 		if jobIndex < 0 {
-			return
+			return nil
 		}
 
 		if len(loaded.State.Jobs) == 1 {
 			ok, err := q.deleteFileIfNotChanged(ctx, loaded)
 			if err != nil {
-				bo.Wait()
+				if err := bo.Wait(ctx); err != nil {
+					return err
+				}
 				continue
 			}
 			if !ok {
-				bo.Wait()
+				if err := bo.Wait(ctx); err != nil {
+					return err
+				}
 				continue
 			}
 
-			return
+			return nil
 		}
 
 		next := cloneQueueFileState(loaded.State)
@@ -164,15 +181,19 @@ func (q *Queue) Remove(item Item) {
 
 		ok, err := q.replaceFileIfNotChanged(ctx, loaded, next)
 		if err != nil {
-			bo.Wait()
+			if err := bo.Wait(ctx); err != nil {
+				return err
+			}
 			continue
 		}
 		if !ok {
-			bo.Wait()
+			if err := bo.Wait(ctx); err != nil {
+				return err
+			}
 			continue
 		}
 
-		return
+		return nil
 	}
 }
 
@@ -3,6 +3,7 @@ package queue
 import (
 	"context"
 	"maps"
+	"sync/atomic"
 	"time"
 
 	"github.com/ZaninAndrea/microdot/pkg/backoff"
@@ -15,18 +16,32 @@ var (
 )
 
 type pushRequest struct {
+	ctx     context.Context
 	payload Payload
-	done    chan struct{}
+	done    chan error
 }
 
-func (q *Queue) Push(payload Payload) {
+// Push adds a job to the queue, batching it with the concurrent pushes. It returns the context error if
+// the context is cancelled before the job is persisted, in which case the job may still be pushed.
+func (q *Queue) Push(ctx context.Context, payload Payload) error {
 	request := pushRequest{
+		ctx:     ctx,
 		payload: maps.Clone(payload),
-		done:    make(chan struct{}),
+		done:    make(chan error, 1),
 	}
 
-	q.pushRequest <- request
-	<-request.done
+	select {
+	case q.pushRequest <- request:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-request.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (q *Queue) pushWorker() {
@@ -56,31 +71,73 @@ func (q *Queue) pushWorker() {
 			}
 		}
 
-		payloads := make([]Payload, len(batch))
-		for i, req := range batch {
+		timer.Stop()
+
+		// The requests whose caller already gave up are not pushed
+		pending := make([]pushRequest, 0, len(batch))
+		for _, req := range batch {
+			if err := req.ctx.Err(); err != nil {
+				req.done <- err
+				continue
+			}
+			pending = append(pending, req)
+		}
+		if len(pending) == 0 {
+			continue
+		}
+
+		payloads := make([]Payload, len(pending))
+		for i, req := range pending {
 			payloads[i] = req.payload
 		}
 
-		q.pushBatch(payloads)
+		ctx, cancel := batchContext(pending)
+		err := q.pushBatch(ctx, payloads)
+		cancel()
 
-		for _, req := range batch {
-			close(req.done)
+		for _, req := range pending {
+			req.done <- err
 		}
 	}
 }
 
-func (q *Queue) pushBatch(payloads []Payload) {
+// batchContext returns a context that is cancelled once the contexts of all the requests are cancelled,
+// since then nobody is waiting for the batch anymore.
+func batchContext(batch []pushRequest) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var remaining atomic.Int64
+	remaining.Store(int64(len(batch)))
+	stops := make([]func() bool, len(batch))
+	for i, req := range batch {
+		stops[i] = context.AfterFunc(req.ctx, func() {
+			if remaining.Add(-1) == 0 {
+				cancel()
+			}
+		})
+	}
+
+	return ctx, func() {
+		for _, stop := range stops {
+			stop()
+		}
+		cancel()
+	}
+}
+
+func (q *Queue) pushBatch(ctx context.Context, payloads []Payload) error {
 	if len(payloads) == 0 {
-		return
+		return nil
 	}
 
-	ctx := context.Background()
 	bo := backoff.NewExponential(MinBackoff, MaxBackoff)
 
 	for {
 		fileIDs, err := q.listFileIDs(ctx)
 		if err != nil {
-			bo.Wait()
+			if err := bo.Wait(ctx); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -101,11 +158,13 @@ func (q *Queue) pushBatch(payloads []Payload) {
 
 			err := q.createFile(ctx, fileID, state)
 			if err != nil {
-				bo.Wait()
+				if err := bo.Wait(ctx); err != nil {
+					return err
+				}
 				continue
 			}
 
-			return
+			return nil
 		}
 
 		start := randomIndex(len(fileIDs))
@@ -142,7 +201,9 @@ func (q *Queue) pushBatch(payloads []Payload) {
 		}
 
 		if shouldRestart || len(candidates) == 0 {
-			bo.Wait()
+			if err := bo.Wait(ctx); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -158,11 +219,13 @@ func (q *Queue) pushBatch(payloads []Payload) {
 
 		ok, err := q.replaceFileIfNotChanged(ctx, candidate, next)
 		if err != nil || !ok {
-			bo.Wait()
+			if err := bo.Wait(ctx); err != nil {
+				return err
+			}
 			continue
 		}
 
-		return
+		return nil
 	}
 }
 
@@ -17,7 +17,9 @@ func (q *Queue) splitPreparingFile(ctx context.Context, original loadedQueueFile
 	for {
 		current, exists, err := q.readFile(ctx, original.ID)
 		if err != nil {
-			bo.Wait()
+			if bo.Wait(ctx) != nil {
+				return
+			}
 			continue
 		}
 		if !exists {
@@ -42,11 +44,15 @@ func (q *Queue) splitPreparingFile(ctx context.Context, original loadedQueueFile
 
 		ok, err := q.replaceFileIfNotChanged(ctx, current, locked)
 		if err != nil {
-			bo.Wait()
+			if bo.Wait(ctx) != nil {
+				return
+			}
 			continue
 		}
 		if !ok {
-			bo.Wait()
+			if bo.Wait(ctx) != nil {
+				return
+			}
 			continue
 		}
 
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+)
+
+// The Elasticsearch compatible endpoints are served under ELASTIC_PATH_PREFIX, shippers should be
+// configured with http://<host>:<port>/elasticsearch as the Elasticsearch URL.
+const ELASTIC_PATH_PREFIX = "/elasticsearch"
+
+// ELASTIC_VERSION is the Elasticsearch version reported to the clients, some of them refuse to
+// connect to servers that are too old.
+const ELASTIC_VERSION = "8.11.0"
+
+type elasticBulkResponse struct {
+	Took   int64                                `json:"took"`
+	Errors bool                                 `json:"errors"`
+	Items  []map[string]elasticBulkResponseItem `json:"items"`
+}
+
+type elasticBulkResponseItem struct {
+	Index   string            `json:"_index"`
+	ID      string            `json:"_id,omitempty"`
+	Version int               `json:"_version,omitempty"`
+	Result  string            `json:"result,omitempty"`
+	Status  int               `json:"status"`
+	Error   *elasticBulkError `json:"error,omitempty"`
+}
+
+type elasticBulkError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// handleElasticInfo answers the handshake that Elasticsearch clients perform before sending data.
+func (s *Server) handleElasticInfo(w http.ResponseWriter, r *http.Request) {
+	writeElasticJSON(w, http.StatusOK, map[string]any{
+		"name":         "microdot",
+		"cluster_name": "microdot",
+		"version": map[string]any{
+			"number":       ELASTIC_VERSION,
+			"build_flavor": "default",
+		},
+		"tagline": "You Know, for Search",
+	})
+}
+
+// handleElasticBulk implements the Elasticsearch bulk API for the index and create actions, so that
+// shippers with an Elasticsearch output (e.g. Filebeat, Fluent Bit or Vector) can send their logs to microdot.
+// The response reports the status of each item, so that shippers retry only the failed ones.
+func (s *Server) handleElasticBulk(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	body, err := requestBody(w, r)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	defer body.Close()
+
+	items, err := s.config.Elastic.Parse(body, r.PathValue("index"))
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	// Persist all the items that were parsed successfully
+	documents := []types.LabeledDocument{}
+	documentItems := []int{}
+	for i, item := range items {
+		if item.Err == nil {
+			documents = append(documents, item.Document)
+			documentItems = append(documentItems, i)
+		}
+	}
+
+	docErrors, flushErr := s.db.AddDocuments(r.Context(), documents)
+	for i, itemIndex := range documentItems {
+		items[itemIndex].Err = docErrors[i]
+		items[itemIndex].Document.ID = documents[i].ID
+	}
+
+	response := elasticBulkResponse{
+		Items: make([]map[string]elasticBulkResponseItem, len(items)),
+	}
+	for i, item := range items {
+		responseItem := elasticBulkResponseItem{
+			Index: item.Index,
+			ID:    item.ID,
+		}
+		if responseItem.ID == "" && item.Err == nil {
+			responseItem.ID = strconv.FormatUint(item.Document.ID, 10)
+		}
+
+		switch {
+		case item.Err != nil:
+			response.Errors = true
+			responseItem.Status = http.StatusBadRequest
+			responseItem.Error = &elasticBulkError{Type: "mapper_parsing_exception", Reason: item.Err.Error()}
+		case flushErr != nil:
+			response.Errors = true
+			responseItem.Status = http.StatusServiceUnavailable
+			responseItem.Error = &elasticBulkError{Type: "unavailable_shards_exception", Reason: fmt.Sprintf("failed to persist document: %v", flushErr)}
+		default:
+			responseItem.Status = http.StatusCreated
+			responseItem.Result = "created"
+			responseItem.Version = 1
+		}
+
+		response.Items[i] = map[string]elasticBulkResponseItem{item.Action: responseItem}
+	}
+	response.Took = time.Since(start).Milliseconds()
+
+	writeElasticJSON(w, http.StatusOK, response)
+}
+
+func writeElasticJSON(w http.ResponseWriter, status int, body any) {
+	// Official Elasticsearch clients check this header to verify that they are talking to Elasticsearch
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/internal/ingest"
+)
+
+// handleLokiPush implements the Loki push API, so that Loki clients (e.g. Promtail, Grafana Alloy or
+// the Docker Loki driver) can send their logs to microdot.
+// Both the JSON and the snappy-compressed protobuf bodies are supported.
+func (s *Server) handleLokiPush(w http.ResponseWriter, r *http.Request) {
+	var parse func([]byte) ([]types.LabeledDocument, error)
+	switch contentType(r) {
+	case "application/json":
+		parse = ingest.ParseLokiJSON
+	case "", "application/x-protobuf":
+		parse = func(body []byte) ([]types.LabeledDocument, error) {
+			return ingest.ParseLokiProtobuf(body, MAX_BODY_SIZE)
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unsupported content type %q", r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := requestBody(w, r)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	defer body.Close()
+
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	documents, err := parse(raw)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	if !s.addDocuments(w, r, documents) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ZaninAndrea/microdot/internal/db"
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/internal/ingest"
+)
+
+// MAX_BODY_SIZE is the maximum size in bytes of a request body accepted by the ingestion endpoints.
+var MAX_BODY_SIZE int64 = 64 << 20
+
+// Config contains the options of the ingestion endpoints.
+type Config struct {
+	// Logfmt is the parser used for request bodies with a logfmt content type.
+	Logfmt *ingest.LogfmtParser
+	// Elastic is the parser used by the Elasticsearch bulk endpoint.
+	Elastic *ingest.ElasticBulkParser
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Logfmt:  ingest.NewLogfmtParser(),
+		Elastic: &ingest.ElasticBulkParser{},
+	}
+}
+
+// Server exposes the ingestion endpoints of a DB over HTTP.
+type Server struct {
+	db     *db.DB
+	mux    *http.ServeMux
+	config Config
+}
+
+var _ http.Handler = (*Server)(nil)
+
+func NewServer(database *db.DB, config Config) *Server {
+	s := &Server{
+		db:     database,
+		mux:    http.NewServeMux(),
+		config: config,
+	}
+
+	s.mux.HandleFunc("POST /api/v1/push", s.handlePush)
+	s.mux.HandleFunc("POST /loki/api/v1/push", s.handleLokiPush)
+	s.mux.HandleFunc("POST /v1/logs", s.handleOTLPLogs)
+	s.mux.HandleFunc("GET "+ELASTIC_PATH_PREFIX+"/{$}", s.handleElasticInfo)
+	s.mux.HandleFunc("POST "+ELASTIC_PATH_PREFIX+"/_bulk", s.handleElasticBulk)
+	s.mux.HandleFunc("PUT "+ELASTIC_PATH_PREFIX+"/_bulk", s.handleElasticBulk)
+	s.mux.HandleFunc("POST "+ELASTIC_PATH_PREFIX+"/{index}/_bulk", s.handleElasticBulk)
+	s.mux.HandleFunc("PUT "+ELASTIC_PATH_PREFIX+"/{index}/_bulk", s.handleElasticBulk)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// requestBody returns the body of the request limited to MAX_BODY_SIZE bytes, transparently
+// decompressing it if it is gzip encoded. The limit applies to the decompressed body as well, so that a
+// small compressed body can't expand to an unbounded amount of memory.
+func requestBody(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
+	body := http.MaxBytesReader(w, r.Body, MAX_BODY_SIZE)
+
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		return gzipReadCloser{
+			Reader: &limitReader{r: io.LimitReader(gzipReader, MAX_BODY_SIZE+1), limit: MAX_BODY_SIZE},
+			gzip:   gzipReader,
+			body:   body,
+		}, nil
+	default:
+		body.Close()
+		return nil, fmt.Errorf("unsupported content encoding %q", r.Header.Get("Content-Encoding"))
+	}
+}
+
+type gzipReadCloser struct {
+	io.Reader
+	gzip *gzip.Reader
+	body io.Closer
+}
+
+func (g gzipReadCloser) Close() error {
+	g.gzip.Close()
+	return g.body.Close()
+}
+
+// limitReader fails with a *http.MaxBytesError once more than limit bytes have been read, the underlying
+// reader is limited to limit+1 bytes so that the excess is detected without reading it all.
+type limitReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n - int(l.read-l.limit), &http.MaxBytesError{Limit: l.limit}
+	}
+
+	return n, err
+}
+
+// writeBodyError responds to a request whose body could not be read or parsed.
+func writeBodyError(w http.ResponseWriter, err error) {
+	if _, ok := errors.AsType[*http.MaxBytesError](err); ok {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, ingest.ErrDecodedBodyTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// addDocuments validates and persists the documents of a request, the response is sent only after the documents
+// have been persisted in the WAL. If any of the documents is invalid the whole request is rejected.
+func (s *Server) addDocuments(w http.ResponseWriter, r *http.Request, documents []types.LabeledDocument) bool {
+	for i, document := range documents {
+		if err := db.ValidateDocument(document.Document); err != nil {
+			http.Error(w, fmt.Sprintf("document %d: %v", i, err), http.StatusBadRequest)
+			return false
+		}
+	}
+
+	if _, err := s.db.AddDocuments(r.Context(), documents); err != nil {
+		http.Error(w, fmt.Sprintf("failed to persist documents: %v", err), http.StatusServiceUnavailable)
+		return false
+	}
+
+	return true
+}
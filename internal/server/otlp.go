@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/internal/ingest"
+)
+
+// handleOTLPLogs implements the OTLP/HTTP logs receiver, supporting both the protobuf and the JSON encodings.
+// Log records that can't be converted to documents or fail the document validation are rejected and reported
+// in the partial success field of the response, while the others are persisted.
+func (s *Server) handleOTLPLogs(w http.ResponseWriter, r *http.Request) {
+	var parse func([]byte) ([]ingest.OTLPLogRecord, error)
+	var encodeResponse func(int64, string) []byte
+	mediaType := contentType(r)
+	switch mediaType {
+	case "application/x-protobuf":
+		parse = ingest.ParseOTLPProtobuf
+		encodeResponse = ingest.EncodeOTLPResponseProtobuf
+	case "application/json":
+		parse = ingest.ParseOTLPJSON
+		encodeResponse = ingest.EncodeOTLPResponseJSON
+	default:
+		http.Error(w, fmt.Sprintf("unsupported content type %q", r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := requestBody(w, r)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	defer body.Close()
+
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	records, err := parse(raw)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	// Persist all the log records that were converted successfully
+	documents := []types.LabeledDocument{}
+	documentRecords := []int{}
+	for i, record := range records {
+		if record.Err == nil {
+			documents = append(documents, record.Document)
+			documentRecords = append(documentRecords, i)
+		}
+	}
+
+	docErrors, err := s.db.AddDocuments(r.Context(), documents)
+	if err != nil {
+		// The OTLP exporters retry the requests that fail with 503
+		http.Error(w, fmt.Sprintf("failed to persist documents: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	for i, recordIndex := range documentRecords {
+		records[recordIndex].Err = docErrors[i]
+	}
+
+	var rejected int64
+	var reasons []string
+	for i, record := range records {
+		if record.Err != nil {
+			rejected++
+			reasons = append(reasons, fmt.Sprintf("log record %d: %v", i, record.Err))
+		}
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(encodeResponse(rejected, strings.Join(reasons, "; ")))
+}
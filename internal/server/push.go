@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+
+	"github.com/ZaninAndrea/microdot/internal/db"
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/internal/ingest"
+)
+
+type lineParser func(line []byte) (types.Labels, types.Document, error)
+
+// handlePush ingests a body with one document per line, either as JSON objects (the default) or as
+// logfmt lines when the content type is application/logfmt.
+// The query parameters of the logfmt requests are added as labels to all the documents, the labels of each
+// line take precedence.
+//
+// The documents are validated before any of them is written, so a request is either accepted or rejected
+// as a whole. The response is sent only after the documents have been persisted in the WAL.
+func (s *Server) handlePush(w http.ResponseWriter, r *http.Request) {
+	var parse lineParser
+	defaultLabels := types.Labels{}
+	switch contentType(r) {
+	case "", "application/json", "application/x-ndjson", "application/jsonl":
+		parse = ingest.ParseJSON
+	case "application/logfmt", "text/logfmt":
+		parse = s.config.Logfmt.Parse
+		defaultLabels = queryLabels(r)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported content type %q", r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := requestBody(w, r)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	defer body.Close()
+
+	documents, err := readLines(body, parse, defaultLabels)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	// The documents have already been validated, so only the flush error needs to be checked
+	if _, err := s.db.AddDocuments(r.Context(), documents); err != nil {
+		http.Error(w, fmt.Sprintf("failed to persist documents: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readLines parses and validates all the documents in a newline-delimited body.
+func readLines(body io.Reader, parse lineParser, defaultLabels types.Labels) ([]types.LabeledDocument, error) {
+	documents := []types.LabeledDocument{}
+
+	// bufio.Reader is used instead of bufio.Scanner since the latter doesn't support arbitrarily long lines
+	reader := bufio.NewReader(body)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			labels, doc, parseErr := parse(line)
+			if parseErr != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, parseErr)
+			}
+			if validationErr := db.ValidateDocument(doc); validationErr != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, validationErr)
+			}
+
+			mergedLabels := maps.Clone(defaultLabels)
+			maps.Copy(mergedLabels, labels)
+			documents = append(documents, types.LabeledDocument{Labels: mergedLabels, Document: doc})
+		}
+
+		if err == io.EOF {
+			return documents, nil
+		}
+	}
+}
+
+// queryLabels returns the query parameters of the request as stream labels.
+func queryLabels(r *http.Request) types.Labels {
+	labels := types.Labels{}
+	for key, values := range r.URL.Query() {
+		if len(values) > 0 {
+			labels[key] = values[len(values)-1]
+		}
+	}
+
+	return labels
+}
+
+// contentType returns the media type of the request, without parameters.
+func contentType(r *http.Request) string {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return ""
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return header
+	}
+
+	return mediaType
+}
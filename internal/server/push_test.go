@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db"
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/internal/wal"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+func newTestServer(t *testing.T) (*Server, *db.DB) {
+	t.Helper()
+
+	oldInterval := wal.FLUSH_INTERVAL
+	wal.FLUSH_INTERVAL = 10 * time.Millisecond
+	t.Cleanup(func() { wal.FLUSH_INTERVAL = oldInterval })
+
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.NewDB(bucket, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewServer(database, DefaultConfig()), database
+}
+
+func push(server *Server, target string, body []byte, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	for key, value := range header {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	return w
+}
+
+func gzipBody(t *testing.T, body string) []byte {
+	t.Helper()
+
+	buf := bytes.Buffer{}
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// countDocuments returns the number of documents matching the labels and the query.
+func countDocuments(t *testing.T, database *db.DB, labels types.Labels, query string) int {
+	t.Helper()
+
+	count := 0
+	for result := range database.Query(context.Background(), labels, query) {
+		if result.IsErr() {
+			t.Fatal(result.Error())
+		}
+		count++
+	}
+	return count
+}
+
+func TestPush(t *testing.T) {
+	server, database := newTestServer(t)
+
+	body := `{"labels":{"app":"api"},"msg":"first","ts":1}` + "\n\n" + `{"labels":{"app":"api"},"msg":"second","ts":2}`
+	if w := push(server, "/api/v1/push", []byte(body), map[string]string{"Content-Type": "application/x-ndjson"}); w.Code != http.StatusNoContent {
+		t.Fatalf("push = %d %q, want %d", w.Code, w.Body, http.StatusNoContent)
+	}
+
+	body = "app=web msg=third ts=3"
+	header := map[string]string{"Content-Type": "application/logfmt", "Content-Encoding": "gzip"}
+	if w := push(server, "/api/v1/push?env=prod", gzipBody(t, body), header); w.Code != http.StatusNoContent {
+		t.Fatalf("gzip logfmt push = %d %q, want %d", w.Code, w.Body, http.StatusNoContent)
+	}
+
+	// The response is sent after the flush, so the documents are already in the WAL
+	if count := countDocuments(t, database, types.Labels{"app": "api"}, ""); count != 2 {
+		t.Errorf("Query(app=api) found %d documents, want 2", count)
+	}
+	if count := countDocuments(t, database, types.Labels{"env": "prod"}, "third"); count != 1 {
+		t.Errorf("Query(env=prod) found %d documents, want the logfmt document with the query labels", count)
+	}
+}
+
+func TestPushErrors(t *testing.T) {
+	server, database := newTestServer(t)
+
+	tests := []struct {
+		name     string
+		body     []byte
+		header   map[string]string
+		code     int
+		contains string
+	}{
+		{
+			name:     "invalid json line",
+			body:     []byte(`{"msg":"valid","ts":1}` + "\n" + `{"msg":`),
+			code:     http.StatusBadRequest,
+			contains: "line 2",
+		},
+		{
+			name:     "invalid document",
+			body:     []byte(`{"msg":"valid","ts":1}` + "\n" + `{"ts":2}`),
+			code:     http.StatusBadRequest,
+			contains: "line 2",
+		},
+		{
+			name:   "unsupported content type",
+			body:   []byte(`{"msg":"valid","ts":1}`),
+			header: map[string]string{"Content-Type": "text/csv"},
+			code:   http.StatusUnsupportedMediaType,
+		},
+		{
+			name:   "unsupported content encoding",
+			body:   []byte(`{"msg":"valid","ts":1}`),
+			header: map[string]string{"Content-Encoding": "br"},
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "invalid gzip body",
+			body:   []byte(`{"msg":"valid","ts":1}`),
+			header: map[string]string{"Content-Encoding": "gzip"},
+			code:   http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := push(server, "/api/v1/push", tt.body, tt.header)
+			if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.contains) {
+				t.Errorf("push = %d %q, want %d containing %q", w.Code, w.Body, tt.code, tt.contains)
+			}
+		})
+	}
+
+	// The rejected requests are discarded as a whole
+	if count := countDocuments(t, database, types.Labels{}, ""); count != 0 {
+		t.Errorf("Query() found %d documents, want none", count)
+	}
+}
+
+func TestPushBodyLimit(t *testing.T) {
+	oldLimit := MAX_BODY_SIZE
+	MAX_BODY_SIZE = 256
+	defer func() { MAX_BODY_SIZE = oldLimit }()
+
+	server, _ := newTestServer(t)
+	line := `{"msg":"a","ts":1}` + "\n"
+	body := strings.Repeat(line, 100)
+
+	if w := push(server, "/api/v1/push", []byte(body), nil); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("push = %d %q, want %d", w.Code, w.Body, http.StatusRequestEntityTooLarge)
+	}
+
+	// The compressed body is within the limit, but the decompressed one isn't
+	compressed := gzipBody(t, body)
+	if int64(len(compressed)) > MAX_BODY_SIZE {
+		t.Fatalf("compressed body is %d bytes, it should be within the limit", len(compressed))
+	}
+	if w := push(server, "/api/v1/push", compressed, map[string]string{"Content-Encoding": "gzip"}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("gzip push = %d %q, want %d", w.Code, w.Body, http.StatusRequestEntityTooLarge)
+	}
+
+	if w := push(server, "/api/v1/push", []byte(strings.Repeat(line, 10)), nil); w.Code != http.StatusNoContent {
+		t.Errorf("push within the limit = %d %q, want %d", w.Code, w.Body, http.StatusNoContent)
+	}
+}
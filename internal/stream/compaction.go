@@ -0,0 +1,387 @@
+package stream
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"hash/fnv"
+	"iter"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/archive"
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+	"github.com/ZaninAndrea/microdot/pkg/containers"
+)
+
+// The archives of a stream are managed as an LSM tree, merging them into fewer and larger archives that
+// are sorted by timestamp. Like InfluxDB, two strategies are used depending on the age of the data:
+//   - Recent archives are size-tiered: COMPACTION_FAN_IN archives of similar size are merged together, so
+//     the data is rewritten only a logarithmic number of times while it's still being ingested
+//   - Archives whose data is older than COLD_ARCHIVE_AGE are time-windowed: all the archives
+//     starting in the same COMPACTION_WINDOW are merged, so old data ends up in a single archive per window
+//
+// Each merge produces an archive with the next level, up to MAX_COMPACTED_SIZE bytes.
+var COMPACTION_FAN_IN = 4
+var COMPACTION_BASE_SIZE uint64 = 1 << 20
+var MAX_COMPACTED_SIZE uint64 = 256 << 20
+var COLD_ARCHIVE_AGE = 24 * time.Hour
+var COMPACTION_WINDOW = 24 * time.Hour
+
+// Compacted archives are read mostly in bulk, so they use larger blocks that compress better.
+var COMPACTED_BLOCK_SIZE = 8 * archive.BLOCK_SIZE
+
+// Compaction merges the Sources archives of a stream into the Target archive.
+type Compaction struct {
+	Sources []Archive
+	Target  Archive
+}
+
+type Compactor struct {
+	bucket blob.Bucket
+	writer *Writer
+}
+
+func NewCompactor(bucket blob.Bucket) *Compactor {
+	return &Compactor{
+		bucket: bucket,
+		writer: NewWriter(bucket),
+	}
+}
+
+// Plan returns the compactions of the stream archives that are currently eligible for merging.
+// Planning is side-effect free, so the same compaction may be planned multiple times and overlapping
+// compactions may be planned concurrently: conflicts are resolved when the compactions are published.
+func (c *Compactor) Plan(ctx context.Context, streamID uint64, now time.Time) ([]Compaction, error) {
+	manifest, _, err := loadManifest(ctx, c.bucket, streamID)
+	if err != nil {
+		return nil, err
+	}
+
+	return planCompactions(manifest.Archives, now), nil
+}
+
+func planCompactions(entries []ManifestEntry, now time.Time) []Compaction {
+	// Archives with close timestamps are merged together, so that the merged archives overlap as little as possible
+	entries = slices.Clone(entries)
+	slices.SortFunc(entries, func(a, b ManifestEntry) int {
+		return cmp.Or(cmp.Compare(a.MinTimestamp, b.MinTimestamp), strings.Compare(a.name(), b.name()))
+	})
+
+	coldBefore := now.Add(-COLD_ARCHIVE_AGE).UnixMilli()
+	windowMillis := max(COMPACTION_WINDOW.Milliseconds(), 1)
+	tiers := make(map[int][]ManifestEntry)
+	windows := make(map[int64][]ManifestEntry)
+	compactions := []Compaction{}
+	for _, entry := range entries {
+		if entry.Size >= MAX_COMPACTED_SIZE {
+			continue
+		}
+
+		if entry.MaxTimestamp < coldBefore {
+			window := entry.MinTimestamp / windowMillis
+			windows[window] = append(windows[window], entry)
+			continue
+		}
+
+		tier := sizeTier(entry.Size)
+		tiers[tier] = append(tiers[tier], entry)
+		if len(tiers[tier]) == COMPACTION_FAN_IN {
+			compactions = append(compactions, newCompaction(tiers[tier]))
+			tiers[tier] = nil
+		}
+	}
+
+	for _, window := range slices.Sorted(maps.Keys(windows)) {
+		// The archives of the window are merged in groups that don't exceed the maximum size
+		group := []ManifestEntry{}
+		size := uint64(0)
+		for _, entry := range windows[window] {
+			if len(group) > 0 && size+entry.Size > MAX_COMPACTED_SIZE {
+				if len(group) > 1 {
+					compactions = append(compactions, newCompaction(group))
+				}
+				group, size = nil, 0
+			}
+
+			group = append(group, entry)
+			size += entry.Size
+		}
+		if len(group) > 1 {
+			compactions = append(compactions, newCompaction(group))
+		}
+	}
+
+	return compactions
+}
+
+// sizeTier returns the tier of an archive with the given size: archives smaller than COMPACTION_BASE_SIZE
+// are in tier 0, then each tier contains archives COMPACTION_FAN_IN times larger than the previous one.
+func sizeTier(size uint64) int {
+	tier := 0
+	limit := COMPACTION_BASE_SIZE
+	for size >= limit {
+		tier++
+		limit *= uint64(COMPACTION_FAN_IN)
+	}
+
+	return tier
+}
+
+// newCompaction returns the compaction merging the sources. The target is derived from the sources, so
+// planning the same compaction again produces the same target.
+func newCompaction(sources []ManifestEntry) Compaction {
+	hash := fnv.New64a()
+	target := Archive{StreamID: sources[0].StreamID, MinTimestamp: sources[0].MinTimestamp, MaxTimestamp: sources[0].MaxTimestamp}
+	archives := make([]Archive, len(sources))
+	for i, source := range sources {
+		archives[i] = source.Archive
+		hash.Write([]byte(source.name()))
+		hash.Write([]byte{0})
+
+		target.Level = max(target.Level, source.Level+1)
+		target.MinTimestamp = min(target.MinTimestamp, source.MinTimestamp)
+		target.MaxTimestamp = max(target.MaxTimestamp, source.MaxTimestamp)
+	}
+	target.FileID = hash.Sum64()
+
+	return Compaction{Sources: archives, Target: target}
+}
+
+// Compact executes the compaction, it can be safely retried after a failure or a crash at any point.
+// If some of the sources have already been merged by a different compaction the execution is abandoned
+// and nil is returned, the files written by the abandoned compaction are removed by the garbage collector.
+func (c *Compactor) Compact(ctx context.Context, compaction Compaction) error {
+	streamID := compaction.Target.StreamID
+	manifest, _, err := loadManifest(ctx, c.bucket, streamID)
+	if err != nil {
+		return err
+	}
+	if manifest.isPublished(compaction.Target) {
+		// A previous execution has already completed the compaction
+		return nil
+	}
+	for _, source := range compaction.Sources {
+		if !manifest.isLive(source) {
+			return nil
+		}
+	}
+
+	columns, labels, err := c.readSchema(ctx, compaction.Sources)
+	if err != nil {
+		return err
+	}
+
+	rows := c.mergeSources(ctx, compaction.Sources, columns)
+	err = c.writer.storeArchive(ctx, compaction.Target, columns, labels, rows, COMPACTED_BLOCK_SIZE, compaction.Sources)
+	if errors.Is(err, ErrArchiveNotLive) {
+		// A concurrent compaction merged some of the sources
+		return nil
+	}
+	return err
+}
+
+// readSchema returns the columns of the merged archive, which contain the columns of all the sources
+// widened to their common supertype, and the labels of the stream. Only the metadata files of the sources
+// are downloaded.
+func (c *Compactor) readSchema(ctx context.Context, sources []Archive) ([]archive.ColumnDef, types.Labels, error) {
+	columns := make(map[string]archive.ColumnDef)
+	var labels types.Labels
+	for _, source := range sources {
+		reader, err := openArchiveRange(ctx, c.bucket, source)
+		if err != nil {
+			return nil, nil, err
+		}
+		labels = reader.Labels()
+		for _, col := range reader.Columns() {
+			if existing, ok := columns[col.Key]; ok {
+				col.Type = getCommonSupertype(existing.Type, col.Type)
+			}
+			columns[col.Key] = col
+		}
+
+		if err := reader.Close(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return slices.SortedFunc(maps.Values(columns), func(a, b archive.ColumnDef) int {
+		return strings.Compare(a.Key, b.Key)
+	}), labels, nil
+}
+
+// mergeSources returns the rows of the sources in timestamp order, converted to the given columns. Rows
+// with the same timestamp are ordered by ID, so the merged archive content is deterministic.
+// Each iteration reads the sources again.
+func (c *Compactor) mergeSources(ctx context.Context, sources []Archive, columns []archive.ColumnDef) iter.Seq[containers.Result[archive.Row]] {
+	return func(yield func(containers.Result[archive.Row]) bool) {
+		cursors := make([]*mergeCursor, 0, len(sources))
+		defer func() {
+			for _, cursor := range cursors {
+				cursor.close()
+			}
+		}()
+
+		compare := rowOrder(columns)
+		for _, source := range sources {
+			cursor, err := c.openCursor(ctx, source, columns)
+			if err != nil {
+				yield(containers.Err[archive.Row](err))
+				return
+			}
+			cursors = append(cursors, cursor)
+		}
+
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(containers.Err[archive.Row](err))
+				return
+			}
+
+			// Pick the source with the earliest row
+			next := -1
+			for i, cursor := range cursors {
+				if cursor.row != nil && (next < 0 || compare(cursor.row, cursors[next].row) < 0) {
+					next = i
+				}
+			}
+			if next < 0 {
+				return
+			}
+
+			if !yield(containers.Ok(cursors[next].row)) {
+				return
+			}
+			if err := cursors[next].advance(); err != nil {
+				yield(containers.Err[archive.Row](err))
+				return
+			}
+		}
+	}
+}
+
+// mergeCursor iterates the rows of a source of a compaction, row is nil once all rows have been read.
+type mergeCursor struct {
+	next func() (containers.Result[archive.Row], bool)
+	stop func()
+	row  archive.Row
+}
+
+// openCursor opens a cursor on the source, converting its rows to the given columns. The rows of all the
+// archives are already sorted, so they are streamed.
+func (c *Compactor) openCursor(ctx context.Context, source Archive, columns []archive.ColumnDef) (*mergeCursor, error) {
+	reader, err := openArchiveRange(ctx, c.bucket, source)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceIndexes := make([]int, len(columns))
+	for i, col := range columns {
+		sourceIndexes[i] = slices.IndexFunc(reader.Columns(), func(sourceCol archive.ColumnDef) bool {
+			return sourceCol.Key == col.Key
+		})
+	}
+	convert := func(row archive.Row) archive.Row {
+		converted := make(archive.Row, len(columns))
+		for i, col := range columns {
+			var value any
+			if sourceIndexes[i] >= 0 {
+				value = row[sourceIndexes[i]]
+			}
+			converted[i] = castValue(value, col.Type)
+		}
+		return converted
+	}
+
+	rows := func(yield func(containers.Result[archive.Row]) bool) {
+		for row := range reader.Rows() {
+			if row.IsErr() {
+				yield(row)
+				return
+			}
+			if !yield(containers.Ok(convert(row.Value))) {
+				return
+			}
+		}
+	}
+	next, stop := iter.Pull(rows)
+	cursor := &mergeCursor{
+		next: next,
+		stop: func() {
+			stop()
+			reader.Close()
+		},
+	}
+	if err := cursor.advance(); err != nil {
+		cursor.close()
+		return nil, err
+	}
+
+	return cursor, nil
+}
+
+func (m *mergeCursor) advance() error {
+	row, ok := m.next()
+	if !ok {
+		m.row = nil
+		return nil
+	}
+	if row.IsErr() {
+		return row.Error()
+	}
+
+	m.row = row.Value
+	return nil
+}
+
+func (m *mergeCursor) close() {
+	m.stop()
+}
+
+// rowOrder returns a comparison function ordering the rows by their ts column and then by their _id column.
+func rowOrder(columns []archive.ColumnDef) func(a, b archive.Row) int {
+	indexes := []int{}
+	for _, key := range []string{"ts", "_id"} {
+		i := slices.IndexFunc(columns, func(col archive.ColumnDef) bool {
+			return col.Key == key
+		})
+		if i >= 0 {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return func(a, b archive.Row) int {
+		for _, i := range indexes {
+			if c := compareValues(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+}
+
+// compareValues compares two values of the same column, the missing values come first.
+func compareValues(a, b any) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	switch a := a.(type) {
+	case int64:
+		return cmp.Compare(a, b.(int64))
+	case float64:
+		return cmp.Compare(a, b.(float64))
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+
+	return 0
+}
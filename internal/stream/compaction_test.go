@@ -0,0 +1,169 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/archive"
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+func TestPlanCompactions(t *testing.T) {
+	now := time.UnixMilli(100 * COMPACTION_WINDOW.Milliseconds())
+	hot := now.Add(-time.Minute).UnixMilli()
+	cold := now.Add(-10 * COMPACTION_WINDOW).UnixMilli()
+
+	entry := func(fileID uint64, ts int64, size uint64) ManifestEntry {
+		return ManifestEntry{Archive: Archive{StreamID: 1, MinTimestamp: ts, MaxTimestamp: ts, FileID: fileID}, Size: size}
+	}
+	entries := []ManifestEntry{
+		// Recent archives are merged in groups of similar size
+		entry(1, hot, 10), entry(2, hot+1, 10), entry(3, hot+2, COMPACTION_BASE_SIZE),
+		entry(4, hot+3, 10), entry(5, hot+4, 10), entry(6, hot+5, 10),
+		entry(7, hot+6, MAX_COMPACTED_SIZE),
+		// Old archives are merged by time window
+		entry(8, cold, 10), entry(9, cold+1, 10),
+		entry(10, cold+COMPACTION_WINDOW.Milliseconds(), 10),
+	}
+
+	compactions := planCompactions(entries, now)
+	if len(compactions) != 2 {
+		t.Fatalf("planned %d compactions, want 2: %v", len(compactions), compactions)
+	}
+	fileIDs := func(archives []Archive) []uint64 {
+		ids := []uint64{}
+		for _, a := range archives {
+			ids = append(ids, a.FileID)
+		}
+		return ids
+	}
+	if ids := fileIDs(compactions[0].Sources); !slices.Equal(ids, []uint64{1, 2, 4, 5}) {
+		t.Errorf("size-tiered compaction sources = %v", ids)
+	}
+	if ids := fileIDs(compactions[1].Sources); !slices.Equal(ids, []uint64{8, 9}) {
+		t.Errorf("time-windowed compaction sources = %v", ids)
+	}
+
+	target := compactions[0].Target
+	if target.Level != 1 || target.MinTimestamp != hot || target.MaxTimestamp != hot+4 {
+		t.Errorf("unexpected target %v", target)
+	}
+	if again := planCompactions(entries, now); again[0].Target != target {
+		t.Errorf("the target changed between plans: %v, %v", again[0].Target, target)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	diskBucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := &countingBucket{DiskBucket: diskBucket}
+	writer := NewWriter(bucket)
+	compactor := NewCompactor(bucket)
+	labels := types.Labels{"app": "test"}
+	streamID := StreamID(labels)
+
+	// The sources overlap in time and have different columns
+	sources := [][]types.Document{
+		{{"_id": int64(3), "ts": int64(30), "msg": "c"}, {"_id": int64(1), "ts": int64(10), "msg": "a"}},
+		{{"_id": int64(2), "ts": int64(20), "msg": "b", "status": int64(200)}},
+		{{"_id": int64(4), "ts": int64(20), "msg": "d", "status": "ok"}},
+	}
+	archives := []Archive{}
+	for i, documents := range sources {
+		a, err := writer.AppendDocuments(ctx, streamID, uint64(i), labels, iterTestDocuments(documents...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, a)
+	}
+
+	manifest, err := NewReader(bucket).LoadManifest(ctx, streamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compaction := newCompaction(manifest.Archives)
+
+	// The schema is read from the metadata files, without downloading the data files
+	bucket.dataReads.Store(0)
+	bucket.rangeReads.Store(0)
+	if _, _, err := compactor.readSchema(ctx, compaction.Sources); err != nil {
+		t.Fatal(err)
+	}
+	if reads := bucket.dataReads.Load() + bucket.rangeReads.Load(); reads != 0 {
+		t.Errorf("readSchema() read the data files %d times, want 0", reads)
+	}
+
+	for range 2 {
+		if err := compactor.Compact(ctx, compaction); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	live, err := NewReader(bucket).ListArchives(ctx, streamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(live, []Archive{compaction.Target}) {
+		t.Errorf("ListArchives() = %v, want %v", live, []Archive{compaction.Target})
+	}
+
+	// The rows are merged in timestamp order, widening the column types
+	reader, err := openArchive(ctx, bucket, compaction.Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	expectedColumns := []archive.ColumnDef{
+		{Key: "_id", Type: archive.ColumnTypeInt64},
+		{Key: "msg", Type: archive.ColumnTypeString},
+		{Key: "status", Type: archive.ColumnTypeString},
+		{Key: "ts", Type: archive.ColumnTypeInt64},
+	}
+	if !slices.Equal(reader.Columns(), expectedColumns) {
+		t.Errorf("Columns() = %v, want %v", reader.Columns(), expectedColumns)
+	}
+	rows := []archive.Row{}
+	for row := range reader.Rows() {
+		if row.IsErr() {
+			t.Fatal(row.Error())
+		}
+		rows = append(rows, row.Value)
+	}
+	expectedRows := []archive.Row{
+		{int64(1), "a", nil, int64(10)},
+		{int64(2), "b", "200", int64(20)},
+		{int64(4), "d", "ok", int64(20)},
+		{int64(3), "c", nil, int64(30)},
+	}
+	if fmt.Sprint(rows) != fmt.Sprint(expectedRows) {
+		t.Errorf("rows = %v, want %v", rows, expectedRows)
+	}
+
+	// Retrying the append of a compacted archive doesn't duplicate its documents
+	if _, err := writer.AppendDocuments(ctx, streamID, 0, labels, iterTestDocuments(sources[0]...)); err != nil {
+		t.Fatal(err)
+	}
+	live, err = NewReader(bucket).ListArchives(ctx, streamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 1 {
+		t.Errorf("ListArchives() = %v, want only the compacted archive", live)
+	}
+
+	// A compaction whose sources have been merged by another compaction is abandoned
+	conflicting := Compaction{Sources: archives[:2], Target: Archive{StreamID: streamID, Level: 1, FileID: 42}}
+	if err := compactor.Compact(ctx, conflicting); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := writer.archiveExists(ctx, conflicting.Target); exists {
+		t.Errorf("the abandoned compaction wrote its target")
+	}
+}
@@ -0,0 +1,129 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+// GC_GRACE_PERIOD is the time an archive stays in the garbage of the manifest before its files are deleted.
+// It must be longer than the slowest reader, which may still be reading an archive removed after it loaded
+// the manifest, and than the time needed to upload and publish an archive.
+var GC_GRACE_PERIOD = time.Hour
+
+// CollectGarbage deletes the files of the stream that have been in the garbage for GC_GRACE_PERIOD, and adds
+// to the garbage the archives that are not referenced by the manifest, such as the ones left behind by a
+// crashed writer.
+//
+// The deletion happens in three steps, each of them can be safely retried:
+// - The expired garbage entries are marked as deleting, so that they can't be published anymore
+// - The files are deleted
+// - The entries are removed from the garbage
+func (w *Writer) CollectGarbage(ctx context.Context, streamID uint64, now time.Time) error {
+	stored, err := w.listStoredArchives(ctx, streamID)
+	if err != nil {
+		return err
+	}
+
+	deleting := []Archive{}
+	err = updateManifest(ctx, w.bucket, streamID, func(manifest *Manifest) (bool, error) {
+		deleting = deleting[:0]
+		changed := false
+
+		for _, a := range stored {
+			if !manifest.isLive(a) && manifest.garbageIndex(a) < 0 {
+				manifest.Garbage = append(manifest.Garbage, GarbageEntry{Archive: a, Since: now.UTC()})
+				changed = true
+			}
+		}
+
+		for i, entry := range manifest.Garbage {
+			if entry.Deleting || now.Sub(entry.Since) >= GC_GRACE_PERIOD {
+				changed = changed || !entry.Deleting
+				manifest.Garbage[i].Deleting = true
+				deleting = append(deleting, entry.Archive)
+			}
+		}
+
+		return changed, nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(deleting) == 0 {
+		return nil
+	}
+
+	for _, a := range deleting {
+		for _, key := range []string{a.dataFileName(), a.metadataFileName()} {
+			err := w.bucket.DeleteObject(ctx, key, nil)
+			if err != nil && !errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+				return err
+			}
+		}
+	}
+
+	return updateManifest(ctx, w.bucket, streamID, func(manifest *Manifest) (bool, error) {
+		length := len(manifest.Garbage)
+		manifest.Garbage = slices.DeleteFunc(manifest.Garbage, func(entry GarbageEntry) bool {
+			return entry.Deleting && slices.Contains(deleting, entry.Archive)
+		})
+		return len(manifest.Garbage) != length, nil
+	})
+}
+
+// listStoredArchives lists the archives of the stream that have at least one file in the bucket.
+func (w *Writer) listStoredArchives(ctx context.Context, streamID uint64) ([]Archive, error) {
+	archives := []Archive{}
+	for obj := range w.bucket.ListObjects(ctx, streamDirectory(streamID)) {
+		if obj.IsErr() {
+			return nil, obj.Error()
+		}
+
+		name, ok := strings.CutSuffix(obj.Value, DATA_FILE_EXTENSION)
+		if !ok {
+			name, ok = strings.CutSuffix(obj.Value, METADATA_FILE_EXTENSION)
+		}
+		if !ok {
+			continue
+		}
+
+		if a, ok := ParseArchive(streamID, name); ok && !slices.Contains(archives, a) {
+			archives = append(archives, a)
+		}
+	}
+
+	return archives, nil
+}
+
+// ListStreams returns the IDs of all the streams stored in the bucket. It lists all the files of the
+// streams, so it should only be used by background jobs.
+func (r *Reader) ListStreams(ctx context.Context) ([]uint64, error) {
+	streams := []uint64{}
+	for obj := range r.bucket.ListObjects(ctx, STREAM_FILE_PREFIX) {
+		if obj.IsErr() {
+			return nil, obj.Error()
+		}
+
+		directory, _, ok := strings.Cut(strings.TrimPrefix(obj.Value, STREAM_FILE_PREFIX), "/")
+		if !ok {
+			continue
+		}
+		streamID, err := strconv.ParseUint(directory, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if !slices.Contains(streams, streamID) {
+			streams = append(streams, streamID)
+		}
+	}
+
+	slices.Sort(streams)
+	return streams, nil
+}
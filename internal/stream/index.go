@@ -0,0 +1,121 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+// The labels of all the streams are stored in a single index object, so that the streams matching a selector
+// are found with a single read instead of listing the files of all the streams. A stream is added to the
+// index before its first archive is published, so the index contains all the streams with some archives.
+// The index is updated with a compare-and-swap on its etag, like the manifests.
+const STREAM_INDEX_FILE_NAME = STREAM_FILE_PREFIX + "index.json"
+
+type streamIndex struct {
+	Streams map[uint64]types.Labels `json:"streams"`
+}
+
+// loadStreamIndex reads the index of the streams and its etag. If the index doesn't exist yet, an empty
+// index and an empty etag are returned.
+func loadStreamIndex(ctx context.Context, bucket blob.Bucket) (streamIndex, string, error) {
+	reader, etag, err := bucket.GetObject(ctx, STREAM_INDEX_FILE_NAME)
+	if errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+		return streamIndex{Streams: map[uint64]types.Labels{}}, "", nil
+	}
+	if err != nil {
+		return streamIndex{}, "", err
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return streamIndex{}, "", err
+	}
+
+	index := streamIndex{}
+	if err := json.Unmarshal(content, &index); err != nil {
+		return streamIndex{}, "", fmt.Errorf("invalid stream index: %w", err)
+	}
+	if index.Streams == nil {
+		index.Streams = map[uint64]types.Labels{}
+	}
+
+	return index, etag, nil
+}
+
+// indexStreams adds the streams to the index, the streams that are already indexed are left unchanged.
+func indexStreams(ctx context.Context, bucket blob.Bucket, streams map[uint64]types.Labels) error {
+	load := func() (streamIndex, string, error) {
+		return loadStreamIndex(ctx, bucket)
+	}
+
+	return updateJSONObject(ctx, bucket, STREAM_INDEX_FILE_NAME, load, func(index *streamIndex) (bool, error) {
+		changed := false
+		for streamID, labels := range streams {
+			if _, ok := index.Streams[streamID]; ok {
+				continue
+			}
+			if labels == nil {
+				labels = types.Labels{}
+			}
+			index.Streams[streamID] = labels
+			changed = true
+		}
+
+		return changed, nil
+	})
+}
+
+// MatchStreams returns the IDs of the streams whose labels contain all the labels of the selector.
+func (r *Reader) MatchStreams(ctx context.Context, selector types.Labels) ([]uint64, error) {
+	index, _, err := loadStreamIndex(ctx, r.bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []uint64{}
+	for _, streamID := range slices.Sorted(maps.Keys(index.Streams)) {
+		if index.Streams[streamID].Matches(selector) {
+			matches = append(matches, streamID)
+		}
+	}
+
+	return matches, nil
+}
+
+// IndexStreams adds to the index the given streams that are missing from it, such as the ones created
+// before the index existed. The labels are read from the manifests of the streams.
+func (w *Writer) IndexStreams(ctx context.Context, streams []uint64) error {
+	index, _, err := loadStreamIndex(ctx, w.bucket)
+	if err != nil {
+		return err
+	}
+
+	missing := make(map[uint64]types.Labels)
+	for _, streamID := range streams {
+		if _, ok := index.Streams[streamID]; ok {
+			continue
+		}
+
+		manifest, _, err := loadManifest(ctx, w.bucket, streamID)
+		if err != nil {
+			return err
+		}
+		if len(manifest.Archives) > 0 {
+			missing[streamID] = manifest.Labels
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return indexStreams(ctx, w.bucket, missing)
+}
@@ -0,0 +1,56 @@
+package stream
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+func TestMatchStreams(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := NewWriter(bucket)
+	reader := NewReader(bucket)
+
+	api := types.Labels{"app": "api", "env": "prod"}
+	web := types.Labels{"app": "web", "env": "prod"}
+	for _, labels := range []types.Labels{api, web} {
+		if _, err := writer.AppendDocuments(ctx, StreamID(labels), 1, labels, iterTestDocuments(types.Document{"msg": "a", "ts": int64(1)})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	matches, err := reader.MatchStreams(ctx, types.Labels{"app": "api"})
+	if err != nil || !slices.Equal(matches, []uint64{StreamID(api)}) {
+		t.Errorf("MatchStreams(app=api) = %v, %v", matches, err)
+	}
+	all := []uint64{StreamID(api), StreamID(web)}
+	slices.Sort(all)
+	if matches, err := reader.MatchStreams(ctx, types.Labels{"env": "prod"}); err != nil || !slices.Equal(matches, all) {
+		t.Errorf("MatchStreams(env=prod) = %v, %v, want %v", matches, err, all)
+	}
+
+	// The streams missing from the index are added from their manifests
+	if err := bucket.DeleteObject(ctx, STREAM_INDEX_FILE_NAME, nil); err != nil {
+		t.Fatal(err)
+	}
+	if matches, err := reader.MatchStreams(ctx, types.Labels{}); err != nil || len(matches) != 0 {
+		t.Errorf("MatchStreams() without index = %v, %v", matches, err)
+	}
+	streams, err := reader.ListStreams(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.IndexStreams(ctx, streams); err != nil {
+		t.Fatalf("IndexStreams() error = %v", err)
+	}
+	if matches, err := reader.MatchStreams(ctx, types.Labels{}); err != nil || !slices.Equal(matches, all) {
+		t.Errorf("MatchStreams() after IndexStreams = %v, %v, want %v", matches, err, all)
+	}
+}
@@ -1,13 +1,118 @@
 package stream
 
-import "fmt"
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+)
 
 const STREAM_FILE_PREFIX = "stream/"
 
-func dataFileName(streamID uint64, fileID uint64) string {
-	return fmt.Sprintf("%s%d/%d.data", STREAM_FILE_PREFIX, streamID, fileID)
+// StreamID returns the ID of the stream identified by the given labels, which is a hash of
+// the sorted label pairs.
+func StreamID(labels types.Labels) uint64 {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	// Keys and values are separated by a zero byte, which can't appear in a valid label,
+	// so that different label sets don't produce the same input
+	hash := fnv.New64a()
+	for _, key := range keys {
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write([]byte(labels[key]))
+		hash.Write([]byte{0})
+	}
+
+	return hash.Sum64()
+}
+
+// Archive identifies an archive of a stream. The archives are stored under the directory of their stream,
+// with a name that encodes the fields of the Archive so that they can be enumerated with a single listing:
+//
+//	stream/<stream ID>/<level>-<min timestamp>-<max timestamp>-<file ID>.data
+//
+// The numbers are zero-padded, so the archives are listed ordered by level and then by timestamp.
+// FileID makes the name unique, and is chosen by the writer of the archive.
+type Archive struct {
+	StreamID     uint64 `json:"-"`
+	Level        int    `json:"level"`
+	MinTimestamp int64  `json:"min_ts"`
+	MaxTimestamp int64  `json:"max_ts"`
+	FileID       uint64 `json:"file_id"`
+}
+
+const DATA_FILE_EXTENSION = ".data"
+const METADATA_FILE_EXTENSION = ".metadata"
+
+func streamDirectory(streamID uint64) string {
+	return fmt.Sprintf("%s%d/", STREAM_FILE_PREFIX, streamID)
+}
+
+func (a Archive) name() string {
+	return fmt.Sprintf("%s%02d-%019d-%019d-%016x", streamDirectory(a.StreamID), a.Level, a.MinTimestamp, a.MaxTimestamp, a.FileID)
 }
 
-func metadataFileName(streamID uint64, fileID uint64) string {
-	return fmt.Sprintf("%s%d/%d.metadata", STREAM_FILE_PREFIX, streamID, fileID)
+// String returns the name of the archive, without the file extension.
+func (a Archive) String() string {
+	return a.name()
+}
+
+func (a Archive) dataFileName() string {
+	return a.name() + DATA_FILE_EXTENSION
+}
+
+func (a Archive) metadataFileName() string {
+	return a.name() + METADATA_FILE_EXTENSION
+}
+
+// ParseArchive parses the name of an archive file of the stream, without the extension.
+func ParseArchive(streamID uint64, name string) (Archive, bool) {
+	name, ok := strings.CutPrefix(name, streamDirectory(streamID))
+	if !ok {
+		return Archive{}, false
+	}
+
+	parts := strings.Split(name, "-")
+	if len(parts) != 4 {
+		return Archive{}, false
+	}
+
+	level, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Archive{}, false
+	}
+	minTimestamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Archive{}, false
+	}
+	maxTimestamp, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return Archive{}, false
+	}
+	fileID, err := strconv.ParseUint(parts[3], 16, 64)
+	if err != nil {
+		return Archive{}, false
+	}
+
+	archive := Archive{
+		StreamID:     streamID,
+		Level:        level,
+		MinTimestamp: minTimestamp,
+		MaxTimestamp: maxTimestamp,
+		FileID:       fileID,
+	}
+	// Only the canonical name is accepted, so that each archive has a single name
+	if archive.name() != streamDirectory(streamID)+name {
+		return Archive{}, false
+	}
+
+	return archive, true
 }
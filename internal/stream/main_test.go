@@ -0,0 +1,87 @@
+package stream
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+	"github.com/ZaninAndrea/microdot/pkg/containers"
+)
+
+func TestArchiveName(t *testing.T) {
+	archive := Archive{StreamID: 42, Level: 1, MinTimestamp: 100, MaxTimestamp: 2_000, FileID: 0xabc}
+	name := archive.name()
+	if expected := "stream/42/01-0000000000000000100-0000000000000002000-0000000000000abc"; name != expected {
+		t.Errorf("name() = %s, want %s", name, expected)
+	}
+
+	if parsed, ok := ParseArchive(42, name); !ok || parsed != archive {
+		t.Errorf("ParseArchive() = %v, %v, want %v", parsed, ok, archive)
+	}
+	for _, invalid := range []string{
+		"stream/43/01-0000000000000000100-0000000000000002000-0000000000000abc",
+		"stream/42/1-100-2000-abc",
+		"stream/42/0",
+	} {
+		if parsed, ok := ParseArchive(42, invalid); ok {
+			t.Errorf("ParseArchive(%s) = %v, want an error", invalid, parsed)
+		}
+	}
+}
+
+func iterTestDocuments(documents ...types.Document) func(func(containers.Result[types.Document]) bool) {
+	return func(yield func(containers.Result[types.Document]) bool) {
+		for _, doc := range documents {
+			if !yield(containers.Ok(doc)) {
+				return
+			}
+		}
+	}
+}
+
+func TestListArchives(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := NewWriter(bucket)
+	labels := types.Labels{"app": "test"}
+	streamID := StreamID(labels)
+
+	// Appending to the same stream creates a new archive each time
+	later, err := writer.AppendDocuments(ctx, streamID, 1, labels, iterTestDocuments(
+		types.Document{"msg": "c", "ts": int64(30)},
+		types.Document{"msg": "d", "ts": int64(40)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	earlier, err := writer.AppendDocuments(ctx, streamID, 2, labels, iterTestDocuments(
+		types.Document{"msg": "b", "ts": int64(20)},
+		types.Document{"msg": "a", "ts": int64(10)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if earlier.MinTimestamp != 10 || earlier.MaxTimestamp != 20 {
+		t.Errorf("unexpected timestamp range %d-%d", earlier.MinTimestamp, earlier.MaxTimestamp)
+	}
+
+	// An archive without the metadata file is still being uploaded
+	incomplete := Archive{StreamID: streamID, MinTimestamp: 50, MaxTimestamp: 60, FileID: 3}
+	if err := bucket.PutObject(ctx, incomplete.dataFileName(), strings.NewReader(""), false); err != nil {
+		t.Fatal(err)
+	}
+
+	archives, err := NewReader(bucket).ListArchives(ctx, streamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []Archive{earlier, later}; !slices.Equal(archives, expected) {
+		t.Errorf("ListArchives() = %v, want %v", archives, expected)
+	}
+}
@@ -0,0 +1,242 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/pkg/backoff"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+// Each stream has a manifest listing its live archives, which is the only source of truth for the readers:
+// an archive is added to the stream when it's published in the manifest, not when its files are uploaded.
+// The manifest is updated with a compare-and-swap on its etag, so concurrent writers never lose updates.
+const MANIFEST_FILE_NAME = "manifest.json"
+
+var MANIFEST_MIN_BACKOFF = 20 * time.Millisecond
+var MANIFEST_MAX_BACKOFF = 2 * time.Second
+
+var ErrArchiveNotLive = fmt.Errorf("the archive is not live in the stream manifest")
+var ErrArchiveDeleting = fmt.Errorf("the archive is being deleted by the garbage collector")
+
+type Manifest struct {
+	// Labels are the labels of the stream, they are set when the first archive is published
+	Labels   types.Labels    `json:"labels,omitempty"`
+	Archives []ManifestEntry `json:"archives"`
+	// TruncatedBefore is the timestamp before which the documents of the stream have been deleted. The
+	// documents may still be in the WAL or in archives that haven't been rewritten yet, so the readers
+	// must filter them out.
+	TruncatedBefore int64 `json:"truncated_before,omitempty"`
+	// Garbage contains the archives that have been removed from the stream, or that have never been
+	// published, which are deleted by the garbage collector after a grace period.
+	Garbage []GarbageEntry `json:"garbage,omitempty"`
+}
+
+// ManifestEntry is a live archive of the stream.
+type ManifestEntry struct {
+	Archive
+	Rows uint64 `json:"rows"`
+	// Size is the total size in bytes of the data and metadata files
+	Size uint64 `json:"size"`
+}
+
+type GarbageEntry struct {
+	Archive
+	Since time.Time `json:"since"`
+	// Replaced is set if the archive was live and its documents have been moved to other archives, e.g. by
+	// a compaction. Publishing it again is a no-op, otherwise a retried append would duplicate its documents.
+	Replaced bool `json:"replaced,omitempty"`
+	// Deleting is set once the garbage collector started deleting the files, from then on the archive
+	// can't be published again until the deletion is complete.
+	Deleting bool `json:"deleting,omitempty"`
+}
+
+func manifestFileName(streamID uint64) string {
+	return streamDirectory(streamID) + MANIFEST_FILE_NAME
+}
+
+// isLive reports whether the archive is listed in the live archives of the manifest.
+func (m *Manifest) isLive(a Archive) bool {
+	return slices.ContainsFunc(m.Archives, func(entry ManifestEntry) bool {
+		return entry.Archive == a
+	})
+}
+
+// isPublished reports whether the archive is live or has been live and then replaced.
+func (m *Manifest) isPublished(a Archive) bool {
+	i := m.garbageIndex(a)
+	return m.isLive(a) || (i >= 0 && m.Garbage[i].Replaced)
+}
+
+// garbageIndex returns the index of the archive in the garbage of the manifest, or -1.
+func (m *Manifest) garbageIndex(a Archive) int {
+	return slices.IndexFunc(m.Garbage, func(entry GarbageEntry) bool {
+		return entry.Archive == a
+	})
+}
+
+// loadManifest reads the manifest of the stream and its etag. If the stream has no manifest yet, an empty
+// manifest and an empty etag are returned.
+func loadManifest(ctx context.Context, bucket blob.Bucket, streamID uint64) (Manifest, string, error) {
+	reader, etag, err := bucket.GetObject(ctx, manifestFileName(streamID))
+	if errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+		return Manifest{Archives: []ManifestEntry{}}, "", nil
+	}
+	if err != nil {
+		return Manifest{}, "", err
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return Manifest{}, "", err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return Manifest{}, "", fmt.Errorf("invalid manifest of stream %d: %w", streamID, err)
+	}
+	for i := range manifest.Archives {
+		manifest.Archives[i].StreamID = streamID
+	}
+	for i := range manifest.Garbage {
+		manifest.Garbage[i].StreamID = streamID
+	}
+
+	return manifest, etag, nil
+}
+
+// updateJSONObject applies the update to the latest version of the JSON object stored at the key, as returned
+// by load together with its etag, and stores it with a compare-and-swap on the etag, retrying if the object
+// is changed concurrently. An empty etag means that the object doesn't exist yet.
+// The update returns false if the object doesn't need to be changed, and may be called multiple times.
+func updateJSONObject[T any](
+	ctx context.Context,
+	bucket blob.Bucket,
+	key string,
+	load func() (T, string, error),
+	update func(*T) (bool, error),
+) error {
+	bo := backoff.NewExponential(MANIFEST_MIN_BACKOFF, MANIFEST_MAX_BACKOFF)
+
+	for {
+		object, etag, err := load()
+		if err != nil {
+			return err
+		}
+
+		changed, err := update(&object)
+		if err != nil || !changed {
+			return err
+		}
+
+		content, err := json.Marshal(object)
+		if err != nil {
+			return err
+		}
+		if etag == "" {
+			err = bucket.PutObject(ctx, key, bytes.NewReader(content), false)
+		} else {
+			err = bucket.PutObjectIfMatch(ctx, key, bytes.NewReader(content), etag)
+		}
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, blob.ETAG_CHANGED_ERROR) && !errors.Is(err, blob.OBJECT_ALREADY_EXISTS_ERROR) {
+			return err
+		}
+
+		// The object has been changed concurrently
+		if err := bo.Wait(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// updateManifest applies the update to the latest version of the manifest and stores it, retrying if the
+// manifest is changed concurrently. The update returns false if the manifest doesn't need to be changed,
+// and may be called multiple times.
+func updateManifest(ctx context.Context, bucket blob.Bucket, streamID uint64, update func(*Manifest) (bool, error)) error {
+	load := func() (Manifest, string, error) {
+		return loadManifest(ctx, bucket, streamID)
+	}
+
+	return updateJSONObject(ctx, bucket, manifestFileName(streamID), load, func(manifest *Manifest) (bool, error) {
+		changed, err := update(manifest)
+		if err != nil || !changed {
+			return changed, err
+		}
+
+		// The archives are kept in the same order of their names
+		slices.SortFunc(manifest.Archives, func(a, b ManifestEntry) int {
+			return strings.Compare(a.name(), b.name())
+		})
+		return true, nil
+	})
+}
+
+// publishArchives atomically adds the archives to the live archives of the stream and moves the removed
+// ones to the garbage. All the removed archives must be live, otherwise ErrArchiveNotLive is returned
+// and the manifest is left unchanged.
+// Publishing an archive that is already published is a no-op, so that publishing can be retried.
+// The labels of the stream are stored in the manifest if it doesn't contain them yet.
+func publishArchives(
+	ctx context.Context,
+	bucket blob.Bucket,
+	streamID uint64,
+	labels types.Labels,
+	added []ManifestEntry,
+	removed []Archive,
+) error {
+	return updateManifest(ctx, bucket, streamID, func(manifest *Manifest) (bool, error) {
+		now := time.Now().UTC()
+
+		for _, a := range removed {
+			if !manifest.isLive(a) {
+				return false, fmt.Errorf("%w: %s", ErrArchiveNotLive, a.name())
+			}
+		}
+
+		changed := false
+		if len(manifest.Labels) == 0 && len(labels) > 0 {
+			manifest.Labels = labels
+			changed = true
+		}
+
+		for _, entry := range added {
+			if manifest.isPublished(entry.Archive) {
+				continue
+			}
+
+			// An archive that was marked as garbage before being published is rescued, unless its files
+			// may have already been deleted
+			if i := manifest.garbageIndex(entry.Archive); i >= 0 {
+				if manifest.Garbage[i].Deleting {
+					return false, fmt.Errorf("%w: %s", ErrArchiveDeleting, entry.name())
+				}
+				manifest.Garbage = slices.Delete(manifest.Garbage, i, i+1)
+			}
+
+			manifest.Archives = append(manifest.Archives, entry)
+			changed = true
+		}
+
+		for _, a := range removed {
+			manifest.Archives = slices.DeleteFunc(manifest.Archives, func(entry ManifestEntry) bool {
+				return entry.Archive == a
+			})
+			manifest.Garbage = append(manifest.Garbage, GarbageEntry{Archive: a, Since: now, Replaced: true})
+			changed = true
+		}
+
+		return changed, nil
+	})
+}
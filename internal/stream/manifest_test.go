@@ -0,0 +1,155 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+func TestPublishArchives(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := ManifestEntry{Archive: Archive{StreamID: 1, MinTimestamp: 10, MaxTimestamp: 20, FileID: 1}, Rows: 2}
+	second := ManifestEntry{Archive: Archive{StreamID: 1, Level: 1, MinTimestamp: 10, MaxTimestamp: 20, FileID: 2}, Rows: 2}
+
+	// Publishing is idempotent
+	for range 2 {
+		if err := publishArchives(ctx, bucket, 1, nil, []ManifestEntry{first}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Replacing an archive moves it to the garbage
+	if err := publishArchives(ctx, bucket, 1, nil, []ManifestEntry{second}, []Archive{first.Archive}); err != nil {
+		t.Fatal(err)
+	}
+	manifest, _, err := loadManifest(ctx, bucket, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(manifest.Archives, []ManifestEntry{second}) {
+		t.Errorf("Archives = %v, want %v", manifest.Archives, []ManifestEntry{second})
+	}
+	if len(manifest.Garbage) != 1 || manifest.Garbage[0].Archive != first.Archive {
+		t.Errorf("Garbage = %v, want %v", manifest.Garbage, first.Archive)
+	}
+
+	// Only live archives can be removed
+	err = publishArchives(ctx, bucket, 1, nil, nil, []Archive{first.Archive})
+	if !errors.Is(err, ErrArchiveNotLive) {
+		t.Errorf("publishArchives() error = %v, want %v", err, ErrArchiveNotLive)
+	}
+}
+
+func TestConcurrentManifestUpdates(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Go(func() {
+			entry := ManifestEntry{Archive: Archive{StreamID: 1, FileID: uint64(i)}}
+			if err := publishArchives(ctx, bucket, 1, nil, []ManifestEntry{entry}, nil); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+
+	manifest, _, err := loadManifest(ctx, bucket, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Archives) != 10 {
+		t.Errorf("the manifest contains %d archives, want 10", len(manifest.Archives))
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := NewWriter(bucket)
+	labels := types.Labels{"app": "test"}
+	streamID := StreamID(labels)
+
+	live, err := writer.AppendDocuments(ctx, streamID, 1, labels, iterTestDocuments(
+		types.Document{"msg": "a", "ts": int64(10)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An archive left behind by a crashed writer
+	orphan := Archive{StreamID: streamID, MinTimestamp: 50, MaxTimestamp: 60, FileID: 2}
+	if err := bucket.PutObject(ctx, orphan.dataFileName(), strings.NewReader(""), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The orphan is marked as garbage, but it's deleted only after the grace period
+	now := time.Now()
+	if err := writer.CollectGarbage(ctx, streamID, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := bucket.GetObject(ctx, orphan.dataFileName()); err != nil {
+		t.Errorf("the orphan archive was deleted before the grace period: %v", err)
+	}
+
+	if err := writer.CollectGarbage(ctx, streamID, now.Add(GC_GRACE_PERIOD)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := bucket.GetObject(ctx, orphan.dataFileName()); !errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+		t.Errorf("GetObject() error = %v, want %v", err, blob.NO_SUCH_KEY_ERROR)
+	}
+	if _, _, err := bucket.GetObject(ctx, live.dataFileName()); err != nil {
+		t.Errorf("the live archive was deleted: %v", err)
+	}
+
+	manifest, _, err := loadManifest(ctx, bucket, streamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Garbage) != 0 {
+		t.Errorf("Garbage = %v, want it empty", manifest.Garbage)
+	}
+	if !manifest.isLive(live) {
+		t.Errorf("the archive %v is not live anymore", live)
+	}
+}
+
+func TestPublishDeletingArchive(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := Archive{StreamID: 1, FileID: 1}
+
+	err = updateManifest(ctx, bucket, 1, func(manifest *Manifest) (bool, error) {
+		manifest.Garbage = append(manifest.Garbage, GarbageEntry{Archive: a, Since: time.Now(), Deleting: true})
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = publishArchives(ctx, bucket, 1, nil, []ManifestEntry{{Archive: a}}, nil)
+	if !errors.Is(err, ErrArchiveDeleting) {
+		t.Errorf("publishArchives() error = %v, want %v", err, ErrArchiveDeleting)
+	}
+}
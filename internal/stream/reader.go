@@ -3,6 +3,7 @@ package stream
 import (
 	"context"
 	"iter"
+	"maps"
 	"slices"
 
 	"github.com/ZaninAndrea/microdot/internal/archive"
@@ -26,60 +27,233 @@ type FindResult struct {
 	Document types.Document
 }
 
-func (r *Reader) IterDocuments(ctx context.Context, streamID uint64, ids []uint64) iter.Seq[containers.Result[FindResult]] {
-	metadataFile, err := r.bucket.GetObject(ctx, metadataFileName(streamID, 0))
+// LoadManifest returns the manifest of the stream, which is empty if the stream doesn't exist.
+func (r *Reader) LoadManifest(ctx context.Context, streamID uint64) (Manifest, error) {
+	manifest, _, err := loadManifest(ctx, r.bucket, streamID)
+	return manifest, err
+}
+
+// ListArchives returns the live archives of the stream, ordered by level and then by timestamp.
+func (r *Reader) ListArchives(ctx context.Context, streamID uint64) ([]Archive, error) {
+	manifest, err := r.LoadManifest(ctx, streamID)
 	if err != nil {
-		return func(yield func(containers.Result[FindResult]) bool) {
+		return nil, err
+	}
+
+	archives := make([]Archive, len(manifest.Archives))
+	for i, entry := range manifest.Archives {
+		archives[i] = entry.Archive
+	}
+	return archives, nil
+}
+
+// ScanDocuments returns all the documents in the live archives of the stream. The documents written before
+// the IDs were assigned have ID 0.
+func (r *Reader) ScanDocuments(ctx context.Context, streamID uint64) iter.Seq[containers.Result[FindResult]] {
+	return func(yield func(containers.Result[FindResult]) bool) {
+		manifest, err := r.LoadManifest(ctx, streamID)
+		if err != nil {
 			yield(containers.Err[FindResult](err))
+			return
+		}
+
+		for _, entry := range manifest.Archives {
+			if !r.scanArchive(ctx, entry.Archive, manifest.TruncatedBefore, yield) {
+				return
+			}
 		}
 	}
+}
 
-	reader, err := archive.NewReader(dataFileName(streamID, 0), metadataFile)
+// scanArchive yields the documents of the archive that haven't been truncated, it returns false if the
+// iteration was stopped.
+func (r *Reader) scanArchive(ctx context.Context, a Archive, truncatedBefore int64, yield func(containers.Result[FindResult]) bool) bool {
+	reader, err := openArchive(ctx, r.bucket, a)
 	if err != nil {
-		return nil, err
+		yield(containers.Err[FindResult](err))
+		return false
+	}
+	defer reader.Close()
+
+	columns := reader.Columns()
+	for row := range reader.Rows() {
+		if err := ctx.Err(); err != nil {
+			yield(containers.Err[FindResult](err))
+			return false
+		}
+		if row.IsErr() {
+			yield(containers.Err[FindResult](row.Error()))
+			return false
+		}
+
+		result := FindResult{Document: rowDocument(columns, row.Value)}
+		if id, ok := result.Document["_id"].(int64); ok {
+			result.ID = uint64(id)
+		}
+		if IsTruncated(result.Document, truncatedBefore) {
+			continue
+		}
+
+		if !yield(containers.Ok(result)) {
+			return false
+		}
 	}
 
-	idColumnIdx := slices.IndexFunc(reader.Columns(), func(col archive.ColumnDef) bool {
-		return col.Key == "_id"
-	})
+	return true
+}
 
+// FindDocuments looks up the documents with the given IDs in all the live archives of the stream.
+// The documents are returned in the order they are found, and the archives aren't read anymore once all
+// the IDs have been found.
+func (r *Reader) FindDocuments(ctx context.Context, streamID uint64, ids []uint64) iter.Seq[containers.Result[FindResult]] {
 	return func(yield func(containers.Result[FindResult]) bool) {
-		if d.idColumnIdx < 0 {
+		manifest, err := r.LoadManifest(ctx, streamID)
+		if err != nil {
+			yield(containers.Err[FindResult](err))
 			return
 		}
 
-		columns := d.reader.Columns()
-		for row := range d.reader.Rows() {
-			if row.IsErr() {
-				if !yield(containers.Err[FindResult](row.Error())) {
+		// A document may be in multiple archives while they are being compacted
+		missing := make(map[uint64]bool, len(ids))
+		for _, id := range ids {
+			missing[id] = true
+		}
+		for _, entry := range manifest.Archives {
+			if len(missing) == 0 {
+				return
+			}
+
+			for result := range r.IterDocuments(ctx, entry.Archive, slices.Collect(maps.Keys(missing))) {
+				if result.IsOk() {
+					if !missing[result.Value.ID] {
+						continue
+					}
+					delete(missing, result.Value.ID)
+					if IsTruncated(result.Value.Document, manifest.TruncatedBefore) {
+						continue
+					}
+				}
+
+				if !yield(result) {
+					return
+				}
+				if result.IsErr() {
 					return
 				}
-				continue
 			}
+		}
+	}
+}
 
-			idAny := row.Value[d.idColumnIdx]
-			idInt, ok := idAny.(int64)
-			if !ok {
-				continue
+// IterDocuments returns the documents of the archive with the given IDs. Only the _id column of each
+// block is fetched, the other columns are fetched only for the blocks containing some of the documents.
+func (r *Reader) IterDocuments(ctx context.Context, a Archive, ids []uint64) iter.Seq[containers.Result[FindResult]] {
+	return func(yield func(containers.Result[FindResult]) bool) {
+		reader, err := openArchiveRange(ctx, r.bucket, a)
+		if err != nil {
+			yield(containers.Err[FindResult](err))
+			return
+		}
+		defer reader.Close()
+
+		columns := reader.Columns()
+		idColumnIdx := slices.IndexFunc(columns, func(col archive.ColumnDef) bool {
+			return col.Key == "_id"
+		})
+		if idColumnIdx < 0 {
+			return
+		}
+		allColumns := make([]int, len(columns))
+		for i := range columns {
+			allColumns[i] = i
+		}
+		wanted := make(map[uint64]struct{}, len(ids))
+		for _, id := range ids {
+			wanted[id] = struct{}{}
+		}
+
+		for block := range reader.BlockCount() {
+			if err := ctx.Err(); err != nil {
+				yield(containers.Err[FindResult](err))
+				return
 			}
 
-			id := uint64(idInt)
-			if !slices.Contains(ids, id) {
+			blockIDs, err := reader.ReadColumns(block, []int{idColumnIdx})
+			if err != nil {
+				yield(containers.Err[FindResult](err))
+				return
+			}
+			matches := []int{}
+			for row, id := range blockIDs[0] {
+				id, ok := id.(int64)
+				if !ok {
+					continue
+				}
+				if _, ok := wanted[uint64(id)]; ok {
+					matches = append(matches, row)
+				}
+			}
+			if len(matches) == 0 {
 				continue
 			}
 
-			document := make(map[string]any, len(columns))
-			for i, col := range columns {
-				document[col.Key] = row.Value[i]
+			values, err := reader.ReadColumns(block, allColumns)
+			if err != nil {
+				yield(containers.Err[FindResult](err))
+				return
 			}
+			for _, row := range matches {
+				document := make(types.Document, len(columns))
+				for i, col := range columns {
+					if values[i][row] != nil {
+						document[col.Key] = values[i][row]
+					}
+				}
 
-			if !yield(containers.Ok(FindResult{ID: id, Document: document})) {
-				return
+				id := uint64(blockIDs[0][row].(int64))
+				if !yield(containers.Ok(FindResult{ID: id, Document: document})) {
+					return
+				}
 			}
 		}
 	}
 }
 
-func (d *diskStream) Close() error {
-	return d.reader.Close()
+// rowDocument converts a row of the archive to a document, omitting the missing values.
+func rowDocument(columns []archive.ColumnDef, row archive.Row) types.Document {
+	document := make(types.Document, len(columns))
+	for i, col := range columns {
+		if row[i] != nil {
+			document[col.Key] = row[i]
+		}
+	}
+
+	return document
+}
+
+// openArchive opens a reader on the files of the archive, which streams the data file sequentially.
+func openArchive(ctx context.Context, bucket blob.Bucket, a Archive) (*archive.Reader, error) {
+	metadataFile, _, err := bucket.GetObject(ctx, a.metadataFileName())
+	if err != nil {
+		return nil, err
+	}
+	dataFile, _, err := bucket.GetObject(ctx, a.dataFileName())
+	if err != nil {
+		metadataFile.Close()
+		return nil, err
+	}
+
+	reader, err := archive.NewReader(dataFile, metadataFile)
+	if err != nil {
+		dataFile.Close()
+		metadataFile.Close()
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// openArchiveRange opens a reader on the archive that fetches only the needed ranges of the data file.
+func openArchiveRange(ctx context.Context, bucket blob.Bucket, a Archive) (*archive.Reader, error) {
+	return archive.NewBucketReader(ctx, bucket, a.dataFileName(), a.metadataFileName())
 }
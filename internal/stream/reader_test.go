@@ -0,0 +1,92 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ZaninAndrea/microdot/internal/archive"
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+// countingBucket counts the reads of the data files of the archives.
+type countingBucket struct {
+	*blob.DiskBucket
+	dataReads  atomic.Int64
+	rangeReads atomic.Int64
+}
+
+func (b *countingBucket) GetObject(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	if strings.HasSuffix(key, DATA_FILE_EXTENSION) {
+		b.dataReads.Add(1)
+	}
+	return b.DiskBucket.GetObject(ctx, key)
+}
+
+func (b *countingBucket) GetObjectRange(ctx context.Context, key string, start, end int) (io.ReadCloser, error) {
+	b.rangeReads.Add(1)
+	return b.DiskBucket.GetObjectRange(ctx, key, start, end)
+}
+
+func TestFindDocuments(t *testing.T) {
+	ctx := context.Background()
+	diskBucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := &countingBucket{DiskBucket: diskBucket}
+	writer := NewWriter(bucket)
+	labels := types.Labels{"app": "test"}
+	streamID := StreamID(labels)
+
+	// The first archive has multiple blocks
+	documents := []types.Document{}
+	for i := range 2*archive.BLOCK_SIZE + 500 {
+		documents = append(documents, types.Document{"_id": int64(i + 1), "ts": int64(i), "msg": fmt.Sprintf("doc %d", i+1)})
+	}
+	if _, err := writer.AppendDocuments(ctx, streamID, 1, labels, iterTestDocuments(documents...)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.AppendDocuments(ctx, streamID, 2, labels, iterTestDocuments(
+		types.Document{"_id": int64(10_001), "ts": int64(10_000), "msg": "other"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket.dataReads.Store(0)
+	bucket.rangeReads.Store(0)
+
+	results := []FindResult{}
+	for result := range NewReader(bucket).FindDocuments(ctx, streamID, []uint64{5, 2400, 10_001, 99_999}) {
+		if result.IsErr() {
+			t.Fatal(result.Error())
+		}
+		results = append(results, result.Value)
+	}
+	slices.SortFunc(results, func(a, b FindResult) int {
+		return int(a.ID) - int(b.ID)
+	})
+	expected := []FindResult{
+		{ID: 5, Document: types.Document{"_id": int64(5), "msg": "doc 5", "ts": int64(4)}},
+		{ID: 2400, Document: types.Document{"_id": int64(2400), "msg": "doc 2400", "ts": int64(2399)}},
+		{ID: 10_001, Document: types.Document{"_id": int64(10_001), "msg": "other", "ts": int64(10_000)}},
+	}
+	if fmt.Sprint(results) != fmt.Sprint(expected) {
+		t.Errorf("FindDocuments() = %v, want %v", results, expected)
+	}
+
+	// The data files are never downloaded, for each block the IDs are read and then the whole block
+	// only if it contains some of the documents
+	if reads := bucket.dataReads.Load(); reads != 0 {
+		t.Errorf("the data files were downloaded %d times", reads)
+	}
+	if reads := bucket.rangeReads.Load(); reads != 5+2 {
+		t.Errorf("the data files were read with %d ranges, want 7", reads)
+	}
+}
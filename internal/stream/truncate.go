@@ -0,0 +1,172 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"slices"
+
+	"github.com/ZaninAndrea/microdot/internal/archive"
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/pkg/containers"
+)
+
+// IsTruncated reports whether the document has a timestamp before the truncation point of its stream.
+// Documents without a timestamp are counted as having timestamp 0.
+func IsTruncated(document types.Document, truncatedBefore int64) bool {
+	ts, _ := toInt64(document["ts"])
+	return ts < truncatedBefore
+}
+
+// Truncate deletes the documents of the stream with a timestamp before the given one, in milliseconds since
+// the Unix epoch, and returns the IDs of the deleted documents. The archives containing only older documents
+// are removed from the manifest, while the ones straddling the truncation point are rewritten.
+//
+// The truncation point is stored in the manifest first, so that the documents are hidden from the readers
+// and are not appended again by the WAL shard jobs. Truncating can be safely retried.
+func (w *Writer) Truncate(ctx context.Context, streamID uint64, before int64) ([]uint64, error) {
+	err := updateManifest(ctx, w.bucket, streamID, func(manifest *Manifest) (bool, error) {
+		if manifest.TruncatedBefore >= before {
+			return false, nil
+		}
+
+		manifest.TruncatedBefore = before
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := []uint64{}
+	for {
+		manifest, _, err := loadManifest(ctx, w.bucket, streamID)
+		if err != nil {
+			return nil, err
+		}
+
+		done := true
+		for _, entry := range manifest.Archives {
+			if entry.MinTimestamp >= before {
+				continue
+			}
+
+			ids, err := w.truncateArchive(ctx, entry.Archive, before)
+			if errors.Is(err, ErrArchiveNotLive) {
+				// The archive has been compacted concurrently, the manifest is loaded again
+				done = false
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			deleted = append(deleted, ids...)
+		}
+
+		if done {
+			return deleted, nil
+		}
+	}
+}
+
+// truncateArchive replaces the archive with one containing only its documents with a timestamp at or after
+// before, and returns the IDs of the deleted documents. The new archive keeps the level and the file ID of
+// the original one, so that a retried WAL shard job appending the same documents doesn't duplicate them.
+func (w *Writer) truncateArchive(ctx context.Context, a Archive, before int64) ([]uint64, error) {
+	reader, err := openArchive(ctx, w.bucket, a)
+	if err != nil {
+		return nil, err
+	}
+	columns := reader.Columns()
+	labels := reader.Labels()
+	tsIdx, idIdx := columnIndex(columns, "ts"), columnIndex(columns, "_id")
+
+	// Find the deleted documents and the timestamp range of the kept ones
+	deleted := []uint64{}
+	kept := Archive{StreamID: a.StreamID, Level: a.Level, FileID: a.FileID}
+	keptRows := 0
+	for row := range reader.Rows() {
+		if row.IsErr() {
+			reader.Close()
+			return nil, row.Error()
+		}
+
+		ts := rowTimestamp(row.Value, tsIdx)
+		if ts < before {
+			if id, ok := rowID(row.Value, idIdx); ok {
+				deleted = append(deleted, id)
+			}
+			continue
+		}
+
+		if keptRows == 0 || ts < kept.MinTimestamp {
+			kept.MinTimestamp = ts
+		}
+		kept.MaxTimestamp = max(kept.MaxTimestamp, ts)
+		keptRows++
+	}
+	if err := reader.Close(); err != nil {
+		return nil, err
+	}
+
+	if keptRows == 0 {
+		return deleted, publishArchives(ctx, w.bucket, a.StreamID, nil, nil, []Archive{a})
+	}
+
+	blockSize := archive.BLOCK_SIZE
+	if a.Level > 0 {
+		blockSize = COMPACTED_BLOCK_SIZE
+	}
+	rows := w.truncatedRows(ctx, a, tsIdx, before)
+	return deleted, w.storeArchive(ctx, kept, columns, labels, rows, blockSize, []Archive{a})
+}
+
+// truncatedRows returns the rows of the archive with a timestamp at or after before. Each iteration reads
+// the archive again.
+func (w *Writer) truncatedRows(ctx context.Context, a Archive, tsIdx int, before int64) iter.Seq[containers.Result[archive.Row]] {
+	return func(yield func(containers.Result[archive.Row]) bool) {
+		reader, err := openArchive(ctx, w.bucket, a)
+		if err != nil {
+			yield(containers.Err[archive.Row](err))
+			return
+		}
+		defer reader.Close()
+
+		for row := range reader.Rows() {
+			if row.IsErr() {
+				yield(row)
+				return
+			}
+			if rowTimestamp(row.Value, tsIdx) < before {
+				continue
+			}
+			if !yield(row) {
+				return
+			}
+		}
+	}
+}
+
+func columnIndex(columns []archive.ColumnDef, key string) int {
+	return slices.IndexFunc(columns, func(col archive.ColumnDef) bool {
+		return col.Key == key
+	})
+}
+
+// rowTimestamp returns the ts column of the row, or 0 if the archive has no ts column.
+func rowTimestamp(row archive.Row, tsIdx int) int64 {
+	if tsIdx < 0 {
+		return 0
+	}
+
+	ts, _ := toInt64(row[tsIdx])
+	return ts
+}
+
+func rowID(row archive.Row, idIdx int) (uint64, bool) {
+	if idIdx < 0 {
+		return 0, false
+	}
+
+	id, ok := row[idIdx].(int64)
+	return uint64(id), ok
+}
@@ -0,0 +1,103 @@
+package stream
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+func TestTruncate(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := NewWriter(bucket)
+	reader := NewReader(bucket)
+	labels := types.Labels{"app": "test"}
+	streamID := StreamID(labels)
+
+	old, err := writer.AppendDocuments(ctx, streamID, 1, labels, iterTestDocuments(
+		types.Document{"_id": int64(1), "msg": "a", "ts": int64(10)},
+		types.Document{"_id": int64(2), "msg": "b", "ts": int64(20)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	straddling, err := writer.AppendDocuments(ctx, streamID, 2, labels, iterTestDocuments(
+		types.Document{"_id": int64(3), "msg": "c", "ts": int64(30)},
+		types.Document{"_id": int64(4), "msg": "d", "ts": int64(50)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent, err := writer.AppendDocuments(ctx, streamID, 3, labels, iterTestDocuments(
+		types.Document{"_id": int64(5), "msg": "e", "ts": int64(60)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := writer.Truncate(ctx, streamID, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(deleted)
+	if !slices.Equal(deleted, []uint64{1, 2, 3}) {
+		t.Errorf("Truncate() = %v, want [1 2 3]", deleted)
+	}
+
+	// The old archive is dropped and the straddling one is rewritten with the same file ID
+	rewritten := Archive{StreamID: streamID, MinTimestamp: 50, MaxTimestamp: 50, FileID: straddling.FileID}
+	live, err := reader.ListArchives(ctx, streamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []Archive{rewritten, recent}; !slices.Equal(live, expected) {
+		t.Errorf("ListArchives() = %v, want %v", live, expected)
+	}
+	manifest, err := reader.LoadManifest(ctx, streamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.TruncatedBefore != 40 || manifest.garbageIndex(old) < 0 || manifest.garbageIndex(straddling) < 0 {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+
+	// Truncating again at an earlier time is a no-op
+	if deleted, err := writer.Truncate(ctx, streamID, 20); err != nil || len(deleted) != 0 {
+		t.Errorf("Truncate() = %v, %v, want no deleted documents", deleted, err)
+	}
+
+	// The documents appended after the truncation are filtered
+	appended, err := writer.AppendDocuments(ctx, streamID, 4, labels, iterTestDocuments(
+		types.Document{"_id": int64(6), "msg": "f", "ts": int64(35)},
+		types.Document{"_id": int64(7), "msg": "g", "ts": int64(70)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appended.MinTimestamp != 70 {
+		t.Errorf("AppendDocuments() = %v, want the documents before the truncation to be skipped", appended)
+	}
+	if a, err := writer.AppendDocuments(ctx, streamID, 5, labels, iterTestDocuments(
+		types.Document{"_id": int64(8), "msg": "h", "ts": int64(5)},
+	)); err != nil || a != (Archive{}) {
+		t.Errorf("AppendDocuments() = %v, %v, want no archive", a, err)
+	}
+
+	ids := []uint64{}
+	for result := range reader.ScanDocuments(ctx, streamID) {
+		if result.IsErr() {
+			t.Fatal(result.Error())
+		}
+		ids = append(ids, result.Value.ID)
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, []uint64{4, 5, 7}) {
+		t.Errorf("ScanDocuments() = %v, want [4 5 7]", ids)
+	}
+}
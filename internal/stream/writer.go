@@ -2,11 +2,14 @@ package stream
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"iter"
 	"maps"
 	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/ZaninAndrea/microdot/internal/archive"
 	"github.com/ZaninAndrea/microdot/internal/db/types"
@@ -25,61 +28,267 @@ func NewWriter(bucket blob.Bucket) *Writer {
 	}
 }
 
-// AppendDocuments appends the given documents to the stream.
-// The provided documents iterator should be safe to consume multiple times.
+// AppendDocuments writes the given documents to a new level 0 archive of the stream, identified by fileID,
+// publishes it in the stream manifest and returns it. The provided documents iterator should be safe to
+// consume multiple times. The rows of the archive are sorted by ts and _id.
+//
+// The archive content is deterministic, so writing again the same documents with the same fileID is a
+// no-op: this allows retrying a failed append without duplicating the data.
+// The documents before the truncation point of the stream are discarded, if all of them are discarded no
+// archive is written and the zero Archive is returned.
 func (w *Writer) AppendDocuments(
 	ctx context.Context,
 	streamID uint64,
+	fileID uint64,
 	labels types.Labels,
 	documents iter.Seq[containers.Result[types.Document]],
-) error {
+) (Archive, error) {
+	manifest, _, err := loadManifest(ctx, w.bucket, streamID)
+	if err != nil {
+		return Archive{}, err
+	}
+	if manifest.TruncatedBefore > 0 {
+		documents = skipTruncated(documents, manifest.TruncatedBefore)
+		empty := true
+		for range documents {
+			empty = false
+			break
+		}
+		if empty {
+			return Archive{}, nil
+		}
+	}
+
+	minTimestamp, maxTimestamp, err := timestampRange(documents)
+	if err != nil {
+		return Archive{}, err
+	}
+
 	// Extract the column definitions
 	columns, rows, err := consolidateData(documents)
 	if err != nil {
+		return Archive{}, err
+	}
+
+	a := Archive{
+		StreamID:     streamID,
+		Level:        0,
+		MinTimestamp: minTimestamp,
+		MaxTimestamp: maxTimestamp,
+		FileID:       fileID,
+	}
+	if manifest.isPublished(a) {
+		// A previous attempt already published the archive
+		return a, nil
+	}
+
+	// The stream is indexed before its first archive is published, so that the queries can find it
+	if len(manifest.Labels) == 0 {
+		if err := indexStreams(ctx, w.bucket, map[uint64]types.Labels{streamID: labels}); err != nil {
+			return Archive{}, err
+		}
+	}
+
+	// The rows are sorted like the compacted archives, so that the compactions can stream all their sources
+	rows, err = sortRows(columns, rows)
+	if err != nil {
+		return Archive{}, err
+	}
+
+	if err := w.storeArchive(ctx, a, columns, labels, rows, archive.BLOCK_SIZE, nil); err != nil {
+		return Archive{}, err
+	}
+
+	return a, nil
+}
+
+// skipTruncated filters out the documents before the truncation point.
+func skipTruncated(documents iter.Seq[containers.Result[types.Document]], truncatedBefore int64) iter.Seq[containers.Result[types.Document]] {
+	return func(yield func(containers.Result[types.Document]) bool) {
+		for doc := range documents {
+			if doc.IsOk() && IsTruncated(doc.Value, truncatedBefore) {
+				continue
+			}
+			if !yield(doc) {
+				return
+			}
+		}
+	}
+}
+
+// storeArchive uploads the archive and publishes it in the stream manifest, replacing the removed archives.
+// The rows iterator may be consumed multiple times.
+func (w *Writer) storeArchive(
+	ctx context.Context,
+	a Archive,
+	columns []archive.ColumnDef,
+	labels types.Labels,
+	rows iter.Seq[containers.Result[archive.Row]],
+	blockSize int,
+	removed []Archive,
+) error {
+	entry, err := w.putArchive(ctx, a, columns, labels, rows, blockSize)
+	if err != nil {
+		return err
+	}
+	if err := publishArchives(ctx, w.bucket, a.StreamID, labels, []ManifestEntry{entry}, removed); err != nil {
 		return err
 	}
 
+	// If the upload found the files of a previous attempt, they may have been deleted by the garbage
+	// collector before the archive was published. Once published the files are never collected, so
+	// uploading them again is safe.
+	complete, err := w.archiveExists(ctx, a)
+	if err != nil {
+		return err
+	}
+	if !complete {
+		if _, err := w.putArchive(ctx, a, columns, labels, rows, blockSize); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// putArchive uploads the data and metadata files of the archive, and returns its manifest entry.
+func (w *Writer) putArchive(
+	ctx context.Context,
+	a Archive,
+	columns []archive.ColumnDef,
+	labels types.Labels,
+	rows iter.Seq[containers.Result[archive.Row]],
+	blockSize int,
+) (ManifestEntry, error) {
 	// Pipe the data to blob storage
-	var dataReader, metadataReader io.ReadCloser
-	var dataWriter, metadataWriter io.WriteCloser
-	dataReader, dataWriter = io.Pipe()
-	metadataReader, metadataWriter = io.Pipe()
+	dataReader, dataWriter := io.Pipe()
+	metadataReader, metadataWriter := io.Pipe()
 
 	eg, uploadContext := errgroup.WithContext(ctx)
 	eg.Go(func() error {
-		return w.bucket.PutObject(uploadContext, dataFileName(streamID, 0), dataReader, false) // TODO: use a proper file naming scheme to avoid collisions
+		return w.putObject(uploadContext, a.dataFileName(), dataReader)
 	})
 	eg.Go(func() error {
-		return w.bucket.PutObject(uploadContext, metadataFileName(streamID, 0), metadataReader, false) // TODO: use a proper file naming scheme to avoid collisions
+		return w.putObject(uploadContext, a.metadataFileName(), metadataReader)
 	})
 
 	// Stream the data in archive format to the pipe
-	writer, err := archive.NewWriter(
+	data := &countingWriter{WriteCloser: dataWriter}
+	metadata := &countingWriter{WriteCloser: metadataWriter}
+	rowCount, err := writeArchive(columns, labels, rows, blockSize, data, metadata)
+	dataWriter.CloseWithError(err)
+	metadataWriter.CloseWithError(err)
+
+	// Wait for the uploads to complete
+	if uploadErr := eg.Wait(); uploadErr != nil {
+		return ManifestEntry{}, uploadErr
+	}
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+
+	return ManifestEntry{Archive: a, Rows: rowCount, Size: data.written + metadata.written}, nil
+}
+
+// archiveExists reports whether both the files of the archive exist.
+func (w *Writer) archiveExists(ctx context.Context, a Archive) (bool, error) {
+	for _, key := range []string{a.dataFileName(), a.metadataFileName()} {
+		reader, _, err := w.bucket.GetObject(ctx, key)
+		if errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		reader.Close()
+	}
+
+	return true, nil
+}
+
+// timestampRange returns the minimum and maximum ts of the documents. Timestamps before the Unix epoch are
+// counted as 0, since they can't be represented in the archive names.
+func timestampRange(documents iter.Seq[containers.Result[types.Document]]) (int64, int64, error) {
+	var minTimestamp, maxTimestamp int64
+	found := false
+	for doc := range documents {
+		if doc.IsErr() {
+			return 0, 0, doc.Error()
+		}
+
+		ts, ok := toInt64(doc.Value["ts"])
+		if !ok {
+			continue
+		}
+		ts = max(ts, 0)
+
+		if !found {
+			minTimestamp, maxTimestamp, found = ts, ts, true
+			continue
+		}
+		minTimestamp = min(minTimestamp, ts)
+		maxTimestamp = max(maxTimestamp, ts)
+	}
+
+	return minTimestamp, maxTimestamp, nil
+}
+
+// putObject uploads the object if it doesn't exist yet, the content is always fully consumed so that
+// the archive writer doesn't block.
+func (w *Writer) putObject(ctx context.Context, key string, content *io.PipeReader) error {
+	err := w.bucket.PutObject(ctx, key, content, false)
+	if errors.Is(err, blob.OBJECT_ALREADY_EXISTS_ERROR) {
+		_, err = io.Copy(io.Discard, content)
+	}
+
+	content.CloseWithError(err)
+	return err
+}
+
+// writeArchive writes the rows in archive format and returns the number of rows written.
+func writeArchive(
+	columns []archive.ColumnDef,
+	labels types.Labels,
+	rows iter.Seq[containers.Result[archive.Row]],
+	blockSize int,
+	dataWriter, metadataWriter io.WriteCloser,
+) (uint64, error) {
+	writer, err := archive.NewWriterWithBlockSize(
 		columns,
 		labels,
 		dataWriter,
 		metadataWriter,
+		blockSize,
 	)
 	if err != nil {
-		return err
+		return 0, err
 	}
+
+	count := uint64(0)
 	for row := range rows {
 		if row.IsErr() {
-			return row.Error()
+			return 0, row.Error()
 		}
 
 		if err := writer.Write([]archive.Row{row.Value}); err != nil {
-			return err
+			return 0, err
 		}
+		count++
 	}
 
-	err = writer.Close()
-	if err != nil {
-		return err
-	}
+	return count, writer.Close()
+}
 
-	// Wait for the uploads to complete
-	return eg.Wait()
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	io.WriteCloser
+	written uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.WriteCloser.Write(p)
+	c.written += uint64(n)
+	return n, err
 }
 
 // ConsolidateData reads all entries from the documents stream, infers the column definitions, and
@@ -100,9 +309,9 @@ func consolidateData(documents iter.Seq[containers.Result[types.Document]]) ([]a
 				continue
 			}
 
-			row := archive.Row{}
-			for _, col := range columns {
-				row = append(row, doc.Value[col.Key])
+			row := make(archive.Row, len(columns))
+			for i, col := range columns {
+				row[i] = castValue(doc.Value[col.Key], col.Type)
 			}
 
 			if !yield(containers.Ok(row)) {
@@ -114,6 +323,26 @@ func consolidateData(documents iter.Seq[containers.Result[types.Document]]) ([]a
 	return columns, rowIter, nil
 }
 
+// sortRows reads all the rows and returns them ordered by their ts column and then by their _id column.
+func sortRows(columns []archive.ColumnDef, rows iter.Seq[containers.Result[archive.Row]]) (iter.Seq[containers.Result[archive.Row]], error) {
+	sorted := []archive.Row{}
+	for row := range rows {
+		if row.IsErr() {
+			return nil, row.Error()
+		}
+		sorted = append(sorted, row.Value)
+	}
+	slices.SortStableFunc(sorted, rowOrder(columns))
+
+	return func(yield func(containers.Result[archive.Row]) bool) {
+		for _, row := range sorted {
+			if !yield(containers.Ok(row)) {
+				return
+			}
+		}
+	}, nil
+}
+
 func inferColumns(documents iter.Seq[containers.Result[types.Document]]) ([]archive.ColumnDef, error) {
 	columns := make(map[string]archive.ColumnDef)
 	for doc := range documents {
@@ -148,7 +377,79 @@ func inferColumns(documents iter.Seq[containers.Result[types.Document]]) ([]arch
 		}
 	}
 
-	return slices.Collect(maps.Values(columns)), nil
+	// Sort the columns so that the archive content doesn't depend on the map iteration order
+	return slices.SortedFunc(maps.Values(columns), func(a, b archive.ColumnDef) int {
+		return strings.Compare(a.Key, b.Key)
+	}), nil
+}
+
+// castValue converts a document value to the type of its column, which may be wider than the value type.
+// Missing values and values that can't be converted are kept as nil instead of being zero-filled.
+func castValue(value any, columnType archive.ColumnType) any {
+	if value == nil {
+		return nil
+	}
+
+	switch columnType {
+	case archive.ColumnTypeInt64:
+		if i, ok := toInt64(value); ok {
+			return i
+		}
+		return nil
+	case archive.ColumnTypeFloat64:
+		if f, ok := value.(float64); ok {
+			return f
+		}
+		if i, ok := toInt64(value); ok {
+			return float64(i)
+		}
+		return nil
+	case archive.ColumnTypeBool:
+		if b, ok := value.(bool); ok {
+			return b
+		}
+		return nil
+	default:
+		switch v := value.(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'g', -1, 64)
+		case bool:
+			return strconv.FormatBool(v)
+		}
+		if i, ok := toInt64(value); ok {
+			return strconv.FormatInt(i, 10)
+		}
+		return fmt.Sprint(value)
+	}
+}
+
+func toInt64(value any) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	}
+
+	return 0, false
 }
 
 var superTypes = map[archive.ColumnType][]archive.ColumnType{
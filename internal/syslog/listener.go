@@ -0,0 +1,246 @@
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db"
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+)
+
+var (
+	// MAX_BATCH_SIZE is the maximum number of messages written to the WAL with a single call.
+	MAX_BATCH_SIZE = 1000
+	// MAX_MESSAGE_SIZE is the maximum size in bytes of a single syslog message.
+	MAX_MESSAGE_SIZE = 64 * 1024
+	// MAX_OCTET_COUNT_DIGITS is the maximum number of digits of the length prefix of an octet-counted message.
+	MAX_OCTET_COUNT_DIGITS = 10
+	// UDP_BATCH_DELAY is the maximum time UDP messages are buffered before being written to the WAL.
+	UDP_BATCH_DELAY = 100 * time.Millisecond
+	// MAX_UDP_INFLIGHT_BATCHES is the maximum number of UDP batches waiting for the WAL flush,
+	// once reached the listener stops reading datagrams.
+	MAX_UDP_INFLIGHT_BATCHES = 8
+)
+
+// Listener receives syslog messages over TCP and UDP and writes them to the DB.
+type Listener struct {
+	db *db.DB
+	wg sync.WaitGroup
+}
+
+func NewListener(database *db.DB) *Listener {
+	return &Listener{
+		db: database,
+	}
+}
+
+// ServeTCP accepts syslog connections on the listener until the context is cancelled.
+// Both octet-counted (RFC 6587) and newline-delimited framings are supported.
+//
+// Each connection is served by reading all the messages that are already available, writing them to the WAL
+// and waiting for the flush before reading again, so that slow flushes apply backpressure to the senders.
+func (l *Listener) ServeTCP(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				l.wg.Wait()
+				return nil
+			}
+			return err
+		}
+
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.serveConn(ctx, conn)
+		}()
+	}
+}
+
+func (l *Listener) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	// Close the connection when the listener is stopped, the messages already read are still flushed
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	reader := bufio.NewReaderSize(conn, MAX_MESSAGE_SIZE)
+	for {
+		// Block until at least one message is available, then take all the buffered ones
+		batch := []types.LabeledDocument{}
+		for len(batch) < MAX_BATCH_SIZE && (len(batch) == 0 || reader.Buffered() > 0) {
+			frame, err := readFrame(reader)
+			if err != nil {
+				if len(batch) > 0 {
+					l.addDocuments(ctx, batch)
+				}
+				if err != io.EOF && !errors.Is(err, net.ErrClosed) && ctx.Err() == nil {
+					log.Printf("syslog: closing connection from %s: %v", conn.RemoteAddr(), err)
+				}
+				return
+			}
+
+			document, err := Parse(frame, time.Now())
+			if err != nil {
+				log.Printf("syslog: dropping message from %s: %v", conn.RemoteAddr(), err)
+				continue
+			}
+			batch = append(batch, document)
+		}
+
+		if !l.addDocuments(ctx, batch) {
+			return
+		}
+	}
+}
+
+// readFrame reads a single message, using octet counting if the frame starts with a digit
+// and newline delimiting otherwise.
+func readFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] >= '0' && first[0] <= '9' {
+		// The prefix is read a byte at a time, so that a sender can't make the buffer grow without a space
+		lengthStr := []byte{}
+		for {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if b == ' ' {
+				break
+			}
+			if b < '0' || b > '9' || len(lengthStr) >= MAX_OCTET_COUNT_DIGITS {
+				return nil, fmt.Errorf("invalid octet count %q", append(lengthStr, b))
+			}
+			lengthStr = append(lengthStr, b)
+		}
+
+		length, err := strconv.Atoi(string(lengthStr))
+		if err != nil || length <= 0 || length > MAX_MESSAGE_SIZE {
+			return nil, fmt.Errorf("invalid octet count %q", lengthStr)
+		}
+
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+
+	frame, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("message exceeds %d bytes", MAX_MESSAGE_SIZE)
+	}
+	if err == io.EOF && len(frame) > 0 {
+		return frame, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// ServeUDP receives syslog datagrams on the connection until the context is cancelled.
+// Each datagram contains a single message. Since UDP has no flow control, the messages are buffered
+// for up to UDP_BATCH_DELAY and written to the WAL asynchronously.
+func (l *Listener) ServeUDP(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	inflight := make(chan struct{}, MAX_UDP_INFLIGHT_BATCHES)
+	var batches sync.WaitGroup
+	defer batches.Wait()
+
+	submit := func(batch []types.LabeledDocument) {
+		if len(batch) == 0 {
+			return
+		}
+
+		inflight <- struct{}{}
+		batches.Go(func() {
+			defer func() { <-inflight }()
+			l.addDocuments(ctx, batch)
+		})
+	}
+
+	buffer := make([]byte, MAX_MESSAGE_SIZE)
+	batch := []types.LabeledDocument{}
+	batchDeadline := time.Now().Add(UDP_BATCH_DELAY)
+	for {
+		conn.SetReadDeadline(batchDeadline)
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				submit(batch)
+				return nil
+			}
+
+			if netErr, ok := errors.AsType[net.Error](err); ok && netErr.Timeout() {
+				submit(batch)
+				batch = []types.LabeledDocument{}
+				batchDeadline = time.Now().Add(UDP_BATCH_DELAY)
+				continue
+			}
+
+			submit(batch)
+			return err
+		}
+
+		document, err := Parse(buffer[:n], time.Now())
+		if err != nil {
+			log.Printf("syslog: dropping message from %s: %v", addr, err)
+			continue
+		}
+
+		batch = append(batch, document)
+		if len(batch) >= MAX_BATCH_SIZE {
+			submit(batch)
+			batch = []types.LabeledDocument{}
+			batchDeadline = time.Now().Add(UDP_BATCH_DELAY)
+		}
+	}
+}
+
+// addDocuments writes the batch to the DB and waits for the WAL flush, it returns false if the
+// documents could not be persisted or the listener has been stopped.
+//
+// Once the listener is stopped the flush is not awaited anymore, the documents already written are
+// flushed when the DB is closed.
+func (l *Listener) addDocuments(ctx context.Context, batch []types.LabeledDocument) bool {
+	docErrors, err := l.db.AddDocuments(ctx, batch)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("syslog: failed to persist %d messages: %v", len(batch), err)
+		}
+		return false
+	}
+
+	for i, docErr := range docErrors {
+		if docErr != nil {
+			log.Printf("syslog: dropping invalid message %v: %v", batch[i].Document, docErr)
+		}
+	}
+
+	return true
+}
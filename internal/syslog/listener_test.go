@@ -0,0 +1,47 @@
+package syslog
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadFrame(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("11 <13>1 first<13>1 second\n"))
+
+	frame, err := readFrame(reader)
+	if err != nil || string(frame) != "<13>1 first" {
+		t.Fatalf("readFrame() = %q, %v, want the octet-counted frame", frame, err)
+	}
+	frame, err = readFrame(reader)
+	if err != nil || string(frame) != "<13>1 second\n" {
+		t.Fatalf("readFrame() = %q, %v, want the newline-delimited frame", frame, err)
+	}
+}
+
+func TestReadFrameLongOctetCount(t *testing.T) {
+	// A prefix without a space is rejected after a few bytes, without buffering the rest of the stream
+	stream := &countingReader{r: strings.NewReader(strings.Repeat("1", 10*MAX_MESSAGE_SIZE))}
+	if _, err := readFrame(bufio.NewReaderSize(stream, 16)); err == nil || err == io.EOF {
+		t.Fatalf("readFrame() returned %v, want an invalid octet count error", err)
+	}
+	if stream.read > 64 {
+		t.Errorf("readFrame() read %d bytes of the prefix", stream.read)
+	}
+
+	if _, err := readFrame(bufio.NewReader(strings.NewReader("99999999 <13>1 too long"))); err == nil {
+		t.Errorf("readFrame() accepted a frame longer than MAX_MESSAGE_SIZE")
+	}
+}
+
+type countingReader struct {
+	r    io.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += n
+	return n, err
+}
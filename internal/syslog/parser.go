@@ -0,0 +1,232 @@
+package syslog
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+)
+
+// Syslog messages are mapped to documents as follows:
+//   - the hostname, app name and facility are stored in the 'hostname', 'app_name' and 'facility' labels
+//   - the message is stored in the 'msg' field and the timestamp in the 'ts' field
+//   - the severity, process id and message id are stored in the 'severity', 'procid' and 'msgid' fields
+//   - each structured data parameter is stored in a field named "<SD-ID>.<PARAM-NAME>"
+//
+// Missing values (NILVALUE in RFC 5424) are omitted, if the timestamp is missing the time of reception is used.
+
+const NIL_VALUE = "-"
+
+var facilityNames = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var severityNames = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+// Parse parses a single syslog message, in either the RFC 5424 or the legacy RFC 3164 format.
+func Parse(message []byte, now time.Time) (types.LabeledDocument, error) {
+	message = bytes.TrimRight(message, "\r\n\x00")
+
+	priority, rest, err := parsePriority(message)
+	if err != nil {
+		return types.LabeledDocument{}, err
+	}
+
+	facility := priority / 8
+	severity := priority % 8
+
+	document := types.LabeledDocument{
+		Labels: types.Labels{"facility": facilityNames[facility]},
+		Document: types.Document{
+			"severity": severityNames[severity],
+		},
+	}
+
+	// RFC 5424 messages have the version right after the priority, which is 1 for the current RFC
+	if len(rest) >= 2 && rest[0] == '1' && rest[1] == ' ' {
+		err = parseRFC5424(string(rest[2:]), document, now)
+	} else {
+		parseRFC3164(string(rest), document, now)
+	}
+	if err != nil {
+		return types.LabeledDocument{}, err
+	}
+
+	if _, ok := document.Document["ts"]; !ok {
+		document.Document["ts"] = now.UnixMilli()
+	}
+
+	return document, nil
+}
+
+// parsePriority parses the <PRI> part at the beginning of the message.
+func parsePriority(message []byte) (int, []byte, error) {
+	if len(message) < 3 || message[0] != '<' {
+		return 0, nil, fmt.Errorf("invalid syslog message: missing priority")
+	}
+
+	end := bytes.IndexByte(message[:min(len(message), 5)], '>')
+	if end < 2 {
+		return 0, nil, fmt.Errorf("invalid syslog message: malformed priority")
+	}
+
+	priority, err := strconv.Atoi(string(message[1:end]))
+	if err != nil || priority < 0 || priority > 191 {
+		return 0, nil, fmt.Errorf("invalid syslog message: priority %q out of range", message[1:end])
+	}
+
+	return priority, message[end+1:], nil
+}
+
+// parseRFC5424 parses the part of a RFC 5424 message following the version:
+// TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA [SP MSG]
+func parseRFC5424(s string, document types.LabeledDocument, now time.Time) error {
+	header := make([]string, 5)
+	for i := range header {
+		field, rest, ok := strings.Cut(s, " ")
+		if !ok && i < len(header)-1 {
+			return fmt.Errorf("invalid RFC 5424 message: truncated header")
+		}
+		header[i] = field
+		s = rest
+	}
+
+	timestamp, hostname, appName, procID, msgID := header[0], header[1], header[2], header[3], header[4]
+	if timestamp != NIL_VALUE {
+		ts, err := time.Parse(time.RFC3339Nano, timestamp)
+		if err != nil {
+			return fmt.Errorf("invalid RFC 5424 timestamp %q: %w", timestamp, err)
+		}
+		document.Document["ts"] = ts.UnixMilli()
+	}
+	if hostname != NIL_VALUE {
+		document.Labels["hostname"] = hostname
+	}
+	if appName != NIL_VALUE {
+		document.Labels["app_name"] = appName
+	}
+	if procID != NIL_VALUE {
+		document.Document["procid"] = procID
+	}
+	if msgID != NIL_VALUE {
+		document.Document["msgid"] = msgID
+	}
+
+	rest, err := parseStructuredData(s, document.Document)
+	if err != nil {
+		return err
+	}
+
+	// The message may be prefixed by a UTF-8 byte order mark
+	rest = strings.TrimPrefix(rest, " ")
+	rest = strings.TrimPrefix(rest, "\ufeff")
+	document.Document["msg"] = rest
+
+	return nil
+}
+
+// parseStructuredData parses the STRUCTURED-DATA part of a RFC 5424 message, storing the parameters
+// in the document, and returns the remaining part of the message.
+func parseStructuredData(s string, doc types.Document) (string, error) {
+	if strings.HasPrefix(s, NIL_VALUE) {
+		return s[len(NIL_VALUE):], nil
+	}
+
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+
+		// Read the SD-ID
+		end := strings.IndexAny(s, " ]")
+		if end <= 0 {
+			return "", fmt.Errorf("invalid RFC 5424 structured data: missing SD-ID")
+		}
+		id := s[:end]
+		s = s[end:]
+
+		// Read the parameters until the end of the element
+		for {
+			s = strings.TrimLeft(s, " ")
+			if strings.HasPrefix(s, "]") {
+				s = s[1:]
+				break
+			}
+
+			eq := strings.Index(s, "=\"")
+			if eq <= 0 {
+				return "", fmt.Errorf("invalid RFC 5424 structured data: malformed parameter in %q", id)
+			}
+			name := s[:eq]
+			s = s[eq+2:]
+
+			// The value is terminated by an unescaped '"', the characters '"', '\' and ']' can be escaped
+			var value strings.Builder
+			closed := false
+			for i := 0; i < len(s); i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+					value.WriteByte(s[i+1])
+					i++
+				} else if s[i] == '"' {
+					s = s[i+1:]
+					closed = true
+					break
+				} else {
+					value.WriteByte(s[i])
+				}
+			}
+			if !closed {
+				return "", fmt.Errorf("invalid RFC 5424 structured data: unterminated value for %q", name)
+			}
+
+			doc[id+"."+name] = value.String()
+		}
+	}
+
+	if s != "" && s[0] != ' ' {
+		return "", fmt.Errorf("invalid RFC 5424 message: expected structured data")
+	}
+
+	return s, nil
+}
+
+// parseRFC3164 parses the part of a BSD syslog message following the priority:
+// TIMESTAMP SP HOSTNAME SP TAG[PID]: MSG
+// Since the format is loosely specified, the parts that can't be recognized are kept in the message.
+func parseRFC3164(s string, document types.LabeledDocument, now time.Time) {
+	// The timestamp has the fixed-length format "Mmm dd hh:mm:ss" and doesn't contain the year
+	if len(s) >= 16 && s[15] == ' ' {
+		if ts, err := time.ParseInLocation(time.Stamp, s[:15], now.Location()); err == nil {
+			ts = ts.AddDate(now.Year(), 0, 0)
+			// Messages from the end of the previous year received at the beginning of the new one
+			if ts.After(now.Add(24 * time.Hour)) {
+				ts = ts.AddDate(-1, 0, 0)
+			}
+			document.Document["ts"] = ts.UnixMilli()
+			s = s[16:]
+
+			if hostname, rest, ok := strings.Cut(s, " "); ok && hostname != "" {
+				document.Labels["hostname"] = hostname
+				s = rest
+			}
+		}
+	}
+
+	// The tag is made of alphanumeric characters, optionally followed by the pid in square brackets
+	if colon := strings.Index(s, ": "); colon > 0 && !strings.ContainsAny(s[:colon], " \t") {
+		tag := s[:colon]
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			document.Document["procid"] = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+		document.Labels["app_name"] = tag
+		s = s[colon+2:]
+	}
+
+	document.Document["msg"] = s
+}
@@ -0,0 +1,94 @@
+package syslog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2024, time.January, 2, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name           string
+		message        string
+		expectedLabels map[string]string
+		expectedDoc    map[string]any
+	}{
+		{
+			name:           "RFC 5424 with structured data",
+			message:        `<165>1 2023-11-14T22:13:20.5Z host1 app 1234 ID47 [exampleSDID@32473 iut="3" eventSource="Appli\]cation"] An application event` + "\n",
+			expectedLabels: map[string]string{"facility": "local4", "hostname": "host1", "app_name": "app"},
+			expectedDoc: map[string]any{
+				"ts":                            int64(1700000000500),
+				"msg":                           "An application event",
+				"severity":                      "notice",
+				"procid":                        "1234",
+				"msgid":                         "ID47",
+				"exampleSDID@32473.iut":         "3",
+				"exampleSDID@32473.eventSource": "Appli]cation",
+			},
+		},
+		{
+			name:           "RFC 5424 with nil values",
+			message:        "<14>1 - - - - - - \ufeffhello",
+			expectedLabels: map[string]string{"facility": "user"},
+			expectedDoc: map[string]any{
+				"ts":       now.UnixMilli(),
+				"msg":      "hello",
+				"severity": "info",
+			},
+		},
+		{
+			name:           "RFC 3164",
+			message:        "<34>Oct 11 22:14:15 mymachine su[42]: 'su root' failed",
+			expectedLabels: map[string]string{"facility": "auth", "hostname": "mymachine", "app_name": "su"},
+			expectedDoc: map[string]any{
+				"ts":       time.Date(2023, time.October, 11, 22, 14, 15, 0, time.UTC).UnixMilli(),
+				"msg":      "'su root' failed",
+				"severity": "crit",
+				"procid":   "42",
+			},
+		},
+		{
+			name:           "RFC 3164 without header",
+			message:        "<13>just a message",
+			expectedLabels: map[string]string{"facility": "user"},
+			expectedDoc: map[string]any{
+				"ts":       now.UnixMilli(),
+				"msg":      "just a message",
+				"severity": "notice",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			document, err := Parse([]byte(tt.message), now)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !reflect.DeepEqual(map[string]string(document.Labels), tt.expectedLabels) {
+				t.Errorf("labels = %v, want %v", document.Labels, tt.expectedLabels)
+			}
+			if !reflect.DeepEqual(map[string]any(document.Document), tt.expectedDoc) {
+				t.Errorf("document = %v, want %v", document.Document, tt.expectedDoc)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	messages := []string{
+		"no priority",
+		"<192>1 - - - - - -",
+		"<14>1 2023-11-14 host app - - - msg",
+		`<14>1 - - - - - [id a="unterminated] msg`,
+	}
+
+	for _, message := range messages {
+		if _, err := Parse([]byte(message), time.Now()); err == nil {
+			t.Errorf("Parse(%q) expected an error", message)
+		}
+	}
+}
@@ -108,3 +108,44 @@ func TestIndex_Persistence(t *testing.T) {
 		}
 	}
 }
+
+func TestIndex_Purge(t *testing.T) {
+	baseFolder := t.TempDir()
+
+	idx, err := NewIndex(baseFolder)
+	if err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	defer idx.Close()
+
+	// The first documents are flushed to disk, the last one stays in memory
+	for docID, content := range []string{"hello world", "hello universe", "hello peace"} {
+		if err := idx.Add(1, int64(docID+1), content); err != nil {
+			t.Fatalf("Failed to add document: %v", err)
+		}
+		if docID == 1 {
+			if err := idx.Flush(); err != nil {
+				t.Fatalf("Failed to flush index: %v", err)
+			}
+		}
+	}
+	if err := idx.Add(2, 1, "hello again"); err != nil {
+		t.Fatalf("Failed to add document: %v", err)
+	}
+
+	if err := idx.Purge(DocumentFilter(1, []uint64{1, 3})); err != nil {
+		t.Fatalf("Purge failed: %v", err)
+	}
+
+	postings, err := idx.Search("hello")
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	found := make(map[[2]int64]bool)
+	for _, p := range postings {
+		found[[2]int64{p.StreamID, p.DocumentID}] = true
+	}
+	if len(found) != 2 || !found[[2]int64{1, 2}] || !found[[2]int64{2, 1}] {
+		t.Errorf("Unexpected postings after purge: %v", postings)
+	}
+}
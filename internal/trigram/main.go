@@ -3,7 +3,10 @@ package trigram
 import (
 	"fmt"
 	"os"
+	"path"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ZaninAndrea/microdot/pkg/cache"
@@ -19,8 +22,10 @@ type Posting struct {
 	Position   int64
 }
 
-// Index is a trigram index implemented as an LSM tree.
+// Index is a trigram index implemented as an LSM tree. It's safe for concurrent use.
 type Index struct {
+	mu sync.Mutex
+
 	mem        *memoryIndex
 	memEntries int
 
@@ -31,6 +36,11 @@ type Index struct {
 
 const INDEX_CACHE_SIZE = 1000
 
+// Queries shorter than a trigram can't be searched in the index
+const MIN_QUERY_LENGTH = 3
+
+var ErrQueryTooShort = fmt.Errorf("the query must be at least %d bytes long", MIN_QUERY_LENGTH)
+
 func NewIndex(baseFolder string) (*Index, error) {
 	// Read the list of files ending in .data.bin in the base folder to initialize diskEntries
 	var diskEntries []string
@@ -62,6 +72,9 @@ func NewIndex(baseFolder string) (*Index, error) {
 }
 
 func (i *Index) Add(streamID, documentID int64, content string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
 	i.mem.Add(streamID, documentID, content)
 	i.memEntries++
 
@@ -75,6 +88,14 @@ func (i *Index) Add(streamID, documentID int64, content string) error {
 	return nil
 }
 
+// Flush writes the documents added to the index to disk.
+func (i *Index) Flush() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.flushMemIndex()
+}
+
 func (i *Index) flushMemIndex() error {
 	if i.memEntries == 0 {
 		return nil
@@ -93,7 +114,16 @@ func (i *Index) flushMemIndex() error {
 	return nil
 }
 
+// Search returns the postings of the documents containing the query, which must be at least
+// MIN_QUERY_LENGTH bytes long.
 func (i *Index) Search(query string) ([]Posting, error) {
+	if len(query) < MIN_QUERY_LENGTH {
+		return nil, ErrQueryTooShort
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
 	var postings []Posting
 	if i.memEntries > 0 {
 		memPostings, err := search(query, i.mem)
@@ -120,6 +150,81 @@ func (i *Index) Search(query string) ([]Posting, error) {
 	return postings, nil
 }
 
+// Purge removes from the index the postings of the documents for which remove returns true. The files
+// containing some of the documents are rewritten, so purging is expensive and should be done in bulk.
+func (i *Index) Purge(remove func(streamID, documentID int64) bool) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	purgeMemoryIndex(i.mem, remove)
+
+	diskEntries := make([]string, 0, len(i.diskEntries))
+	for _, name := range i.diskEntries {
+		diskIndex, err := i.disks.Get(name)
+		if err != nil {
+			return err
+		}
+		mem, err := diskIndex.LoadAll()
+		if err != nil {
+			return err
+		}
+		if !purgeMemoryIndex(mem, remove) {
+			diskEntries = append(diskEntries, name)
+			continue
+		}
+
+		// The purged index is written to a new file before deleting the old one, so that a crash
+		// doesn't lose the other postings
+		purgedName := fmt.Sprintf("%d", time.Now().UnixNano())
+		if err := writeToDiskFS(mem, i.baseFolder, purgedName); err != nil {
+			return err
+		}
+		i.disks.Remove(name)
+		for _, extension := range []string{".data.bin", ".metadata.bin"} {
+			if err := os.Remove(path.Join(i.baseFolder, name+extension)); err != nil {
+				return err
+			}
+		}
+		diskEntries = append(diskEntries, purgedName)
+	}
+
+	i.diskEntries = diskEntries
+	return nil
+}
+
+// DocumentFilter returns a Purge filter matching the given documents of the stream.
+func DocumentFilter(streamID uint64, documentIDs []uint64) func(streamID, documentID int64) bool {
+	ids := make(map[int64]bool, len(documentIDs))
+	for _, id := range documentIDs {
+		ids[int64(id)] = true
+	}
+
+	return func(postingStream, postingDocument int64) bool {
+		return postingStream == int64(streamID) && ids[postingDocument]
+	}
+}
+
+// purgeMemoryIndex removes the postings of the documents from the index, it returns whether any was removed.
+func purgeMemoryIndex(mem *memoryIndex, remove func(streamID, documentID int64) bool) bool {
+	purged := false
+	for trigram, postings := range mem.postingList {
+		kept := slices.DeleteFunc(postings, func(p Posting) bool {
+			return remove(p.StreamID, p.DocumentID)
+		})
+		if len(kept) != len(postings) {
+			purged = true
+		}
+
+		if len(kept) == 0 {
+			delete(mem.postingList, trigram)
+		} else {
+			mem.postingList[trigram] = kept
+		}
+	}
+
+	return purged
+}
+
 func (i *Index) Close() error {
-	return i.flushMemIndex()
+	return i.Flush()
 }
@@ -0,0 +1,235 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+// WAL files are merged in groups of COMPACTION_FAN_IN consecutive files of the same level, the merged
+// file has the next level. Files of level MAX_COMPACTION_LEVEL are not compacted further, so with
+// the default settings a compacted file contains up to 100 flushed files (~100MB).
+var COMPACTION_FAN_IN = 10
+var MAX_COMPACTION_LEVEL = 2
+
+// Compaction merges the Sources WAL files into the Target file.
+type Compaction struct {
+	Sources []string
+	Target  string
+}
+
+type Compactor struct {
+	bucket blob.Bucket
+	// Corrupted sources are quarantined, otherwise their compaction would keep failing
+	reader *Reader
+}
+
+func NewCompactor(bucket blob.Bucket) *Compactor {
+	return &Compactor{
+		bucket: bucket,
+		reader: NewReader(bucket, CORRUPTION_QUARANTINE),
+	}
+}
+
+// Plan returns the compactions of the WAL files that are currently eligible for merging.
+// Planning is side-effect free, so the same compaction may be planned multiple times: conflicts are
+// resolved when the compactions are executed.
+func (c *Compactor) Plan(ctx context.Context) ([]Compaction, error) {
+	keys, err := listKeys(ctx, c.bucket, WAL_FILE_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	locks, err := listLocks(ctx, c.bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group consecutive files of the same level, a file that is already claimed breaks the sequence
+	groups := make(map[int][]string)
+	compactions := []Compaction{}
+	for _, key := range keys {
+		level, ok := walFileLevel(key)
+		if !ok || level >= MAX_COMPACTION_LEVEL {
+			continue
+		}
+		if _, locked := locks[key]; locked {
+			groups[level] = nil
+			continue
+		}
+
+		groups[level] = append(groups[level], key)
+		if len(groups[level]) == COMPACTION_FAN_IN {
+			compactions = append(compactions, Compaction{
+				Sources: groups[level],
+				Target:  compactionTarget(groups[level][0], level+1),
+			})
+			groups[level] = nil
+		}
+	}
+
+	return compactions, nil
+}
+
+// Compact executes the compaction, it can be safely retried after a failure or a crash at any point.
+// If some of the sources are claimed by a different compaction the execution is abandoned and nil is
+// returned, since the sources will be compacted by the other one.
+func (c *Compactor) Compact(ctx context.Context, compaction Compaction) error {
+	for i, source := range compaction.Sources {
+		claimed, err := ClaimFile(ctx, c.bucket, source, compaction.Target)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return ReleaseFiles(ctx, c.bucket, compaction.Sources[:i], compaction.Target)
+		}
+	}
+
+	// The target is written atomically, so if it exists a previous execution has already merged all the sources
+	exists, err := objectExists(ctx, c.bucket, compaction.Target)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		// The sources may have been consumed by somebody else, e.g. if the compaction
+		// was abandoned and its sources were claimed again
+		for _, source := range compaction.Sources {
+			exists, err := objectExists(ctx, c.bucket, source)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return ReleaseFiles(ctx, c.bucket, compaction.Sources, compaction.Target)
+			}
+		}
+
+		// The reader is closed after the upload, so that the encoder stops and releases the sources even if
+		// the upload returned without reading all of it, e.g. because the target already exists
+		content := c.concatSources(ctx, compaction.Sources)
+		err := c.bucket.PutObject(ctx, compaction.Target, content, false)
+		content.CloseWithError(err)
+		if err != nil && !errors.Is(err, blob.OBJECT_ALREADY_EXISTS_ERROR) {
+			return err
+		}
+	}
+
+	return ConsumeFiles(ctx, c.bucket, compaction.Sources)
+}
+
+// concatSources returns a reader streaming the records of the sources one after the other, re-encoded
+// in a single WAL file. Legacy JSON sources are converted to the binary format.
+func (c *Compactor) concatSources(ctx context.Context, sources []string) *io.PipeReader {
+	reader, writer := io.Pipe()
+
+	go func() {
+		encoder := newRecordEncoder(writer)
+		for _, source := range sources {
+			if err := c.copySource(ctx, encoder, source); err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		writer.CloseWithError(encoder.Close())
+	}()
+
+	return reader
+}
+
+func (c *Compactor) copySource(ctx context.Context, encoder *recordEncoder, source string) error {
+	for rec := range c.reader.IterFile(ctx, source) {
+		if rec.IsErr() {
+			return rec.Error()
+		}
+
+		encoded, _, err := encodeRecords([]record{rec.Value})
+		if err != nil {
+			return err
+		}
+		if err := encoder.Write(encoded[0]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compactedSources returns the WAL files that have already been merged into a compaction target
+// in the given set of keys, which are duplicated until the compaction deletes them.
+func compactedSources(ctx context.Context, bucket blob.Bucket, keys map[string]bool) (map[string]bool, error) {
+	locks, err := listLocks(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	compacted := make(map[string]bool)
+	for key, lock := range locks {
+		if keys[key] && keys[lock.Owner] {
+			compacted[key] = true
+		}
+	}
+
+	return compacted, nil
+}
+
+func objectExists(ctx context.Context, bucket blob.Bucket, key string) (bool, error) {
+	reader, _, err := bucket.GetObject(ctx, key)
+	if errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, reader.Close()
+}
+
+// listKeys returns the sorted keys of the objects with the given prefix.
+func listKeys(ctx context.Context, bucket blob.Bucket, prefix string) ([]string, error) {
+	keys := []string{}
+	for obj := range bucket.ListObjects(ctx, prefix) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		keys = append(keys, obj.Value)
+	}
+	slices.Sort(keys)
+
+	return keys, nil
+}
+
+// WAL files written by the Writer are named "<timestamp>_<random>.log", while compacted files are
+// named after their first source with the level added: "<timestamp>_<random>.l<level>.log".
+// This keeps the compacted files sorted by the age of their content.
+func compactionTarget(firstSource string, level int) string {
+	base := strings.TrimSuffix(firstSource, ".log")
+	if dot := strings.LastIndexByte(base, '.'); dot > len(WAL_FILE_PREFIX) {
+		base = base[:dot]
+	}
+
+	return fmt.Sprintf("%s.l%d.log", base, level)
+}
+
+// walFileLevel returns the compaction level of a WAL file, which is 0 for the files written by the Writer.
+func walFileLevel(key string) (int, bool) {
+	name, ok := strings.CutSuffix(strings.TrimPrefix(key, WAL_FILE_PREFIX), ".log")
+	if !ok {
+		return 0, false
+	}
+
+	dot := strings.LastIndexByte(name, '.')
+	if dot < 0 {
+		return 0, true
+	}
+
+	level, err := strconv.Atoi(strings.TrimPrefix(name[dot+1:], "l"))
+	if err != nil || !strings.HasPrefix(name[dot+1:], "l") {
+		return 0, false
+	}
+
+	return level, true
+}
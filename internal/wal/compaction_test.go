@@ -0,0 +1,270 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+// writeWALFiles writes count level 0 WAL files each containing a single record, and returns their keys.
+func writeWALFiles(t *testing.T, bucket blob.Bucket, count int) []string {
+	t.Helper()
+
+	keys := make([]string, count)
+	for i := range count {
+		keys[i] = fmt.Sprintf("%s%019d_%d.log", WAL_FILE_PREFIX, 1_700_000_000_000_000_000+i, i)
+		content := fmt.Sprintf(`{"l":{"app":"test"},"d":{"msg":"hello","ts":%d}}`+"\n", i)
+		if err := bucket.PutObject(context.Background(), keys[i], strings.NewReader(content), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return keys
+}
+
+func readTimestamps(t *testing.T, bucket blob.Bucket) []int64 {
+	t.Helper()
+
+	timestamps := []int64{}
+	for rec := range NewReader(bucket, CORRUPTION_STOP).Iter(context.Background()) {
+		if rec.Err != nil {
+			t.Fatalf("Iter() error = %v", rec.Err)
+		}
+		timestamps = append(timestamps, rec.Value.Data["ts"].(int64))
+	}
+	slices.Sort(timestamps)
+
+	return timestamps
+}
+
+func newTestBucket(t *testing.T) blob.Bucket {
+	t.Helper()
+
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bucket
+}
+
+func TestCompactionPlan(t *testing.T) {
+	bucket := newTestBucket(t)
+	keys := writeWALFiles(t, bucket, 25)
+	compactor := NewCompactor(bucket)
+
+	compactions, err := compactor.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last 5 files don't fill a group
+	if len(compactions) != 2 {
+		t.Fatalf("expected 2 compactions, got %d", len(compactions))
+	}
+	for i, compaction := range compactions {
+		expectedSources := keys[i*COMPACTION_FAN_IN : (i+1)*COMPACTION_FAN_IN]
+		if !slices.Equal(compaction.Sources, expectedSources) {
+			t.Errorf("compaction %d sources = %v, want %v", i, compaction.Sources, expectedSources)
+		}
+		expectedTarget := strings.TrimSuffix(expectedSources[0], ".log") + ".l1.log"
+		if compaction.Target != expectedTarget {
+			t.Errorf("compaction %d target = %s, want %s", i, compaction.Target, expectedTarget)
+		}
+	}
+
+	// Compacting the level 1 files produces a level 2 file, named after the oldest source
+	level1 := []string{}
+	for i := range COMPACTION_FAN_IN {
+		level1 = append(level1, compactionTarget(keys[i], 1))
+	}
+	if target := compactionTarget(level1[0], 2); target != strings.TrimSuffix(keys[0], ".log")+".l2.log" {
+		t.Errorf("unexpected level 2 target %s", target)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	bucket := newTestBucket(t)
+	writeWALFiles(t, bucket, COMPACTION_FAN_IN)
+	compactor := NewCompactor(bucket)
+	expected := readTimestamps(t, bucket)
+
+	compactions, err := compactor.Plan(ctx)
+	if err != nil || len(compactions) != 1 {
+		t.Fatalf("Plan() = %v, %v", compactions, err)
+	}
+	if err := compactor.Compact(ctx, compactions[0]); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+
+	keys, err := listKeys(ctx, bucket, WAL_FILE_PREFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(keys, []string{compactions[0].Target}) {
+		t.Errorf("expected only the compacted file, got %v", keys)
+	}
+	locks, err := listKeys(ctx, bucket, LOCK_PREFIX)
+	if err != nil || len(locks) != 0 {
+		t.Errorf("expected no locks, got %v (%v)", locks, err)
+	}
+	if actual := readTimestamps(t, bucket); !slices.Equal(actual, expected) {
+		t.Errorf("records after compaction = %v, want %v", actual, expected)
+	}
+
+	// Running the compaction again is a no-op
+	if err := compactor.Compact(ctx, compactions[0]); err != nil {
+		t.Fatalf("Compact() retry error = %v", err)
+	}
+	if actual := readTimestamps(t, bucket); !slices.Equal(actual, expected) {
+		t.Errorf("records after retry = %v, want %v", actual, expected)
+	}
+}
+
+func TestCompactResume(t *testing.T) {
+	ctx := context.Background()
+	bucket := newTestBucket(t)
+	writeWALFiles(t, bucket, COMPACTION_FAN_IN)
+	compactor := NewCompactor(bucket)
+	expected := readTimestamps(t, bucket)
+
+	compactions, err := compactor.Plan(ctx)
+	if err != nil || len(compactions) != 1 {
+		t.Fatalf("Plan() = %v, %v", compactions, err)
+	}
+	compaction := compactions[0]
+
+	// Simulate a crash after writing the target and deleting some of the sources
+	for _, source := range compaction.Sources {
+		if claimed, err := ClaimFile(ctx, bucket, source, compaction.Target); err != nil || !claimed {
+			t.Fatalf("ClaimFile() = %v, %v", claimed, err)
+		}
+	}
+	if err := bucket.PutObject(ctx, compaction.Target, compactor.concatSources(ctx, compaction.Sources), false); err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range compaction.Sources[:3] {
+		if err := bucket.DeleteObject(ctx, source, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Readers skip the sources that are still present
+	if actual := readTimestamps(t, bucket); !slices.Equal(actual, expected) {
+		t.Errorf("records during compaction = %v, want %v", actual, expected)
+	}
+
+	// The planner doesn't plan again the claimed sources
+	if planned, err := compactor.Plan(ctx); err != nil || len(planned) != 0 {
+		t.Errorf("Plan() during compaction = %v, %v", planned, err)
+	}
+
+	if err := compactor.Compact(ctx, compaction); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if actual := readTimestamps(t, bucket); !slices.Equal(actual, expected) {
+		t.Errorf("records after compaction = %v, want %v", actual, expected)
+	}
+	if keys, _ := listKeys(ctx, bucket, WAL_FILE_PREFIX); len(keys) != 1 {
+		t.Errorf("expected only the compacted file, got %v", keys)
+	}
+}
+
+func TestCompactConflict(t *testing.T) {
+	ctx := context.Background()
+	bucket := newTestBucket(t)
+	keys := writeWALFiles(t, bucket, COMPACTION_FAN_IN+1)
+	compactor := NewCompactor(bucket)
+	expected := readTimestamps(t, bucket)
+
+	first := Compaction{Sources: keys[:COMPACTION_FAN_IN], Target: compactionTarget(keys[0], 1)}
+	second := Compaction{Sources: keys[1:], Target: compactionTarget(keys[1], 1)}
+
+	// The second compaction claims one of the sources of the first one, which is abandoned
+	if claimed, err := ClaimFile(ctx, bucket, keys[5], second.Target); err != nil || !claimed {
+		t.Fatalf("ClaimFile() = %v, %v", claimed, err)
+	}
+	if err := compactor.Compact(ctx, first); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	locks, err := listKeys(ctx, bucket, LOCK_PREFIX)
+	if err != nil || !slices.Equal(locks, []string{lockKey(keys[5])}) {
+		t.Errorf("expected only the lock of the second compaction, got %v (%v)", locks, err)
+	}
+
+	if err := compactor.Compact(ctx, second); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if actual := readTimestamps(t, bucket); !slices.Equal(actual, expected) {
+		t.Errorf("records after compaction = %v, want %v", actual, expected)
+	}
+	if keys, _ := listKeys(ctx, bucket, WAL_FILE_PREFIX); len(keys) != 2 {
+		t.Errorf("expected the first source and the compacted file, got %v", keys)
+	}
+}
+
+// racingBucket simulates a compaction target written concurrently by another worker: the upload of the
+// target fails without reading the content. It counts the readers of the objects that are still open.
+type racingBucket struct {
+	blob.Bucket
+	target string
+	open   atomic.Int64
+}
+
+func (b *racingBucket) PutObject(ctx context.Context, key string, content io.Reader, replaceExisting bool) error {
+	if key == b.target {
+		// The upload fails once the encoder is blocked on the content, holding the first source open
+		for b.open.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return blob.OBJECT_ALREADY_EXISTS_ERROR
+	}
+	return b.Bucket.PutObject(ctx, key, content, replaceExisting)
+}
+
+func (b *racingBucket) GetObject(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	reader, etag, err := b.Bucket.GetObject(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	b.open.Add(1)
+	return &countedReader{ReadCloser: reader, open: &b.open}, etag, nil
+}
+
+type countedReader struct {
+	io.ReadCloser
+	open *atomic.Int64
+}
+
+func (r *countedReader) Close() error {
+	r.open.Add(-1)
+	return r.ReadCloser.Close()
+}
+
+func TestCompactUnreadTarget(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestBucket(t)
+	keys := writeWALFiles(t, inner, COMPACTION_FAN_IN)
+	compaction := Compaction{Sources: keys, Target: compactionTarget(keys[0], 1)}
+	bucket := &racingBucket{Bucket: inner, target: compaction.Target}
+
+	if err := NewCompactor(bucket).Compact(ctx, compaction); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+
+	// The encoder stops once the content is closed, releasing the source it was reading
+	deadline := time.Now().Add(5 * time.Second)
+	for bucket.open.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d source readers are still open after the compaction", bucket.open.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,661 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"iter"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ZaninAndrea/microdot/internal/archive"
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/internal/stream"
+	"github.com/ZaninAndrea/microdot/pkg/containers"
+	"github.com/pierrec/lz4/v4"
+)
+
+// WAL files are stored in a binary format:
+// - The magic bytes "MWAL"
+// - The format version (uint32)
+// - A sequence of blocks, each framed as:
+// 	- The length of the stored block (uint32)
+// 	- The length of the decompressed block (uint32), equal to the stored length if the block isn't compressed
+// 	- The CRC32C checksum of the decompressed length and of the stored block (uint32)
+// 	- The block, compressed with LZ4 unless compression doesn't reduce its size. It contains a sequence
+// 	  of entries, each made of its length (uvarint) and its content, starting with its kind (uint8):
+// 		- ENTRY_LABELS adds a label set to the dictionary of the file:
+// 			- The index of the label set in the dictionary (uvarint)
+// 			- The stream ID (uint64)
+// 			- The number of labels (uvarint), then for each label:
+// 				- Key (string with length explicitly stated at the beginning)
+// 				- Value (string with length explicitly stated at the beginning)
+// 		- ENTRY_RECORD stores a document:
+// 			- The index of its label set in the dictionary (uvarint)
+// 			- The document ID (uvarint)
+// 			- The number of fields (uvarint), then for each field:
+// 				- Key (string with length explicitly stated at the beginning)
+// 				- Value type (uint8)
+// 				- Value: varint for int64, 8 bytes for float64, a length-prefixed string or a byte for bool
+// 		- ENTRY_TRAILER closes the file:
+// 			- The number of records in the file (uvarint)
+//
+// Each label set is written only once per file, before the first record that uses it.
+// A file without the trailer has been truncated, since the trailer is always the last entry.
+//
+// A block is closed once its entries reach WAL_BLOCK_SIZE bytes. Each block is compressed on its own and its
+// checksum covers the stored bytes, so a corrupted block is detected before decompressing it and is skipped
+// using its length: only the entries of that block are lost, the following blocks can still be read.
+// Label sets carry their index, so the records of the following blocks keep referencing the right label set,
+// while the records whose label set has been lost can't be decoded.
+//
+// Legacy WAL files contain newline-delimited JSON records, and are recognized by the missing magic bytes.
+
+var WAL_MAGIC = []byte("MWAL")
+
+const WAL_FORMAT_VERSION uint32 = 1
+
+const (
+	ENTRY_LABELS  uint8 = 1
+	ENTRY_RECORD  uint8 = 2
+	ENTRY_TRAILER uint8 = 3
+)
+
+const (
+	VALUE_INT64   uint8 = 0
+	VALUE_FLOAT64 uint8 = 1
+	VALUE_STRING  uint8 = 2
+	VALUE_BOOL    uint8 = 3
+)
+
+// WAL_BLOCK_SIZE is the size of the decompressed entries after which a block is closed. Smaller blocks lose
+// fewer records when corrupted, but compress worse.
+var WAL_BLOCK_SIZE = 32 << 10
+
+// MAX_BLOCK_SIZE bounds the length of a block, so that a corrupted length doesn't cause a huge allocation.
+// A block contains up to WAL_BLOCK_SIZE bytes plus the entry that filled it, which can be a large document.
+var MAX_BLOCK_SIZE uint32 = 128 << 20
+
+var CRC32C_TABLE = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrUnsupportedFormatVersion = fmt.Errorf("unsupported WAL format version")
+
+// All the errors caused by the content of a file wrap ErrCorruptedFile, the other errors (e.g. a failed read
+// from the bucket) are returned unchanged.
+var ErrCorruptedFile = fmt.Errorf("corrupted WAL file")
+var ErrInvalidEntry = fmt.Errorf("%w: invalid entry", ErrCorruptedFile)
+var ErrChecksumMismatch = fmt.Errorf("%w: checksum mismatch", ErrCorruptedFile)
+var ErrTruncatedFile = fmt.Errorf("%w: truncated file", ErrCorruptedFile)
+var ErrInvalidBlock = fmt.Errorf("%w: invalid block", ErrCorruptedFile)
+
+// encodedRecord is a record whose fields have already been encoded, the label set is resolved
+// against the file dictionary only when the record is written.
+type encodedRecord struct {
+	labels   types.Labels
+	streamID uint64
+	id       uint64
+	fields   []byte
+}
+
+// encodeRecords encodes the fields of the records, which can be done without holding the file lock.
+func encodeRecords(records []record) ([]encodedRecord, int, error) {
+	encoded := make([]encodedRecord, len(records))
+	size := 0
+	for i, r := range records {
+		buffer := &bytes.Buffer{}
+		writer := archive.NewStructuredWriter(nopWriteCloser{buffer})
+		if err := encodeFields(writer, r.Data); err != nil {
+			return nil, 0, err
+		}
+
+		encoded[i] = encodedRecord{labels: r.StreamLabels, streamID: r.StreamID, id: r.ID, fields: buffer.Bytes()}
+		size += buffer.Len()
+	}
+
+	return encoded, size, nil
+}
+
+func encodeFields(w *archive.StructuredWriter, doc types.Document) error {
+	// The keys are sorted so that the encoding is deterministic
+	keys := slices.Sorted(maps.Keys(doc))
+
+	if err := w.WriteUvarint(uint64(len(keys))); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := w.WriteString(key); err != nil {
+			return err
+		}
+
+		var err error
+		switch v := doc[key].(type) {
+		case int64:
+			if err = w.WriteUint8(VALUE_INT64); err == nil {
+				err = w.WriteVarint(v)
+			}
+		case int:
+			if err = w.WriteUint8(VALUE_INT64); err == nil {
+				err = w.WriteVarint(int64(v))
+			}
+		case float64:
+			if err = w.WriteUint8(VALUE_FLOAT64); err == nil {
+				err = w.WriteFloat64(v)
+			}
+		case string:
+			if err = w.WriteUint8(VALUE_STRING); err == nil {
+				err = w.WriteString(v)
+			}
+		case bool:
+			var b uint8
+			if v {
+				b = 1
+			}
+			if err = w.WriteUint8(VALUE_BOOL); err == nil {
+				err = w.WriteUint8(b)
+			}
+		default:
+			return fmt.Errorf("unsupported value type for key %s: %T", key, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordEncoder writes records to a WAL file in the binary format.
+type recordEncoder struct {
+	w io.Writer
+	// The entries of the current block are buffered until the block is full, each entry is buffered
+	// to compute its length before being appended to the block
+	block         *bytes.Buffer
+	entry         *bytes.Buffer
+	writer        *archive.StructuredWriter
+	labelSets     map[string]uint64
+	records       uint64
+	headerWritten bool
+}
+
+func newRecordEncoder(w io.Writer) *recordEncoder {
+	entry := &bytes.Buffer{}
+	return &recordEncoder{
+		w:         w,
+		block:     &bytes.Buffer{},
+		entry:     entry,
+		writer:    archive.NewStructuredWriter(nopWriteCloser{entry}),
+		labelSets: make(map[string]uint64),
+	}
+}
+
+// writeHeader writes the uncompressed file header, it's deferred to the first write so that creating
+// an encoder never blocks on the underlying writer.
+func (e *recordEncoder) writeHeader() error {
+	if e.headerWritten {
+		return nil
+	}
+	e.headerWritten = true
+
+	header := archive.NewStructuredWriter(nopWriteCloser{e.w})
+	if _, err := header.Write(WAL_MAGIC); err != nil {
+		return err
+	}
+	return header.WriteUInt32(WAL_FORMAT_VERSION)
+}
+
+// Write appends a record to the file, defining its label set first if needed.
+func (e *recordEncoder) Write(r encodedRecord) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+
+	key := labelSetKey(r.labels)
+	index, ok := e.labelSets[key]
+	if !ok {
+		index = uint64(len(e.labelSets))
+		e.labelSets[key] = index
+		if err := e.writeLabelSet(index, r.streamID, r.labels); err != nil {
+			return err
+		}
+	}
+
+	if err := e.writer.WriteUint8(ENTRY_RECORD); err != nil {
+		return err
+	}
+	if err := e.writer.WriteUvarint(index); err != nil {
+		return err
+	}
+	if err := e.writer.WriteUvarint(r.id); err != nil {
+		return err
+	}
+	if _, err := e.writer.Write(r.fields); err != nil {
+		return err
+	}
+
+	e.records++
+	return e.writeEntry()
+}
+
+func (e *recordEncoder) writeLabelSet(index uint64, streamID uint64, labels types.Labels) error {
+	if err := e.writer.WriteUint8(ENTRY_LABELS); err != nil {
+		return err
+	}
+	if err := e.writer.WriteUvarint(index); err != nil {
+		return err
+	}
+	if err := e.writer.WriteUInt64(streamID); err != nil {
+		return err
+	}
+	if err := e.writer.WriteUvarint(uint64(len(labels))); err != nil {
+		return err
+	}
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		if err := e.writer.WriteString(key); err != nil {
+			return err
+		}
+		if err := e.writer.WriteString(labels[key]); err != nil {
+			return err
+		}
+	}
+
+	return e.writeEntry()
+}
+
+// writeEntry appends the buffered entry to the current block, and writes the block once it's full.
+func (e *recordEncoder) writeEntry() error {
+	defer e.entry.Reset()
+
+	e.block.Write(binary.AppendUvarint(nil, uint64(e.entry.Len())))
+	e.block.Write(e.entry.Bytes())
+	if e.block.Len() < WAL_BLOCK_SIZE {
+		return nil
+	}
+
+	return e.writeBlock()
+}
+
+// writeBlock compresses the current block and writes it to the file framed with its lengths and checksum.
+func (e *recordEncoder) writeBlock() error {
+	block := e.block.Bytes()
+	defer e.block.Reset()
+	if len(block) == 0 {
+		return nil
+	}
+
+	stored := make([]byte, lz4.CompressBlockBound(len(block)))
+	n, err := lz4.CompressBlock(block, stored, nil)
+	if err != nil {
+		return err
+	}
+	// Incompressible blocks are stored as they are
+	stored = stored[:n]
+	if n == 0 || n >= len(block) {
+		stored = block
+	}
+
+	var frame [12]byte
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(stored)))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(block)))
+	binary.BigEndian.PutUint32(frame[8:], blockChecksum(frame[4:8], stored))
+	if _, err := e.w.Write(frame[:]); err != nil {
+		return err
+	}
+	_, err = e.w.Write(stored)
+	return err
+}
+
+// blockChecksum returns the checksum of a block, which covers its decompressed length and its stored bytes.
+func blockChecksum(decompressedLength []byte, stored []byte) uint32 {
+	return crc32.Update(crc32.Checksum(decompressedLength, CRC32C_TABLE), CRC32C_TABLE, stored)
+}
+
+// Close writes the trailer and the last block, the underlying writer is not closed.
+func (e *recordEncoder) Close() error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+
+	if err := e.writer.WriteUint8(ENTRY_TRAILER); err != nil {
+		return err
+	}
+	if err := e.writer.WriteUvarint(e.records); err != nil {
+		return err
+	}
+	if err := e.writeEntry(); err != nil {
+		return err
+	}
+
+	return e.writeBlock()
+}
+
+// iterRecords decodes the records of a WAL file, in either the binary or the legacy JSON format.
+func iterRecords(r io.Reader) iter.Seq[containers.Result[record]] {
+	return func(yield func(containers.Result[record]) bool) {
+		buffered := bufio.NewReader(r)
+		magic, err := buffered.Peek(len(WAL_MAGIC))
+		if err != nil && err != io.EOF {
+			yield(containers.Err[record](err))
+			return
+		}
+
+		if bytes.Equal(magic, WAL_MAGIC) {
+			decodeBinary(buffered, yield)
+		} else {
+			decodeJSON(buffered, yield)
+		}
+	}
+}
+
+func decodeBinary(r *bufio.Reader, yield func(containers.Result[record]) bool) {
+	header := archive.NewStructuredReader(io.NopCloser(r))
+	if _, err := io.ReadFull(header, make([]byte, len(WAL_MAGIC))); err != nil {
+		yield(containers.Err[record](corruptionError(err)))
+		return
+	}
+	version, err := header.ReadUInt32()
+	if err != nil {
+		yield(containers.Err[record](corruptionError(err)))
+		return
+	}
+	if version != WAL_FORMAT_VERSION {
+		yield(containers.Err[record](ErrUnsupportedFormatVersion))
+		return
+	}
+
+	blocks := archive.NewStructuredReader(io.NopCloser(r))
+	labelSets := map[uint64]labelSet{}
+	records := uint64(0)
+	lostBlocks := false
+	for {
+		block, err := readBlock(blocks)
+		if err == io.EOF {
+			yield(containers.Err[record](ErrTruncatedFile))
+			return
+		}
+		if errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrInvalidBlock) {
+			// The block has been skipped using its length, so the following blocks can still be decoded
+			lostBlocks = true
+			if !yield(containers.Err[record](err)) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			yield(containers.Err[record](corruptionError(err)))
+			return
+		}
+
+		for len(block) > 0 {
+			length, n := binary.Uvarint(block)
+			if n <= 0 || length == 0 || length > uint64(len(block)-n) {
+				// The checksum of the block matched, so the following entries can't be delimited reliably
+				if !yield(containers.Err[record](fmt.Errorf("%w: invalid entry length", ErrInvalidEntry))) {
+					return
+				}
+				break
+			}
+			kind := block[n]
+			entry := archive.NewStructuredReader(io.NopCloser(bytes.NewReader(block[n+1 : n+int(length)])))
+			block = block[n+int(length):]
+
+			switch kind {
+			case ENTRY_LABELS:
+				index, labels, err := decodeLabelSet(entry)
+				if err != nil {
+					if !yield(containers.Err[record](corruptionError(err))) {
+						return
+					}
+					continue
+				}
+				labelSets[index] = labels
+			case ENTRY_RECORD:
+				records++
+				rec, err := decodeRecord(entry, labelSets)
+				if err != nil {
+					if !yield(containers.Err[record](corruptionError(err))) {
+						return
+					}
+					continue
+				}
+				if !yield(containers.Ok(rec)) {
+					return
+				}
+			case ENTRY_TRAILER:
+				// The records of the lost blocks can't be counted, their loss has already been reported
+				count, err := entry.ReadUvarint()
+				if err != nil {
+					yield(containers.Err[record](corruptionError(err)))
+				} else if count != records && !lostBlocks {
+					yield(containers.Err[record](fmt.Errorf("%w: the trailer declares %d records, found %d", ErrCorruptedFile, count, records)))
+				}
+				return
+			default:
+				if !yield(containers.Err[record](fmt.Errorf("%w: unknown kind %d", ErrInvalidEntry, kind))) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// readBlock reads the next block and returns its decompressed entries, or io.EOF if the file ended
+// between two blocks. If the checksum doesn't match or the block can't be decompressed, the block is
+// consumed anyway so that the following one can be read.
+func readBlock(r *archive.StructuredReader) ([]byte, error) {
+	var frame [12]byte
+	if _, err := io.ReadFull(r, frame[:]); err != nil {
+		return nil, err
+	}
+
+	storedLength := binary.BigEndian.Uint32(frame[:4])
+	decompressedLength := binary.BigEndian.Uint32(frame[4:8])
+	if storedLength == 0 || storedLength > MAX_BLOCK_SIZE || decompressedLength > MAX_BLOCK_SIZE {
+		// The block can't be skipped, since its length can't be trusted
+		return nil, fmt.Errorf("%w: invalid block length %d", ErrCorruptedFile, storedLength)
+	}
+
+	stored := make([]byte, storedLength)
+	if _, err := io.ReadFull(r, stored); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if blockChecksum(frame[4:8], stored) != binary.BigEndian.Uint32(frame[8:]) {
+		return nil, ErrChecksumMismatch
+	}
+	if decompressedLength == storedLength {
+		return stored, nil
+	}
+
+	block := make([]byte, decompressedLength)
+	n, err := lz4.UncompressBlock(stored, block)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBlock, err)
+	}
+	if n != int(decompressedLength) {
+		return nil, fmt.Errorf("%w: decompressed %d bytes, want %d", ErrInvalidBlock, n, decompressedLength)
+	}
+
+	return block, nil
+}
+
+// corruptionError wraps the errors caused by malformed or truncated content in ErrCorruptedFile.
+func corruptionError(err error) error {
+	switch {
+	case errors.Is(err, ErrCorruptedFile):
+		return err
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("%w: %w", ErrTruncatedFile, err)
+	}
+
+	return err
+}
+
+// labelSet is a label set of the file dictionary, together with the ID of its stream.
+type labelSet struct {
+	streamID uint64
+	labels   types.Labels
+}
+
+// decodeLabelSet decodes a label set entry, returning the index of the label set in the dictionary.
+func decodeLabelSet(r *archive.StructuredReader) (uint64, labelSet, error) {
+	index, err := r.ReadUvarint()
+	if err != nil {
+		return 0, labelSet{}, err
+	}
+
+	streamID, err := r.ReadUInt64()
+	if err != nil {
+		return 0, labelSet{}, err
+	}
+
+	count, err := r.ReadUvarint()
+	if err != nil {
+		return 0, labelSet{}, err
+	}
+
+	labels := make(types.Labels, count)
+	for range count {
+		key, err := r.ReadString()
+		if err != nil {
+			return 0, labelSet{}, err
+		}
+		value, err := r.ReadString()
+		if err != nil {
+			return 0, labelSet{}, err
+		}
+		labels[key] = value
+	}
+
+	return index, labelSet{streamID: streamID, labels: labels}, nil
+}
+
+// decodeRecord decodes a record entry, the records with the same label set share the same Labels map.
+func decodeRecord(r *archive.StructuredReader, labelSets map[uint64]labelSet) (record, error) {
+	index, err := r.ReadUvarint()
+	if err != nil {
+		return record{}, err
+	}
+	labels, ok := labelSets[index]
+	if !ok {
+		// The label set is undefined, or it has been lost in a corrupted block
+		return record{}, fmt.Errorf("%w: undefined label set %d", ErrInvalidEntry, index)
+	}
+
+	id, err := r.ReadUvarint()
+	if err != nil {
+		return record{}, err
+	}
+
+	count, err := r.ReadUvarint()
+	if err != nil {
+		return record{}, err
+	}
+
+	doc := make(types.Document, count)
+	for range count {
+		key, err := r.ReadString()
+		if err != nil {
+			return record{}, err
+		}
+		valueType, err := r.ReadUint8()
+		if err != nil {
+			return record{}, err
+		}
+
+		switch valueType {
+		case VALUE_INT64:
+			doc[key], err = r.ReadVarint()
+		case VALUE_FLOAT64:
+			doc[key], err = r.ReadFloat64()
+		case VALUE_STRING:
+			doc[key], err = r.ReadString()
+		case VALUE_BOOL:
+			var b uint8
+			b, err = r.ReadUint8()
+			doc[key] = b != 0
+		default:
+			err = fmt.Errorf("%w: unknown value type %d", ErrInvalidEntry, valueType)
+		}
+		if err != nil {
+			return record{}, err
+		}
+	}
+
+	return record{
+		StreamLabels: labels.labels,
+		Data:         doc,
+		ID:           id,
+		StreamID:     labels.streamID,
+	}, nil
+}
+
+func decodeJSON(r *bufio.Reader, yield func(containers.Result[record]) bool) {
+	// The lines are read with a bufio.Reader rather than a bufio.Scanner, which fails on lines longer than 64KB
+	for {
+		line, readErr := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			// Decode the JSON line into a map[string]any.
+			// UseNumber() is needed to preserve the full precision of uint64 values, which would otherwise
+			// be degraded if decoded as float64.
+			var doc record
+			dec := json.NewDecoder(bytes.NewReader(line))
+			dec.UseNumber()
+			if err := dec.Decode(&doc); err != nil {
+				// Each line is independent, so the following ones can still be read
+				if !yield(containers.Err[record](fmt.Errorf("%w: %w", ErrInvalidEntry, err))) {
+					return
+				}
+			} else {
+				doc.StreamID = stream.StreamID(doc.StreamLabels)
+				for key, value := range doc.Data {
+					if n, ok := value.(json.Number); ok {
+						if i, err := n.Int64(); err == nil {
+							doc.Data[key] = i
+						} else if f, err := n.Float64(); err == nil {
+							doc.Data[key] = f
+						}
+					}
+				}
+
+				if !yield(containers.Ok(doc)) {
+					return
+				}
+			}
+		}
+
+		if readErr == io.EOF {
+			return
+		}
+		if readErr != nil {
+			yield(containers.Err[record](readErr))
+			return
+		}
+	}
+}
+
+// labelSetKey returns a canonical representation of the labels, used as key of the dictionary.
+func labelSetKey(labels types.Labels) string {
+	var builder strings.Builder
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		builder.WriteString(key)
+		builder.WriteByte(0)
+		builder.WriteString(labels[key])
+		builder.WriteByte(0)
+	}
+
+	return builder.String()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
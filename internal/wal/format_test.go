@@ -0,0 +1,260 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ZaninAndrea/microdot/internal/archive"
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/internal/stream"
+)
+
+func encodeTestFile(t *testing.T, records []record) []byte {
+	t.Helper()
+
+	encoded, _, err := encodeRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := &bytes.Buffer{}
+	encoder := newRecordEncoder(buffer)
+	for _, r := range encoded {
+		if err := encoder.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+func decodeTestFile(t *testing.T, content []byte) []record {
+	t.Helper()
+
+	records := []record{}
+	for rec := range iterRecords(bytes.NewReader(content)) {
+		if rec.IsErr() {
+			t.Fatalf("iterRecords() error = %v", rec.Error())
+		}
+		records = append(records, rec.Value)
+	}
+	return records
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	api := types.Labels{"app": "api", "env": "prod"}
+	web := types.Labels{"app": "web"}
+	records := []record{
+		{StreamLabels: api, StreamID: 7, ID: 1 << 40, Data: types.Document{"msg": "first", "count": int64(1), "ratio": 1.0, "ok": true}},
+		{StreamLabels: web, StreamID: 1 << 63, ID: 1<<40 + 1, Data: types.Document{"msg": "second", "count": int64(-2)}},
+		{StreamLabels: api, StreamID: 7, ID: 1<<40 + 2, Data: types.Document{"msg": "third", "ratio": 0.5, "ok": false}},
+		{StreamLabels: types.Labels{}, StreamID: 9, ID: 1<<40 + 3, Data: types.Document{}},
+	}
+
+	content := encodeTestFile(t, records)
+	if !bytes.HasPrefix(content, WAL_MAGIC) {
+		t.Fatalf("missing magic bytes in %q", content[:len(WAL_MAGIC)])
+	}
+
+	// Whole numbers stay float64 and integers stay int64, unlike the legacy JSON format
+	actual := decodeTestFile(t, content)
+	if !reflect.DeepEqual(actual, records) {
+		t.Errorf("decoded records = %v, want %v", actual, records)
+	}
+
+	// Each label set is defined only once
+	if actual[0].StreamLabels == nil || reflect.ValueOf(actual[0].StreamLabels).Pointer() != reflect.ValueOf(actual[2].StreamLabels).Pointer() {
+		t.Errorf("records with the same labels should share the label set")
+	}
+}
+
+func TestFormatEmptyFile(t *testing.T) {
+	if actual := decodeTestFile(t, encodeTestFile(t, nil)); len(actual) != 0 {
+		t.Errorf("expected no records, got %v", actual)
+	}
+}
+
+func TestFormatLegacyJSON(t *testing.T) {
+	// Lines longer than 64KB are supported
+	long := strings.Repeat("x", 100_000)
+	content := `{"l":{"app":"test"},"d":{"msg":"hello","ts":1,"ratio":0.5}}` + "\n" +
+		`{"l":{"app":"test"},"d":{"msg":"` + long + `","ts":2}}` + "\n"
+
+	// Legacy records don't have a document ID
+	streamID := stream.StreamID(types.Labels{"app": "test"})
+	expected := []record{
+		{StreamLabels: types.Labels{"app": "test"}, StreamID: streamID, Data: types.Document{"msg": "hello", "ts": int64(1), "ratio": 0.5}},
+		{StreamLabels: types.Labels{"app": "test"}, StreamID: streamID, Data: types.Document{"msg": long, "ts": int64(2)}},
+	}
+	if actual := decodeTestFile(t, []byte(content)); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("decoded records = %v, want %v", actual, expected)
+	}
+}
+
+// decodeCorruptedFile decodes the content until the first error, which must be a corruption error.
+func decodeCorruptedFile(t *testing.T, content []byte) ([]record, error) {
+	t.Helper()
+
+	records := []record{}
+	for rec := range iterRecords(bytes.NewReader(content)) {
+		if rec.IsErr() {
+			if !errors.Is(rec.Err, ErrCorruptedFile) {
+				t.Fatalf("iterRecords() error = %v, want a corruption error", rec.Err)
+			}
+			return records, rec.Err
+		}
+		records = append(records, rec.Value)
+	}
+
+	t.Fatalf("expected a corruption error")
+	return nil, nil
+}
+
+func testRecords(count int) []record {
+	records := make([]record, count)
+	for i := range records {
+		records[i] = record{
+			StreamLabels: types.Labels{"app": "test"},
+			Data:         types.Document{"msg": strings.Repeat("message ", i), "ts": int64(i)},
+			ID:           uint64(i + 1),
+			StreamID:     stream.StreamID(types.Labels{"app": "test"}),
+		}
+	}
+	return records
+}
+
+// decodeAll decodes the content, collecting the records and the errors.
+func decodeAll(content []byte) ([]record, []error) {
+	records := []record{}
+	errs := []error{}
+	for rec := range iterRecords(bytes.NewReader(content)) {
+		if rec.IsErr() {
+			errs = append(errs, rec.Err)
+			continue
+		}
+		records = append(records, rec.Value)
+	}
+	return records, errs
+}
+
+// blockOffsets returns the offset in the file of the stored bytes of each block.
+func blockOffsets(content []byte) []int {
+	offsets := []int{}
+	for offset := len(WAL_MAGIC) + 4; offset < len(content); {
+		offsets = append(offsets, offset+12)
+		offset += 12 + int(binary.BigEndian.Uint32(content[offset:]))
+	}
+	return offsets
+}
+
+// flipByte returns a copy of the content with the byte at the given offset corrupted.
+func flipByte(content []byte, offset int) []byte {
+	corrupted := slices.Clone(content)
+	corrupted[offset] ^= 0xff
+	return corrupted
+}
+
+func TestFormatCorruption(t *testing.T) {
+	oldBlockSize := WAL_BLOCK_SIZE
+	defer func() { WAL_BLOCK_SIZE = oldBlockSize }()
+
+	// With the default block size the label set and all the records fit in the first block, followed by the trailer
+	records := testRecords(20)
+	content := encodeTestFile(t, records)
+	if offsets := blockOffsets(content); len(offsets) != 1 {
+		t.Fatalf("expected a single block, got %d", len(offsets))
+	}
+	actual, err := decodeCorruptedFile(t, flipByte(content, len(content)-1))
+	if !errors.Is(err, ErrChecksumMismatch) || len(actual) != 0 {
+		t.Errorf("corrupted block: got %d records and error %v", len(actual), err)
+	}
+
+	// With one entry per block, a corrupted block loses only its entry
+	WAL_BLOCK_SIZE = 1
+	content = encodeTestFile(t, records)
+	offsets := blockOffsets(content)
+	if len(offsets) != len(records)+2 {
+		t.Fatalf("expected %d blocks, got %d", len(records)+2, len(offsets))
+	}
+
+	// The corrupted trailer is detected after all the records
+	actual, err = decodeCorruptedFile(t, flipByte(content, len(content)-1))
+	if !errors.Is(err, ErrChecksumMismatch) || !reflect.DeepEqual(actual, records) {
+		t.Errorf("corrupted trailer: got %d records and error %v", len(actual), err)
+	}
+
+	// A corrupted record is skipped, the following ones are still returned. The first block is the label set.
+	actual, errs := decodeAll(flipByte(content, offsets[10]+3))
+	expected := slices.Delete(slices.Clone(records), 9, 10)
+	if !reflect.DeepEqual(actual, expected) || len(errs) != 1 || !errors.Is(errs[0], ErrChecksumMismatch) {
+		t.Errorf("corrupted record: got %d records and errors %v", len(actual), errs)
+	}
+
+	// The records of a corrupted label set can't be returned
+	actual, errs = decodeAll(flipByte(content, offsets[0]))
+	if len(actual) != 0 || len(errs) != len(records)+1 || !errors.Is(errs[0], ErrChecksumMismatch) || !errors.Is(errs[1], ErrInvalidEntry) {
+		t.Errorf("corrupted label set: got %d records and %d errors", len(actual), len(errs))
+	}
+
+	// A file without the trailer has been truncated
+	actual, err = decodeCorruptedFile(t, content[:offsets[len(offsets)-1]-12])
+	if !errors.Is(err, ErrTruncatedFile) || !reflect.DeepEqual(actual, records) {
+		t.Errorf("missing trailer: got %d records and error %v", len(actual), err)
+	}
+
+	// A truncated upload returns the records of the complete blocks
+	actual, err = decodeCorruptedFile(t, content[:offsets[11]+2])
+	if !errors.Is(err, ErrTruncatedFile) || !reflect.DeepEqual(actual, records[:10]) {
+		t.Errorf("truncated upload: got %d records and error %v", len(actual), err)
+	}
+}
+
+func TestFormatCorruptionRecovery(t *testing.T) {
+	// The records span many blocks, a corrupted byte in the middle of the file loses a single block
+	records := testRecords(500)
+	content := encodeTestFile(t, records)
+	if offsets := blockOffsets(content); len(offsets) < 10 {
+		t.Fatalf("expected at least 10 blocks, got %d", len(offsets))
+	}
+
+	headerSize := len(WAL_MAGIC) + 4
+	actual, errs := decodeAll(flipByte(content, headerSize+(len(content)-headerSize)/2))
+	if len(errs) != 1 || !errors.Is(errs[0], ErrChecksumMismatch) {
+		t.Fatalf("iterRecords() errors = %v, want a single checksum mismatch", errs)
+	}
+
+	lost := len(records) - len(actual)
+	first := 0
+	for first < len(actual) && reflect.DeepEqual(actual[first], records[first]) {
+		first++
+	}
+	expected := slices.Delete(slices.Clone(records), first, first+lost)
+	if lost == 0 || lost > len(records)/10 || !reflect.DeepEqual(actual, expected) {
+		t.Errorf("recovered %d of %d records, want all but the ones of the corrupted block", len(actual), len(records))
+	}
+}
+
+func TestFormatUnsupported(t *testing.T) {
+	if _, _, err := encodeRecords([]record{{Data: types.Document{"nested": []any{1}}}}); err == nil {
+		t.Errorf("expected an error for an unsupported value type")
+	}
+
+	buffer := &bytes.Buffer{}
+	writer := archive.NewStructuredWriter(nopWriteCloser{buffer})
+	writer.Write(WAL_MAGIC)
+	writer.WriteUInt32(WAL_FORMAT_VERSION + 1)
+
+	for rec := range iterRecords(strings.NewReader(buffer.String())) {
+		if !errors.Is(rec.Err, ErrUnsupportedFormatVersion) {
+			t.Errorf("iterRecords() error = %v, want %v", rec.Err, ErrUnsupportedFormatVersion)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+// WAL files are consumed either by a compaction, which merges them in a bigger file, or by the sharding,
+// which moves their records to the streams. Before being consumed a file is claimed by creating a lock
+// object containing the owner of the file, which is the compaction target or SHARD_OWNER.
+// The locks are deleted only after the files have been removed.
+//
+// A lock is valid for LOCK_LEASE, which is much longer than a job, so an expired lock belongs to a job
+// that has been dropped. The expired locks of the compactions that didn't write their target are reclaimed,
+// while the ones of the shard jobs can be claimed only by another shard job, since the archives already
+// written are deduplicated only by sharding the same file again.
+const LOCK_PREFIX = "wal-lock/"
+const SHARD_OWNER = "shard"
+
+var LOCK_LEASE = time.Hour
+
+type walLock struct {
+	Owner string `json:"owner"`
+	// ExpiresAt is the expiration time of the lease in milliseconds since the Unix epoch
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+func newLock(owner string, now time.Time) walLock {
+	return walLock{Owner: owner, ExpiresAt: now.Add(LOCK_LEASE).UnixMilli()}
+}
+
+func (l walLock) expired(now time.Time) bool {
+	return now.UnixMilli() >= l.ExpiresAt
+}
+
+func (l walLock) encode() io.Reader {
+	encoded, _ := json.Marshal(l)
+	return bytes.NewReader(encoded)
+}
+
+// ClaimFile creates the lock of the WAL file for the given owner. It returns true also if the lock
+// already exists for the same owner, which happens when a job is retried, and in that case the lease
+// is renewed. An expired lock is taken over if it can be reclaimed.
+func ClaimFile(ctx context.Context, bucket blob.Bucket, key, owner string) (bool, error) {
+	lockKey := lockKey(key)
+	for {
+		err := bucket.PutObject(ctx, lockKey, newLock(owner, time.Now()).encode(), false)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, blob.OBJECT_ALREADY_EXISTS_ERROR) {
+			return false, err
+		}
+
+		current, etag, err := readLock(ctx, bucket, lockKey)
+		if errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if current.Owner != owner {
+			reclaimable, err := lockReclaimable(ctx, bucket, current, time.Now())
+			if err != nil || !reclaimable {
+				return false, err
+			}
+		}
+
+		err = bucket.PutObjectIfMatch(ctx, lockKey, newLock(owner, time.Now()).encode(), etag)
+		if errors.Is(err, blob.ETAG_CHANGED_ERROR) {
+			// The lock has been updated concurrently, check the new owner
+			continue
+		}
+		return err == nil, err
+	}
+}
+
+// lockReclaimable reports whether the lock can be claimed by a different owner, which is the case for the
+// expired locks of the compactions that didn't write their target.
+func lockReclaimable(ctx context.Context, bucket blob.Bucket, lock walLock, now time.Time) (bool, error) {
+	if !lock.expired(now) || lock.Owner == SHARD_OWNER {
+		return false, nil
+	}
+
+	targetExists, err := objectExists(ctx, bucket, lock.Owner)
+	return !targetExists, err
+}
+
+// ReleaseFiles deletes the locks of the WAL files that are held by the owner.
+func ReleaseFiles(ctx context.Context, bucket blob.Bucket, keys []string, owner string) error {
+	for _, key := range keys {
+		lockKey := lockKey(key)
+		current, etag, err := readLock(ctx, bucket, lockKey)
+		if errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if current.Owner != owner {
+			continue
+		}
+
+		if err := deleteLock(ctx, bucket, lockKey, etag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ConsumeFiles deletes the claimed WAL files and then their locks.
+func ConsumeFiles(ctx context.Context, bucket blob.Bucket, keys []string) error {
+	for _, key := range keys {
+		err := bucket.DeleteObject(ctx, key, nil)
+		if err != nil && !errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+			return err
+		}
+	}
+	for _, key := range keys {
+		err := bucket.DeleteObject(ctx, lockKey(key), nil)
+		if err != nil && !errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CleanLocks removes the locks left behind by the dropped jobs: the locks of the WAL files that don't
+// exist anymore, e.g. because they have been quarantined, and the expired locks of the compactions. The
+// expired compactions that already wrote their target are completed by consuming their sources, the other
+// ones are released so that their sources can be claimed again.
+func CleanLocks(ctx context.Context, bucket blob.Bucket, now time.Time) error {
+	// The locks are listed before the files, since a lock is created only for an existing file a lock
+	// without a file can't belong to a file that is being written
+	lockKeys, err := listKeys(ctx, bucket, LOCK_PREFIX)
+	if err != nil {
+		return err
+	}
+	fileKeys, err := listKeys(ctx, bucket, WAL_FILE_PREFIX)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]bool, len(fileKeys))
+	for _, key := range fileKeys {
+		files[key] = true
+	}
+
+	for _, lockKey := range lockKeys {
+		lock, etag, err := readLock(ctx, bucket, lockKey)
+		if errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		key := walFileKey(lockKey)
+		if !files[key] {
+			if err := deleteLock(ctx, bucket, lockKey, etag); err != nil {
+				return err
+			}
+			continue
+		}
+		if !lock.expired(now) || lock.Owner == SHARD_OWNER {
+			continue
+		}
+
+		reclaimable, err := lockReclaimable(ctx, bucket, lock, now)
+		if err != nil {
+			return err
+		}
+		if reclaimable {
+			err = deleteLock(ctx, bucket, lockKey, etag)
+		} else {
+			err = ConsumeFiles(ctx, bucket, []string{key})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listLocks returns the lock of each claimed WAL file.
+func listLocks(ctx context.Context, bucket blob.Bucket) (map[string]walLock, error) {
+	lockKeys, err := listKeys(ctx, bucket, LOCK_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	locks := make(map[string]walLock, len(lockKeys))
+	for _, lockKey := range lockKeys {
+		lock, _, err := readLock(ctx, bucket, lockKey)
+		if errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		locks[walFileKey(lockKey)] = lock
+	}
+
+	return locks, nil
+}
+
+func readLock(ctx context.Context, bucket blob.Bucket, lockKey string) (walLock, string, error) {
+	reader, etag, err := bucket.GetObject(ctx, lockKey)
+	if err != nil {
+		return walLock{}, "", err
+	}
+	defer reader.Close()
+
+	var lock walLock
+	if err := json.NewDecoder(reader).Decode(&lock); err != nil {
+		return walLock{}, "", err
+	}
+
+	return lock, etag, nil
+}
+
+// deleteLock deletes the lock if it hasn't changed since it was read.
+func deleteLock(ctx context.Context, bucket blob.Bucket, lockKey, etag string) error {
+	err := bucket.DeleteObject(ctx, lockKey, &etag)
+	if err != nil && !errors.Is(err, blob.NO_SUCH_KEY_ERROR) && !errors.Is(err, blob.ETAG_CHANGED_ERROR) {
+		return err
+	}
+
+	return nil
+}
+
+func lockKey(key string) string {
+	return LOCK_PREFIX + strings.TrimPrefix(key, WAL_FILE_PREFIX)
+}
+
+func walFileKey(lockKey string) string {
+	return WAL_FILE_PREFIX + strings.TrimPrefix(lockKey, LOCK_PREFIX)
+}
@@ -0,0 +1,89 @@
+package wal
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClaimExpiredLock(t *testing.T) {
+	oldLease := LOCK_LEASE
+	defer func() { LOCK_LEASE = oldLease }()
+
+	ctx := context.Background()
+	bucket := newTestBucket(t)
+	keys := writeWALFiles(t, bucket, 1)
+
+	// A live lock can't be claimed by another owner
+	if claimed, err := ClaimFile(ctx, bucket, keys[0], "wal/first.l1.log"); err != nil || !claimed {
+		t.Fatalf("ClaimFile() = %v, %v", claimed, err)
+	}
+	if claimed, err := ClaimFile(ctx, bucket, keys[0], SHARD_OWNER); err != nil || claimed {
+		t.Fatalf("ClaimFile() of a live lock = %v, %v", claimed, err)
+	}
+
+	// The expired lock of a compaction that didn't write its target is reclaimed
+	LOCK_LEASE = 0
+	if claimed, err := ClaimFile(ctx, bucket, keys[0], "wal/first.l1.log"); err != nil || !claimed {
+		t.Fatalf("ClaimFile() renewal = %v, %v", claimed, err)
+	}
+	if claimed, err := ClaimFile(ctx, bucket, keys[0], SHARD_OWNER); err != nil || !claimed {
+		t.Fatalf("ClaimFile() of an expired lock = %v, %v", claimed, err)
+	}
+
+	// The expired lock of a shard job is kept, the archives it wrote are deduplicated only by sharding again
+	if claimed, err := ClaimFile(ctx, bucket, keys[0], "wal/second.l1.log"); err != nil || claimed {
+		t.Fatalf("ClaimFile() of an expired shard lock = %v, %v", claimed, err)
+	}
+	if files, err := NewReader(bucket, CORRUPTION_STOP).ShardableFiles(ctx, time.Now()); err != nil || !slices.Equal(files, keys) {
+		t.Errorf("ShardableFiles() = %v, %v, want the file of the expired shard job", files, err)
+	}
+}
+
+func TestCleanLocks(t *testing.T) {
+	oldLease := LOCK_LEASE
+	defer func() { LOCK_LEASE = oldLease }()
+
+	ctx := context.Background()
+	bucket := newTestBucket(t)
+	keys := writeWALFiles(t, bucket, 4)
+
+	// The file of the first lock has been quarantined
+	if claimed, err := ClaimFile(ctx, bucket, keys[0], SHARD_OWNER); err != nil || !claimed {
+		t.Fatalf("ClaimFile() = %v, %v", claimed, err)
+	}
+	if err := bucket.DeleteObject(ctx, keys[0], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second compaction is live, the third one was dropped before writing the target and the fourth
+	// one after writing it
+	if claimed, err := ClaimFile(ctx, bucket, keys[1], "wal/live.l1.log"); err != nil || !claimed {
+		t.Fatalf("ClaimFile() = %v, %v", claimed, err)
+	}
+	LOCK_LEASE = -time.Minute
+	if claimed, err := ClaimFile(ctx, bucket, keys[2], "wal/dropped.l1.log"); err != nil || !claimed {
+		t.Fatalf("ClaimFile() = %v, %v", claimed, err)
+	}
+	target := WAL_FILE_PREFIX + "1700000000000000003_3.l1.log"
+	if claimed, err := ClaimFile(ctx, bucket, keys[3], target); err != nil || !claimed {
+		t.Fatalf("ClaimFile() = %v, %v", claimed, err)
+	}
+	if err := bucket.PutObject(ctx, target, strings.NewReader(""), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CleanLocks(ctx, bucket, time.Now()); err != nil {
+		t.Fatalf("CleanLocks() error = %v", err)
+	}
+	locks, err := listKeys(ctx, bucket, LOCK_PREFIX)
+	if err != nil || !slices.Equal(locks, []string{lockKey(keys[1])}) {
+		t.Errorf("locks after cleaning = %v (%v), want only the live one", locks, err)
+	}
+	files, err := listKeys(ctx, bucket, WAL_FILE_PREFIX)
+	if err != nil || !slices.Equal(files, []string{keys[1], keys[2], target}) {
+		t.Errorf("files after cleaning = %v (%v), want the source of the compacted file consumed", files, err)
+	}
+}
@@ -7,4 +7,8 @@ const WAL_FILE_PREFIX = "wal/"
 type record struct {
 	StreamLabels types.Labels   `json:"l"`
 	Data         types.Document `json:"d"`
+	// The IDs are stored only in the binary format, for legacy JSON files ID is zero and
+	// StreamID is computed from the labels
+	ID       uint64 `json:"-"`
+	StreamID uint64 `json:"-"`
 }
@@ -1,87 +1,216 @@
 package wal
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"iter"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/ZaninAndrea/microdot/pkg/blob"
 	"github.com/ZaninAndrea/microdot/pkg/containers"
 )
 
+// QUARANTINE_PREFIX contains the corrupted WAL files moved away by the CORRUPTION_QUARANTINE policy,
+// they are kept for manual inspection and never read by the database.
+const QUARANTINE_PREFIX = "wal-quarantine/"
+
+// CorruptionPolicy defines how a Reader handles the WAL files that fail the integrity checks.
+type CorruptionPolicy int
+
+const (
+	// CORRUPTION_STOP returns the corruption error and stops reading the corrupted file.
+	CORRUPTION_STOP CorruptionPolicy = iota
+	// CORRUPTION_SKIP logs the corruption and skips the records that can't be read, the records
+	// decoded before the corruption was detected are still returned.
+	CORRUPTION_SKIP
+	// CORRUPTION_QUARANTINE skips the corrupted records like CORRUPTION_SKIP, then moves the file under
+	// QUARANTINE_PREFIX so that it's not read again and returns the corruption error, so that the jobs
+	// reading the file fail instead of consuming a partial copy of it.
+	CORRUPTION_QUARANTINE
+)
+
 type Reader struct {
-	bucket blob.Bucket
+	bucket           blob.Bucket
+	corruptionPolicy CorruptionPolicy
 }
 
-func NewReader(bucket blob.Bucket) *Reader {
+func NewReader(bucket blob.Bucket, corruptionPolicy CorruptionPolicy) *Reader {
 	return &Reader{
-		bucket: bucket,
+		bucket:           bucket,
+		corruptionPolicy: corruptionPolicy,
 	}
 }
 
+// Iter returns the records of all the WAL files. The sources of a compaction are skipped once the
+// compacted file exists, if a file is compacted while it's being iterated its records may be returned twice.
 func (r *Reader) Iter(ctx context.Context) iter.Seq[containers.Result[record]] {
 	return func(yield func(containers.Result[record]) bool) {
-		for obj := range r.bucket.ListObjects(ctx, WAL_FILE_PREFIX) {
-			if obj.Err != nil {
-				if !yield(containers.Err[record](obj.Err)) {
-					return
-				}
+		keys, err := listKeys(ctx, r.bucket, WAL_FILE_PREFIX)
+		if err != nil {
+			yield(containers.Err[record](err))
+			return
+		}
+
+		listed := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			listed[key] = true
+		}
+		compacted, err := compactedSources(ctx, r.bucket, listed)
+		if err != nil {
+			yield(containers.Err[record](err))
+			return
+		}
+
+		missing := false
+		for _, key := range keys {
+			if compacted[key] {
 				continue
 			}
 
-			for rec := range r.iterObject(ctx, obj.Value) {
-				if !yield(rec) {
+			reader, _, err := r.bucket.GetObject(ctx, key)
+			if errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+				// The file has been deleted by a compaction after being listed
+				missing = true
+				continue
+			}
+			if err != nil {
+				if !yield(containers.Err[record](err)) {
 					return
 				}
+				continue
+			}
+			if !r.iterObject(ctx, key, reader, yield) {
+				return
 			}
 		}
-	}
-}
 
-func (r *Reader) iterObject(ctx context.Context, key string) iter.Seq[containers.Result[record]] {
-	return func(yield func(containers.Result[record]) bool) {
-		reader, err := r.bucket.GetObject(ctx, key)
+		if !missing {
+			return
+		}
+
+		// Read the files created after the first listing, which include the compaction targets of the
+		// missing files
+		keys, err = listKeys(ctx, r.bucket, WAL_FILE_PREFIX)
 		if err != nil {
 			yield(containers.Err[record](err))
 			return
 		}
+		for _, key := range keys {
+			if listed[key] {
+				continue
+			}
 
-		// Read the object line by line
-		scanner := bufio.NewScanner(reader)
-		for scanner.Scan() {
-			// Decode the JSON line into a map[string]any.
-			// UseNumber() is needed to preserve the full precision of uint64 values, which would otherwise
-			// be degraded if decoded as float64.
-			var doc record
-			dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
-			dec.UseNumber()
-			err := dec.Decode(&doc)
+			reader, _, err := r.bucket.GetObject(ctx, key)
+			if errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+				continue
+			}
 			if err != nil {
 				if !yield(containers.Err[record](err)) {
 					return
 				}
 				continue
 			}
+			if !r.iterObject(ctx, key, reader, yield) {
+				return
+			}
+		}
+	}
+}
 
-			for key, value := range doc.Data {
-				if n, ok := value.(json.Number); ok {
-					if i, err := n.Int64(); err == nil {
-						doc.Data[key] = i
-					} else if f, err := n.Float64(); err == nil {
-						doc.Data[key] = f
-					}
-				}
+// iterObject yields the records read from a WAL file, handling the corruption according to the policy
+// of the reader. It returns false if the iteration was stopped.
+func (r *Reader) iterObject(
+	ctx context.Context,
+	key string,
+	reader io.ReadCloser,
+	yield func(containers.Result[record]) bool,
+) bool {
+	defer reader.Close()
+
+	var corruption error
+	for rec := range iterRecords(reader) {
+		// Stop scanning as soon as the caller gives up, files can be large
+		if err := ctx.Err(); err != nil {
+			yield(containers.Err[record](err))
+			return false
+		}
+
+		if rec.IsErr() && errors.Is(rec.Err, ErrCorruptedFile) {
+			if r.corruptionPolicy == CORRUPTION_STOP {
+				return yield(containers.Err[record](fmt.Errorf("%s: %w", key, rec.Err)))
 			}
 
-			if !yield(containers.Ok(doc)) {
-				return
+			log.Printf("skipping corrupted records of WAL file %s: %v", key, rec.Err)
+			if corruption == nil {
+				corruption = fmt.Errorf("%s: %w", key, rec.Err)
 			}
+			continue
 		}
 
-		if err := scanner.Err(); err != nil {
-			yield(containers.Err[record](err))
+		if !yield(rec) {
+			return false
+		}
+	}
+
+	if corruption != nil && r.corruptionPolicy == CORRUPTION_QUARANTINE {
+		if err := quarantineFile(ctx, r.bucket, key); err != nil {
+			log.Printf("failed to quarantine WAL file %s: %v", key, err)
 		}
+		return yield(containers.Err[record](corruption))
 	}
+
+	return true
+}
+
+// quarantineFile moves a corrupted WAL file under QUARANTINE_PREFIX. The locks of the file are left in place,
+// they are removed by their owner when it finds the file missing.
+func quarantineFile(ctx context.Context, bucket blob.Bucket, key string) error {
+	reader, _, err := bucket.GetObject(ctx, key)
+	if errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+		// The file has already been moved
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	target := QUARANTINE_PREFIX + strings.TrimPrefix(key, WAL_FILE_PREFIX)
+	err = bucket.PutObject(ctx, target, reader, false)
+	if err != nil && !errors.Is(err, blob.OBJECT_ALREADY_EXISTS_ERROR) {
+		return err
+	}
+
+	err = bucket.DeleteObject(ctx, key, nil)
+	if err != nil && !errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+		return err
+	}
+	return nil
+}
+
+// DeleteQuarantinedFiles deletes the quarantined files whose content was written before the given time,
+// which is read from their name like for the WAL files.
+func DeleteQuarantinedFiles(ctx context.Context, bucket blob.Bucket, before time.Time) error {
+	keys, err := listKeys(ctx, bucket, QUARANTINE_PREFIX)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		createdAt, ok := walFileTime(WAL_FILE_PREFIX + strings.TrimPrefix(key, QUARANTINE_PREFIX))
+		if !ok || !createdAt.Before(before) {
+			continue
+		}
+
+		err := bucket.DeleteObject(ctx, key, nil)
+		if err != nil && !errors.Is(err, blob.NO_SUCH_KEY_ERROR) {
+			return err
+		}
+	}
+
+	return nil
 }
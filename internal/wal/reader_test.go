@@ -0,0 +1,136 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+// writeCorruptedFiles writes a valid WAL file and one whose trailer is missing, and returns their keys.
+func writeCorruptedFiles(t *testing.T, bucket blob.Bucket) (string, string) {
+	t.Helper()
+
+	valid := WAL_FILE_PREFIX + "1_valid.log"
+	corrupted := WAL_FILE_PREFIX + "2_corrupted.log"
+
+	// With one entry per block the truncated upload loses only the trailer
+	oldBlockSize := WAL_BLOCK_SIZE
+	WAL_BLOCK_SIZE = 1
+	content := encodeTestFile(t, testRecords(3))
+	WAL_BLOCK_SIZE = oldBlockSize
+	offsets := blockOffsets(content)
+	truncated := content[:offsets[len(offsets)-1]-12]
+	for key, content := range map[string][]byte{valid: content, corrupted: truncated} {
+		if err := bucket.PutObject(context.Background(), key, bytes.NewReader(content), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return valid, corrupted
+}
+
+// readRecords returns the number of records read with the given policy, and the errors.
+func readRecords(bucket blob.Bucket, policy CorruptionPolicy) (int, []error) {
+	count := 0
+	errs := []error{}
+	for rec := range NewReader(bucket, policy).Iter(context.Background()) {
+		if rec.IsErr() {
+			errs = append(errs, rec.Err)
+			continue
+		}
+		count++
+	}
+
+	return count, errs
+}
+
+func TestReaderCorruptionPolicy(t *testing.T) {
+	ctx := context.Background()
+	bucket := newTestBucket(t)
+	valid, corrupted := writeCorruptedFiles(t, bucket)
+
+	// The records of the corrupted file are returned before the corruption is detected
+	count, errs := readRecords(bucket, CORRUPTION_STOP)
+	if count != 6 || len(errs) != 1 || !errors.Is(errs[0], ErrTruncatedFile) {
+		t.Errorf("CORRUPTION_STOP: got %d records and errors %v", count, errs)
+	}
+
+	count, errs = readRecords(bucket, CORRUPTION_SKIP)
+	if count != 6 || len(errs) != 0 {
+		t.Errorf("CORRUPTION_SKIP: got %d records and errors %v", count, errs)
+	}
+	if keys, _ := listKeys(ctx, bucket, WAL_FILE_PREFIX); !slices.Equal(keys, []string{valid, corrupted}) {
+		t.Errorf("CORRUPTION_SKIP shouldn't move the files, got %v", keys)
+	}
+
+	// The corruption is reported after the readable records, so that the jobs reading the file fail
+	count, errs = readRecords(bucket, CORRUPTION_QUARANTINE)
+	if count != 6 || len(errs) != 1 || !errors.Is(errs[0], ErrTruncatedFile) {
+		t.Errorf("CORRUPTION_QUARANTINE: got %d records and errors %v", count, errs)
+	}
+	if keys, _ := listKeys(ctx, bucket, WAL_FILE_PREFIX); !slices.Equal(keys, []string{valid}) {
+		t.Errorf("expected only the valid file, got %v", keys)
+	}
+	if keys, _ := listKeys(ctx, bucket, QUARANTINE_PREFIX); !slices.Equal(keys, []string{QUARANTINE_PREFIX + "2_corrupted.log"}) {
+		t.Errorf("expected the corrupted file in quarantine, got %v", keys)
+	}
+
+	// The quarantined file isn't read anymore
+	if count, errs = readRecords(bucket, CORRUPTION_STOP); count != 3 || len(errs) != 0 {
+		t.Errorf("after quarantine: got %d records and errors %v", count, errs)
+	}
+}
+
+func TestCompactCorruptedSource(t *testing.T) {
+	ctx := context.Background()
+	bucket := newTestBucket(t)
+	valid, corrupted := writeCorruptedFiles(t, bucket)
+	compactor := NewCompactor(bucket)
+
+	// The compaction fails instead of writing a partial copy of the corrupted source
+	compaction := Compaction{Sources: []string{valid, corrupted}, Target: compactionTarget(valid, 1)}
+	if err := compactor.Compact(ctx, compaction); !errors.Is(err, ErrCorruptedFile) {
+		t.Fatalf("Compact() error = %v, want %v", err, ErrCorruptedFile)
+	}
+	if keys, _ := listKeys(ctx, bucket, QUARANTINE_PREFIX); len(keys) != 1 {
+		t.Errorf("expected the corrupted source in quarantine, got %v", keys)
+	}
+
+	// The retry releases the valid source, which can be compacted with the next files
+	if err := compactor.Compact(ctx, compaction); err != nil {
+		t.Fatalf("Compact() retry error = %v", err)
+	}
+	if keys, _ := listKeys(ctx, bucket, WAL_FILE_PREFIX); !slices.Equal(keys, []string{valid}) {
+		t.Errorf("files after the retry = %v, want only the valid source", keys)
+	}
+	if locks, _ := listKeys(ctx, bucket, LOCK_PREFIX); len(locks) != 0 {
+		t.Errorf("locks after the retry = %v, want none", locks)
+	}
+}
+
+func TestReaderCancellation(t *testing.T) {
+	bucket := newTestBucket(t)
+	writeWALFiles(t, bucket, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	count := 0
+	var err error
+	for rec := range NewReader(bucket, CORRUPTION_STOP).Iter(ctx) {
+		if rec.IsErr() {
+			err = rec.Err
+			continue
+		}
+
+		count++
+		cancel()
+	}
+
+	if count != 1 || !errors.Is(err, context.Canceled) {
+		t.Errorf("got %d records and error %v, want 1 record and %v", count, err, context.Canceled)
+	}
+}
@@ -0,0 +1,76 @@
+package wal
+
+import (
+	"context"
+	"iter"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/pkg/containers"
+)
+
+// WAL files are moved to the streams once they have been fully compacted, or once they are older than
+// SHARD_MAX_AGE, which happens when the traffic is too low to fill a compaction group.
+var SHARD_MAX_AGE = 10 * time.Minute
+
+// ShardableFiles returns the WAL files that are ready to be moved to the streams and that haven't been
+// claimed yet, or whose shard job has been dropped.
+func (r *Reader) ShardableFiles(ctx context.Context, now time.Time) ([]string, error) {
+	keys, err := listKeys(ctx, r.bucket, WAL_FILE_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	locks, err := listLocks(ctx, r.bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	shardable := []string{}
+	for _, key := range keys {
+		level, ok := walFileLevel(key)
+		if !ok {
+			continue
+		}
+		if lock, locked := locks[key]; locked && (lock.Owner != SHARD_OWNER || !lock.expired(now)) {
+			continue
+		}
+
+		createdAt, ok := walFileTime(key)
+		if level >= MAX_COMPACTION_LEVEL || (ok && now.Sub(createdAt) >= SHARD_MAX_AGE) {
+			shardable = append(shardable, key)
+		}
+	}
+
+	return shardable, nil
+}
+
+// IterFile returns the records of a single WAL file.
+func (r *Reader) IterFile(ctx context.Context, key string) iter.Seq[containers.Result[record]] {
+	return func(yield func(containers.Result[record]) bool) {
+		reader, _, err := r.bucket.GetObject(ctx, key)
+		if err != nil {
+			yield(containers.Err[record](err))
+			return
+		}
+
+		r.iterObject(ctx, key, reader, yield)
+	}
+}
+
+// walFileTime returns the creation time of a WAL file, which is the time of its oldest source for
+// compacted files.
+func walFileTime(key string) (time.Time, bool) {
+	name := strings.TrimPrefix(key, WAL_FILE_PREFIX)
+	nanos, _, ok := strings.Cut(name, "_")
+	if !ok {
+		return time.Time{}, false
+	}
+
+	timestamp, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, timestamp), true
+}
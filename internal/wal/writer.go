@@ -2,7 +2,6 @@ package wal
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
@@ -13,13 +12,33 @@ import (
 	"github.com/ZaninAndrea/microdot/pkg/blob"
 )
 
+var ErrWriterClosed = fmt.Errorf("WAL writer is closed")
+
+// The active WAL file is flushed to blob storage as soon as it reaches MAX_FILE_SIZE bytes or
+// MAX_FILE_RECORDS records, or after FLUSH_INTERVAL, whichever comes first.
+// A single batch is never split across files, so a file may exceed the thresholds by one batch.
+var FLUSH_INTERVAL = 1 * time.Second
+var MAX_FILE_SIZE = 1 << 20
+var MAX_FILE_RECORDS = 10_000
+
 type Writer struct {
 	bucket blob.Bucket
 
-	mu             sync.Mutex
-	activeWriter   *io.WriteCloser
-	writeCloseErr  chan error
-	flushListeners []chan error
+	mu      sync.Mutex
+	closed  bool
+	active  *walFile
+	uploads sync.WaitGroup
+}
+
+// walFile is a WAL file that is being streamed to blob storage.
+// The size is the size of the encoded records before compression.
+type walFile struct {
+	writer    *io.PipeWriter
+	encoder   *recordEncoder
+	putErr    chan error
+	listeners []chan error
+	size      int
+	records   int
 }
 
 func NewWriter(bucket blob.Bucket) *Writer {
@@ -28,44 +47,113 @@ func NewWriter(bucket blob.Bucket) *Writer {
 	}
 }
 
-func (w *Writer) AddDocument(ctx context.Context, labels types.Labels, doc types.Document) error {
-	err := <-w.write(record{
-		StreamLabels: labels,
-		Data:         doc,
-	})
-	if err != nil {
-		return err
+func (w *Writer) AddDocument(ctx context.Context, doc types.LabeledDocument) error {
+	return w.AddDocuments(ctx, []types.LabeledDocument{doc})
+}
+
+// AddDocuments appends a batch of documents to the active WAL file and waits until the file has been
+// persisted to blob storage. The whole batch is written under a single lock acquisition.
+func (w *Writer) AddDocuments(ctx context.Context, docs []types.LabeledDocument) error {
+	if len(docs) == 0 {
+		return nil
 	}
 
-	return nil
+	records := make([]record, len(docs))
+	for i, doc := range docs {
+		records[i] = record{
+			StreamLabels: doc.Labels,
+			Data:         doc.Document,
+			ID:           doc.ID,
+			StreamID:     doc.StreamID,
+		}
+	}
+
+	return waitFlush(ctx, w.write(records))
+}
+
+// waitFlush waits for the result of a write, or until the context is cancelled. The documents of a
+// cancelled write may still be persisted, since they can't be removed from the WAL file.
+func waitFlush(ctx context.Context, result chan error) error {
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
+// Close flushes the active WAL file, if any, and rejects all the following writes.
+// It returns once all the pending documents have been acknowledged by the blob storage, or when the
+// context is cancelled.
 func (w *Writer) Close(ctx context.Context) error {
-	w.flush()
+	w.mu.Lock()
+	w.closed = true
+	active := w.active
+	w.mu.Unlock()
 
-	return nil
+	done := make(chan struct{})
+	go func() {
+		if active != nil {
+			w.flush(active)
+		}
+		w.uploads.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (w *Writer) write(r record) chan error {
-	jsonBytes, err := json.Marshal(r)
+// write appends the records to the active WAL file, it returns a channel that receives the
+// result of the flush of the file.
+func (w *Writer) write(records []record) chan error {
+	// The fields are encoded before acquiring the lock, only the label sets need the file dictionary
+	encoded, size, err := encodeRecords(records)
 	if err != nil {
 		errChan := make(chan error, 1)
 		errChan <- err
 		return errChan
 	}
-	jsonBytes = append(jsonBytes, '\n')
 
 	// Write to blob storage
 	listener := make(chan error, 1)
+	closed := false
+	var file *walFile
 	func() {
 		w.mu.Lock()
 		defer w.mu.Unlock()
-		w.flushListeners = append(w.flushListeners, listener)
+		if w.closed {
+			closed = true
+			return
+		}
 
-		w.createWriterIfMissing()
-		_, err = (*w.activeWriter).Write(jsonBytes)
+		file = w.activeFile()
+		file.listeners = append(file.listeners, listener)
+		file.size += size
+		file.records += len(records)
+		for _, r := range encoded {
+			if err = file.encoder.Write(r); err != nil {
+				return
+			}
+		}
 	}()
 
+	if closed {
+		errChan := make(chan error, 1)
+		errChan <- ErrWriterClosed
+		return errChan
+	}
+
+	// Rotate the file early if it's full or if the upload failed. The flush is done outside the lock so
+	// that the following writes can proceed in a new file while this one is uploaded.
+	if err != nil || file.size >= MAX_FILE_SIZE || file.records >= MAX_FILE_RECORDS {
+		w.flush(file)
+	}
+
 	if err != nil {
 		if flushErr := <-listener; flushErr != nil {
 			err = flushErr
@@ -79,21 +167,21 @@ func (w *Writer) write(r record) chan error {
 	return listener
 }
 
-var FLUSH_INTERVAL = 1 * time.Second
-
-// createWriterIfMissing creates a new writer if there isn't an active one.
-// It should be called with the writerLock held.
-func (w *Writer) createWriterIfMissing() {
-	if w.activeWriter != nil {
-		return
+// activeFile returns the active WAL file, creating a new one if there isn't any.
+// It should be called with the lock held.
+func (w *Writer) activeFile() *walFile {
+	if w.active != nil {
+		return w.active
 	}
 
-	var writer io.WriteCloser
 	reader, writer := io.Pipe()
-	w.activeWriter = &writer
-
-	errChannel := make(chan error, 1)
-	w.writeCloseErr = errChannel
+	file := &walFile{
+		writer:  writer,
+		encoder: newRecordEncoder(writer),
+		putErr:  make(chan error, 1),
+	}
+	w.active = file
+	w.uploads.Add(1)
 
 	// Write data to blob storage
 	go func() {
@@ -101,37 +189,41 @@ func (w *Writer) createWriterIfMissing() {
 		defer cancel()
 
 		err := w.bucket.PutObject(ctx, w.walFileName(), reader, false)
-		reader.Close()
-		errChannel <- err
+		reader.CloseWithError(err)
+		file.putErr <- err
 	}()
 
-	// Close the writer and flush data to blob storage
-	go func() {
-		<-time.After(FLUSH_INTERVAL)
-		w.flush()
-	}()
+	// Close the writer and flush data to blob storage, if the file was already rotated
+	// because it was full the flush is a no-op
+	time.AfterFunc(FLUSH_INTERVAL, func() {
+		w.flush(file)
+	})
+
+	return file
 }
 
-func (w *Writer) flush() {
+// flush closes the given WAL file, waits for its upload to complete and notifies the result to the
+// writers of the file. Only the first call for each file has effect.
+func (w *Writer) flush(file *walFile) {
 	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	err := (*w.activeWriter).Close()
-	w.activeWriter = nil
-	if err != nil {
-		w.broadcastFlush(err)
+	if w.active != file {
+		w.mu.Unlock()
 		return
 	}
+	w.active = nil
+	w.mu.Unlock()
 
-	err = <-w.writeCloseErr
-	w.broadcastFlush(err)
-}
+	defer w.uploads.Done()
+
+	err := file.encoder.Close()
+	file.writer.CloseWithError(err)
+	if err == nil {
+		err = <-file.putErr
+	}
 
-func (w *Writer) broadcastFlush(err error) {
-	for _, listener := range w.flushListeners {
+	for _, listener := range file.listeners {
 		listener <- err
 	}
-	w.flushListeners = nil
 }
 
 func (w *Writer) walFileName() string {
@@ -0,0 +1,86 @@
+package wal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+func countWALFiles(t *testing.T, bucket blob.Bucket) int {
+	t.Helper()
+
+	count := 0
+	for obj := range bucket.ListObjects(context.Background(), WAL_FILE_PREFIX) {
+		if obj.Err != nil {
+			t.Fatalf("ListObjects() error = %v", obj.Err)
+		}
+		count++
+	}
+	return count
+}
+
+func TestWriterRotation(t *testing.T) {
+	oldInterval, oldRecords := FLUSH_INTERVAL, MAX_FILE_RECORDS
+	FLUSH_INTERVAL, MAX_FILE_RECORDS = time.Hour, 10
+	defer func() { FLUSH_INTERVAL, MAX_FILE_RECORDS = oldInterval, oldRecords }()
+
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := NewWriter(bucket)
+
+	// Each batch fills a file, so the writes must be acknowledged without waiting for the timer
+	ctx := context.Background()
+	for i := range 3 {
+		docs := make([]types.LabeledDocument, MAX_FILE_RECORDS)
+		for j := range docs {
+			docs[j] = types.LabeledDocument{
+				Labels:   types.Labels{"app": "test"},
+				Document: types.Document{"msg": "hello", "ts": int64(i*len(docs) + j)},
+			}
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- writer.AddDocuments(ctx, docs) }()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("AddDocuments() error = %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("AddDocuments() didn't return before the flush interval")
+		}
+	}
+
+	// A partial file is flushed on close, write returns once the record has been appended to the file
+	flushed := writer.write([]record{{
+		StreamLabels: types.Labels{"app": "test"},
+		Data:         types.Document{"msg": "last", "ts": int64(30)},
+	}})
+	if err := writer.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := <-flushed; err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+
+	if count := countWALFiles(t, bucket); count != 4 {
+		t.Errorf("expected 4 WAL files, got %d", count)
+	}
+
+	records := 0
+	for rec := range NewReader(bucket, CORRUPTION_STOP).Iter(ctx) {
+		if rec.Err != nil {
+			t.Fatalf("Iter() error = %v", rec.Err)
+		}
+		records++
+	}
+	if records != 3*MAX_FILE_RECORDS+1 {
+		t.Errorf("expected %d records, got %d", 3*MAX_FILE_RECORDS+1, records)
+	}
+}
@@ -0,0 +1,169 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/queue"
+	"github.com/ZaninAndrea/microdot/internal/stream"
+	"github.com/ZaninAndrea/microdot/internal/trigram"
+	"github.com/ZaninAndrea/microdot/internal/wal"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+// The background maintenance of the database is split in jobs that are pushed to a queue stored in the bucket,
+// so that they can be processed by any instance and retried if an instance crashes.
+// Each job payload contains its type in the JOB_TYPE_KEY field.
+const JOB_TYPE_KEY = "type"
+const QUEUE_DIRECTORY = "queue/"
+
+// A job is retried by another worker if it isn't completed before its claim expires, the claim
+// is extended while the job is running.
+var CLAIM_DURATION = 2 * time.Minute
+var PLAN_INTERVAL = 30 * time.Second
+
+// Jobs are idempotent, but the planner avoids pushing again the jobs that it pushed less than
+// REPLAN_INTERVAL ago, which are probably still waiting in the queue.
+var REPLAN_INTERVAL = 10 * time.Minute
+
+type Worker struct {
+	bucket          blob.Bucket
+	queue           *queue.Queue
+	walReader       *wal.Reader
+	walCompactor    *wal.Compactor
+	streamReader    *stream.Reader
+	streamWriter    *stream.Writer
+	streamCompactor *stream.Compactor
+	trigramIndex    *trigram.Index
+
+	retentionPolicies []RetentionPolicy
+
+	// planned contains the time at which the jobs were last pushed, by job key.
+	// It's only accessed by the planner goroutine.
+	planned map[string]time.Time
+}
+
+func NewWorker(bucket blob.Bucket) *Worker {
+	return &Worker{
+		bucket:          bucket,
+		queue:           queue.NewQueue(bucket, QUEUE_DIRECTORY),
+		walReader:       wal.NewReader(bucket, wal.CORRUPTION_QUARANTINE),
+		walCompactor:    wal.NewCompactor(bucket),
+		streamReader:    stream.NewReader(bucket),
+		streamWriter:    stream.NewWriter(bucket),
+		streamCompactor: stream.NewCompactor(bucket),
+		planned:         make(map[string]time.Time),
+	}
+}
+
+// SetTrigramIndex makes the WAL shard jobs add the messages of the sharded documents to the index.
+// The index is stored locally, so it only contains the documents sharded by this worker.
+func (w *Worker) SetTrigramIndex(index *trigram.Index) {
+	w.trigramIndex = index
+}
+
+// Run processes the jobs in the queue until the context is cancelled.
+func (w *Worker) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		item, err := w.queue.Pull(ctx, CLAIM_DURATION)
+		if err != nil {
+			// The context has been cancelled
+			return
+		}
+
+		if err := w.process(ctx, item); err != nil {
+			log.Printf("failed to process %v job: %v", item.Payload()[JOB_TYPE_KEY], err)
+			continue
+		}
+
+		if err := w.queue.Remove(ctx, item); err != nil {
+			// The job will be processed again once the claim expires, which is harmless since jobs are idempotent
+			log.Printf("failed to remove %v job: %v", item.Payload()[JOB_TYPE_KEY], err)
+		}
+	}
+}
+
+// Plan periodically enqueues the maintenance jobs that are needed, until the context is cancelled.
+func (w *Worker) Plan(ctx context.Context) {
+	ticker := time.NewTicker(PLAN_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if err := w.planWALCompactions(ctx); err != nil {
+			log.Printf("failed to plan WAL compactions: %v", err)
+		}
+		if err := w.planWALSharding(ctx); err != nil {
+			log.Printf("failed to plan WAL sharding: %v", err)
+		}
+		if err := w.planStreamJobs(ctx); err != nil {
+			log.Printf("failed to plan stream jobs: %v", err)
+		}
+		if err := w.applyQuarantineRetention(ctx, time.Now()); err != nil {
+			log.Printf("failed to apply the retention to the quarantined WAL files: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recentlyPlanned reports whether the job with the given key was pushed less than REPLAN_INTERVAL ago,
+// otherwise it records that the job is being pushed now.
+func (w *Worker) recentlyPlanned(key string) bool {
+	now := time.Now()
+	for plannedKey, plannedAt := range w.planned {
+		if now.Sub(plannedAt) >= REPLAN_INTERVAL {
+			delete(w.planned, plannedKey)
+		}
+	}
+
+	if _, ok := w.planned[key]; ok {
+		return true
+	}
+
+	w.planned[key] = now
+	return false
+}
+
+// process runs the job while periodically extending its claim.
+func (w *Worker) process(ctx context.Context, item queue.Item) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(CLAIM_DURATION / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := w.queue.ExtendClaim(ctx, item, CLAIM_DURATION); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	payload := item.Payload()
+	switch payload[JOB_TYPE_KEY] {
+	case WAL_COMPACTION_JOB:
+		return w.compactWAL(ctx, payload)
+	case WAL_SHARD_JOB:
+		return w.shardWAL(ctx, payload)
+	case STREAM_GC_JOB:
+		return w.collectStreamGarbage(ctx, payload)
+	case STREAM_COMPACTION_JOB:
+		return w.compactStream(ctx, payload)
+	case STREAM_RETENTION_JOB:
+		return w.truncateStream(ctx, payload)
+	default:
+		// Jobs with an unknown type can't ever be completed, so they are dropped
+		log.Printf("dropping job with unknown type %v", payload[JOB_TYPE_KEY])
+		return nil
+	}
+}
@@ -0,0 +1,158 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/internal/queue"
+	"github.com/ZaninAndrea/microdot/internal/trigram"
+	"github.com/ZaninAndrea/microdot/internal/wal"
+)
+
+const STREAM_RETENTION_JOB = "stream_retention"
+
+// RetentionPolicy deletes the documents older than Period from the streams matching the selector.
+// An empty selector matches all the streams.
+type RetentionPolicy struct {
+	Selector types.Labels
+	Period   time.Duration
+}
+
+// ParseRetentionPolicy parses a policy in the format "key=value,key2=value2:period", where the period is
+// a Go duration, e.g. "app=api:720h". The selector can be empty, e.g. ":720h".
+func ParseRetentionPolicy(value string) (RetentionPolicy, error) {
+	rawSelector, rawPeriod, ok := strings.Cut(value, ":")
+	if !ok {
+		return RetentionPolicy{}, fmt.Errorf("missing retention period in %q", value)
+	}
+
+	period, err := time.ParseDuration(rawPeriod)
+	if err != nil {
+		return RetentionPolicy{}, fmt.Errorf("invalid retention period in %q: %w", value, err)
+	}
+	if period <= 0 {
+		return RetentionPolicy{}, fmt.Errorf("the retention period must be positive in %q", value)
+	}
+
+	selector := types.Labels{}
+	if rawSelector != "" {
+		for pair := range strings.SplitSeq(rawSelector, ",") {
+			key, labelValue, ok := strings.Cut(pair, "=")
+			if !ok || key == "" {
+				return RetentionPolicy{}, fmt.Errorf("invalid retention selector in %q", value)
+			}
+			selector[key] = labelValue
+		}
+	}
+
+	return RetentionPolicy{Selector: selector, Period: period}, nil
+}
+
+// SetRetentionPolicies makes the planner truncate the streams matching the policies. If a stream matches
+// more than one policy, the shortest period is applied.
+func (w *Worker) SetRetentionPolicies(policies []RetentionPolicy) {
+	w.retentionPolicies = policies
+}
+
+// retentionPeriod returns the shortest period of the policies matching the labels, or false if none matches.
+func (w *Worker) retentionPeriod(labels types.Labels) (time.Duration, bool) {
+	var period time.Duration
+	found := false
+	for _, policy := range w.retentionPolicies {
+		if labels.Matches(policy.Selector) && (!found || policy.Period < period) {
+			period = policy.Period
+			found = true
+		}
+	}
+
+	return period, found
+}
+
+// planStreamRetention enqueues the truncation of the stream if it contains documents older than its
+// retention period.
+func (w *Worker) planStreamRetention(ctx context.Context, streamID uint64, now time.Time) error {
+	if len(w.retentionPolicies) == 0 {
+		return nil
+	}
+
+	manifest, err := w.streamReader.LoadManifest(ctx, streamID)
+	if err != nil {
+		return err
+	}
+	if len(manifest.Archives) == 0 {
+		return nil
+	}
+	period, ok := w.retentionPeriod(manifest.Labels)
+	if !ok {
+		return nil
+	}
+
+	before := now.Add(-period).UnixMilli()
+	expired := false
+	for _, entry := range manifest.Archives {
+		expired = expired || entry.MinTimestamp < before
+	}
+	if !expired {
+		return nil
+	}
+
+	id := strconv.FormatUint(streamID, 10)
+	if w.recentlyPlanned(STREAM_RETENTION_JOB + "/" + id) {
+		return nil
+	}
+
+	// The timestamp is sent as a string, since JSON numbers can't represent all the int64 values
+	return w.queue.Push(ctx, queue.Payload{
+		JOB_TYPE_KEY: STREAM_RETENTION_JOB,
+		"stream":     id,
+		"before":     strconv.FormatInt(before, 10),
+	})
+}
+
+// truncateStream deletes the documents of a stream older than the timestamp in the payload, and removes
+// them from the trigram index of the worker. The index is stored locally, so the indexes of the other
+// instances keep the postings of the deleted documents: they are harmless, since the documents are looked
+// up in the stream and are not found anymore, and the trigram index is only supported by single instance
+// deployments anyway.
+func (w *Worker) truncateStream(ctx context.Context, payload queue.Payload) error {
+	streamID, err := payloadStreamID(payload)
+	if err != nil {
+		return err
+	}
+	rawBefore, ok := payload["before"].(string)
+	if !ok {
+		return fmt.Errorf("invalid stream retention timestamp: %v", payload["before"])
+	}
+	before, err := strconv.ParseInt(rawBefore, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid stream retention timestamp: %w", err)
+	}
+
+	deleted, err := w.streamWriter.Truncate(ctx, streamID, before)
+	if err != nil {
+		return err
+	}
+
+	// A retried job doesn't find the deleted documents again, the postings left by a failed purge are
+	// harmless since their documents are not found in the stream
+	if w.trigramIndex == nil || len(deleted) == 0 {
+		return nil
+	}
+	return w.trigramIndex.Purge(trigram.DocumentFilter(streamID, deleted))
+}
+
+// applyQuarantineRetention deletes the quarantined WAL files older than the retention period. A file may
+// contain the documents of any stream, so it's deleted only if a policy with an empty selector applies to
+// all the streams: its period bounds the period of every stream.
+func (w *Worker) applyQuarantineRetention(ctx context.Context, now time.Time) error {
+	period, ok := w.retentionPeriod(types.Labels{})
+	if !ok {
+		return nil
+	}
+
+	return wal.DeleteQuarantinedFiles(ctx, w.bucket, now.Add(-period))
+}
@@ -0,0 +1,96 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/internal/wal"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	policy, err := ParseRetentionPolicy("app=api,env=prod:720h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(policy.Selector, types.Labels{"app": "api", "env": "prod"}) || policy.Period != 720*time.Hour {
+		t.Errorf("ParseRetentionPolicy() = %v", policy)
+	}
+
+	policy, err = ParseRetentionPolicy(":24h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Selector) != 0 || policy.Period != 24*time.Hour {
+		t.Errorf("ParseRetentionPolicy() = %v", policy)
+	}
+
+	for _, invalid := range []string{"app=api", "app=api:forever", "app:24h", "app=api:-1h"} {
+		if _, err := ParseRetentionPolicy(invalid); err == nil {
+			t.Errorf("ParseRetentionPolicy(%q) succeeded, want an error", invalid)
+		}
+	}
+}
+
+func TestRetentionPeriod(t *testing.T) {
+	w := &Worker{}
+	w.SetRetentionPolicies([]RetentionPolicy{
+		{Selector: types.Labels{}, Period: 720 * time.Hour},
+		{Selector: types.Labels{"app": "api"}, Period: 24 * time.Hour},
+		{Selector: types.Labels{"app": "web"}, Period: 8760 * time.Hour},
+	})
+
+	for _, tc := range []struct {
+		labels types.Labels
+		period time.Duration
+	}{
+		{types.Labels{"app": "api", "env": "prod"}, 24 * time.Hour},
+		{types.Labels{"app": "web"}, 720 * time.Hour},
+		{types.Labels{"app": "db"}, 720 * time.Hour},
+	} {
+		if period, ok := w.retentionPeriod(tc.labels); !ok || period != tc.period {
+			t.Errorf("retentionPeriod(%v) = %v, %v, want %v", tc.labels, period, ok, tc.period)
+		}
+	}
+}
+
+func TestQuarantineRetention(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWorker(bucket)
+
+	now := time.Now()
+	old := fmt.Sprintf("%s%d_1.log", wal.QUARANTINE_PREFIX, now.Add(-48*time.Hour).UnixNano())
+	recent := fmt.Sprintf("%s%d_2.log", wal.QUARANTINE_PREFIX, now.Add(-time.Hour).UnixNano())
+	for _, key := range []string{old, recent} {
+		if err := bucket.PutObject(ctx, key, strings.NewReader(""), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The files may contain any stream, so they are kept if some streams have no retention period
+	w.SetRetentionPolicies([]RetentionPolicy{{Selector: types.Labels{"app": "api"}, Period: 24 * time.Hour}})
+	if err := w.applyQuarantineRetention(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if keys := listKeys(t, bucket, wal.QUARANTINE_PREFIX); len(keys) != 2 {
+		t.Errorf("quarantined files = %v, want both files", keys)
+	}
+
+	w.SetRetentionPolicies([]RetentionPolicy{{Selector: types.Labels{}, Period: 24 * time.Hour}})
+	if err := w.applyQuarantineRetention(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if keys := listKeys(t, bucket, wal.QUARANTINE_PREFIX); !slices.Equal(keys, []string{recent}) {
+		t.Errorf("quarantined files = %v, want %v", keys, []string{recent})
+	}
+}
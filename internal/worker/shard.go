@@ -0,0 +1,141 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"iter"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/internal/queue"
+	"github.com/ZaninAndrea/microdot/internal/wal"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+	"github.com/ZaninAndrea/microdot/pkg/containers"
+)
+
+const WAL_SHARD_JOB = "wal_shard"
+
+// shard contains the documents of a WAL file that belong to the same stream
+type shard struct {
+	labels    types.Labels
+	documents []types.Document
+}
+
+func (w *Worker) planWALSharding(ctx context.Context) error {
+	files, err := w.walReader.ShardableFiles(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if w.recentlyPlanned(file) {
+			continue
+		}
+
+		err := w.queue.Push(ctx, queue.Payload{
+			JOB_TYPE_KEY: WAL_SHARD_JOB,
+			"source":     file,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shardWAL moves the records of a WAL file to the streams, writing one archive for each stream.
+// The archives are named after the WAL file, so if the job is retried the archives that were already
+// written are not duplicated.
+func (w *Worker) shardWAL(ctx context.Context, payload queue.Payload) error {
+	source, ok := payload["source"].(string)
+	if !ok {
+		return fmt.Errorf("invalid WAL shard source: %v", payload["source"])
+	}
+
+	claimed, err := wal.ClaimFile(ctx, w.bucket, source, wal.SHARD_OWNER)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		// The file is being compacted, the compacted file will be sharded instead
+		return nil
+	}
+
+	// Group the records by stream, keeping the order of the WAL file
+	shards := make(map[uint64]*shard)
+	for record := range w.walReader.IterFile(ctx, source) {
+		if record.IsErr() && errors.Is(record.Error(), blob.NO_SUCH_KEY_ERROR) {
+			// A previous execution has already consumed the file
+			return wal.ConsumeFiles(ctx, w.bucket, []string{source})
+		}
+		if record.IsErr() {
+			return record.Error()
+		}
+
+		// The document ID is stored in the _id column of the archive
+		document := maps.Clone(record.Value.Data)
+		document["_id"] = int64(record.Value.ID)
+
+		streamID := record.Value.StreamID
+		if _, ok := shards[streamID]; !ok {
+			shards[streamID] = &shard{labels: record.Value.StreamLabels}
+		}
+		shards[streamID].documents = append(shards[streamID].documents, document)
+	}
+
+	fileID := archiveFileID(source)
+	for _, streamID := range slices.Sorted(maps.Keys(shards)) {
+		s := shards[streamID]
+		_, err := w.streamWriter.AppendDocuments(ctx, streamID, fileID, s.labels, iterDocuments(s.documents))
+		if err != nil {
+			return fmt.Errorf("failed to write stream %d: %w", streamID, err)
+		}
+	}
+
+	// The documents are indexed before consuming the WAL file, so that a crash leads to indexing them again
+	if err := w.indexShards(shards); err != nil {
+		return err
+	}
+
+	return wal.ConsumeFiles(ctx, w.bucket, []string{source})
+}
+
+// indexShards adds the messages of the documents to the trigram index, if the worker has one.
+func (w *Worker) indexShards(shards map[uint64]*shard) error {
+	if w.trigramIndex == nil {
+		return nil
+	}
+
+	for streamID, s := range shards {
+		for _, document := range s.documents {
+			msg, _ := document["msg"].(string)
+			if err := w.trigramIndex.Add(int64(streamID), document["_id"].(int64), msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	return w.trigramIndex.Flush()
+}
+
+// archiveFileID derives the ID of the stream archives from the key of the WAL file they were created from.
+func archiveFileID(walKey string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(walKey))
+	return hash.Sum64()
+}
+
+func iterDocuments(documents []types.Document) iter.Seq[containers.Result[types.Document]] {
+	return func(yield func(containers.Result[types.Document]) bool) {
+		for _, doc := range documents {
+			if !yield(containers.Ok(doc)) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/db/types"
+	"github.com/ZaninAndrea/microdot/internal/queue"
+	"github.com/ZaninAndrea/microdot/internal/stream"
+	"github.com/ZaninAndrea/microdot/internal/wal"
+	"github.com/ZaninAndrea/microdot/pkg/blob"
+)
+
+func listKeys(t *testing.T, bucket blob.Bucket, prefix string) []string {
+	t.Helper()
+
+	keys := []string{}
+	for obj := range bucket.ListObjects(context.Background(), prefix) {
+		if obj.IsErr() {
+			t.Fatal(obj.Error())
+		}
+		keys = append(keys, obj.Value)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+func TestShardWAL(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWorker(bucket)
+
+	apiID := stream.StreamID(types.Labels{"app": "api"})
+	webID := stream.StreamID(types.Labels{"app": "web"})
+	docs := []types.LabeledDocument{
+		{Labels: types.Labels{"app": "api"}, Document: types.Document{"msg": "first", "ts": int64(1)}, ID: 101, StreamID: apiID},
+		{Labels: types.Labels{"app": "web"}, Document: types.Document{"msg": "second", "ts": int64(2), "status": int64(200)}, ID: 102, StreamID: webID},
+		{Labels: types.Labels{"app": "api"}, Document: types.Document{"msg": "third", "ts": int64(3), "latency": 0.5}, ID: 103, StreamID: apiID},
+	}
+	writer := wal.NewWriter(bucket)
+	if err := writer.AddDocuments(ctx, docs); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file becomes shardable once it's old enough
+	files, err := w.walReader.ShardableFiles(ctx, time.Now().Add(wal.SHARD_MAX_AGE))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("ShardableFiles() = %v, %v", files, err)
+	}
+	source := files[0]
+
+	payload := queue.Payload{JOB_TYPE_KEY: WAL_SHARD_JOB, "source": source}
+	if err := w.shardWAL(ctx, payload); err != nil {
+		t.Fatalf("shardWAL() error = %v", err)
+	}
+
+	// One archive is written for each stream and the WAL file is consumed
+	streamReader := stream.NewReader(bucket)
+	fileID := archiveFileID(source)
+	apiArchives, err := streamReader.ListArchives(ctx, apiID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedArchives := []stream.Archive{{StreamID: apiID, Level: 0, MinTimestamp: 1, MaxTimestamp: 3, FileID: fileID}}
+	if !slices.Equal(apiArchives, expectedArchives) {
+		t.Errorf("api archives = %v, want %v", apiArchives, expectedArchives)
+	}
+	webArchives, err := streamReader.ListArchives(ctx, webID)
+	if err != nil || len(webArchives) != 1 {
+		t.Errorf("web archives = %v, %v", webArchives, err)
+	}
+	if keys := listKeys(t, bucket, stream.STREAM_FILE_PREFIX); len(keys) != 7 {
+		t.Errorf("expected a data file, a metadata file and a manifest for each stream and the stream index, got %v", keys)
+	}
+	if keys := listKeys(t, bucket, wal.WAL_FILE_PREFIX); len(keys) != 0 {
+		t.Errorf("expected the WAL file to be consumed, got %v", keys)
+	}
+	if keys := listKeys(t, bucket, wal.LOCK_PREFIX); len(keys) != 0 {
+		t.Errorf("expected no locks, got %v", keys)
+	}
+
+	// The archive of the api stream contains both its documents with their IDs, without the missing values
+	results := []stream.FindResult{}
+	for result := range streamReader.IterDocuments(ctx, apiArchives[0], []uint64{101, 103}) {
+		if result.IsErr() {
+			t.Fatal(result.Error())
+		}
+		results = append(results, result.Value)
+	}
+	expectedResults := []stream.FindResult{
+		{ID: 101, Document: types.Document{"_id": int64(101), "msg": "first", "ts": int64(1)}},
+		{ID: 103, Document: types.Document{"_id": int64(103), "latency": 0.5, "msg": "third", "ts": int64(3)}},
+	}
+	if fmt.Sprint(results) != fmt.Sprint(expectedResults) {
+		t.Errorf("documents = %v, want %v", results, expectedResults)
+	}
+}
+
+func TestShardWALRetry(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWorker(bucket)
+
+	source := wal.WAL_FILE_PREFIX + "1700000000000000000_1.log"
+	content := `{"l":{"app":"api"},"d":{"msg":"first","ts":1}}` + "\n"
+	if err := bucket.PutObject(ctx, source, strings.NewReader(content), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash after writing the archives, before consuming the WAL file
+	payload := queue.Payload{JOB_TYPE_KEY: WAL_SHARD_JOB, "source": source}
+	if err := w.shardWAL(ctx, payload); err != nil {
+		t.Fatal(err)
+	}
+	streamFiles := listKeys(t, bucket, stream.STREAM_FILE_PREFIX)
+	if err := bucket.PutObject(ctx, source, strings.NewReader(content), false); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := wal.ClaimFile(ctx, bucket, source, wal.SHARD_OWNER); err != nil || !claimed {
+		t.Fatalf("ClaimFile() = %v, %v", claimed, err)
+	}
+
+	// The retry doesn't duplicate the archives
+	if err := w.shardWAL(ctx, payload); err != nil {
+		t.Fatalf("shardWAL() retry error = %v", err)
+	}
+	if keys := listKeys(t, bucket, stream.STREAM_FILE_PREFIX); !slices.Equal(keys, streamFiles) {
+		t.Errorf("stream files after retry = %v, want %v", keys, streamFiles)
+	}
+	if keys := listKeys(t, bucket, wal.WAL_FILE_PREFIX); len(keys) != 0 {
+		t.Errorf("expected the WAL file to be consumed, got %v", keys)
+	}
+
+	// A WAL file claimed by a compaction is not sharded
+	if err := bucket.PutObject(ctx, source, strings.NewReader(content), false); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := wal.ClaimFile(ctx, bucket, source, "wal/target.l1.log"); err != nil || !claimed {
+		t.Fatalf("ClaimFile() = %v, %v", claimed, err)
+	}
+	if err := w.shardWAL(ctx, payload); err != nil {
+		t.Fatalf("shardWAL() error = %v", err)
+	}
+	if keys := listKeys(t, bucket, wal.WAL_FILE_PREFIX); len(keys) != 1 {
+		t.Errorf("expected the WAL file to be kept, got %v", keys)
+	}
+}
+
+func TestShardWALCorruptedFile(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := blob.NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWorker(bucket)
+
+	source := wal.WAL_FILE_PREFIX + "1700000000000000000_1.log"
+	content := `{"l":{"app":"api"},"d":{"msg":"first","ts":1}}` + "\n" + "{not json\n"
+	if err := bucket.PutObject(ctx, source, strings.NewReader(content), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The job fails instead of publishing the readable part of the file
+	payload := queue.Payload{JOB_TYPE_KEY: WAL_SHARD_JOB, "source": source}
+	if err := w.shardWAL(ctx, payload); !errors.Is(err, wal.ErrCorruptedFile) {
+		t.Fatalf("shardWAL() error = %v, want %v", err, wal.ErrCorruptedFile)
+	}
+	if keys := listKeys(t, bucket, stream.STREAM_FILE_PREFIX); len(keys) != 0 {
+		t.Errorf("expected no stream files, got %v", keys)
+	}
+	if keys := listKeys(t, bucket, wal.QUARANTINE_PREFIX); len(keys) != 1 {
+		t.Errorf("expected the WAL file in quarantine, got %v", keys)
+	}
+}
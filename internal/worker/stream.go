@@ -0,0 +1,142 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/queue"
+	"github.com/ZaninAndrea/microdot/internal/stream"
+)
+
+const STREAM_GC_JOB = "stream_gc"
+const STREAM_COMPACTION_JOB = "stream_compaction"
+
+// planStreamJobs enqueues the garbage collection, the compactions and the truncations of all the streams.
+func (w *Worker) planStreamJobs(ctx context.Context) error {
+	streams, err := w.streamReader.ListStreams(ctx)
+	if err != nil {
+		return err
+	}
+	// The streams created before the stream index existed are added to it, so that the queries find them
+	if err := w.streamWriter.IndexStreams(ctx, streams); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, streamID := range streams {
+		if err := w.planStreamGC(ctx, streamID); err != nil {
+			return err
+		}
+		if err := w.planStreamCompactions(ctx, streamID, now); err != nil {
+			return err
+		}
+		if err := w.planStreamRetention(ctx, streamID, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Worker) planStreamGC(ctx context.Context, streamID uint64) error {
+	// The stream ID is sent as a string, since the payload is serialized to JSON
+	id := strconv.FormatUint(streamID, 10)
+	if w.recentlyPlanned(STREAM_GC_JOB + "/" + id) {
+		return nil
+	}
+
+	return w.queue.Push(ctx, queue.Payload{
+		JOB_TYPE_KEY: STREAM_GC_JOB,
+		"stream":     id,
+	})
+}
+
+func (w *Worker) planStreamCompactions(ctx context.Context, streamID uint64, now time.Time) error {
+	compactions, err := w.streamCompactor.Plan(ctx, streamID, now)
+	if err != nil {
+		return err
+	}
+
+	for _, compaction := range compactions {
+		if w.recentlyPlanned(compaction.Target.String()) {
+			continue
+		}
+
+		sources := make([]string, len(compaction.Sources))
+		for i, source := range compaction.Sources {
+			sources[i] = source.String()
+		}
+		err := w.queue.Push(ctx, queue.Payload{
+			JOB_TYPE_KEY: STREAM_COMPACTION_JOB,
+			"stream":     strconv.FormatUint(streamID, 10),
+			"sources":    sources,
+			"target":     compaction.Target.String(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// collectStreamGarbage deletes the archives of a stream that are no longer referenced by its manifest.
+func (w *Worker) collectStreamGarbage(ctx context.Context, payload queue.Payload) error {
+	streamID, err := payloadStreamID(payload)
+	if err != nil {
+		return err
+	}
+
+	return w.streamWriter.CollectGarbage(ctx, streamID, time.Now())
+}
+
+func (w *Worker) compactStream(ctx context.Context, payload queue.Payload) error {
+	streamID, err := payloadStreamID(payload)
+	if err != nil {
+		return err
+	}
+
+	// The payload has been serialized to JSON, so the sources are decoded as []any
+	rawSources, ok := payload["sources"].([]any)
+	if !ok {
+		return fmt.Errorf("invalid stream compaction sources: %v", payload["sources"])
+	}
+	rawTarget, ok := payload["target"].(string)
+	if !ok {
+		return fmt.Errorf("invalid stream compaction target: %v", payload["target"])
+	}
+	target, ok := stream.ParseArchive(streamID, rawTarget)
+	if !ok {
+		return fmt.Errorf("invalid stream compaction target: %v", rawTarget)
+	}
+
+	sources := make([]stream.Archive, len(rawSources))
+	for i, rawSource := range rawSources {
+		name, _ := rawSource.(string)
+		source, ok := stream.ParseArchive(streamID, name)
+		if !ok {
+			return fmt.Errorf("invalid stream compaction source: %v", rawSource)
+		}
+		sources[i] = source
+	}
+
+	return w.streamCompactor.Compact(ctx, stream.Compaction{
+		Sources: sources,
+		Target:  target,
+	})
+}
+
+func payloadStreamID(payload queue.Payload) (uint64, error) {
+	rawStreamID, ok := payload["stream"].(string)
+	if !ok {
+		return 0, fmt.Errorf("invalid stream: %v", payload["stream"])
+	}
+	streamID, err := strconv.ParseUint(rawStreamID, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid stream: %w", err)
+	}
+
+	return streamID, nil
+}
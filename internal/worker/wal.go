@@ -0,0 +1,67 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ZaninAndrea/microdot/internal/queue"
+	"github.com/ZaninAndrea/microdot/internal/wal"
+)
+
+const WAL_COMPACTION_JOB = "wal_compaction"
+
+func (w *Worker) planWALCompactions(ctx context.Context) error {
+	// The locks of the dropped jobs would keep their files from being compacted or sharded
+	if err := wal.CleanLocks(ctx, w.bucket, time.Now()); err != nil {
+		return err
+	}
+
+	compactions, err := w.walCompactor.Plan(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, compaction := range compactions {
+		if w.recentlyPlanned(compaction.Target) {
+			continue
+		}
+
+		err := w.queue.Push(ctx, queue.Payload{
+			JOB_TYPE_KEY: WAL_COMPACTION_JOB,
+			"sources":    compaction.Sources,
+			"target":     compaction.Target,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Worker) compactWAL(ctx context.Context, payload queue.Payload) error {
+	// The payload has been serialized to JSON, so the sources are decoded as []any
+	rawSources, ok := payload["sources"].([]any)
+	if !ok {
+		return fmt.Errorf("invalid WAL compaction sources: %v", payload["sources"])
+	}
+	target, ok := payload["target"].(string)
+	if !ok {
+		return fmt.Errorf("invalid WAL compaction target: %v", payload["target"])
+	}
+
+	sources := make([]string, len(rawSources))
+	for i, rawSource := range rawSources {
+		source, ok := rawSource.(string)
+		if !ok {
+			return fmt.Errorf("invalid WAL compaction source: %v", rawSource)
+		}
+		sources[i] = source
+	}
+
+	return w.walCompactor.Compact(ctx, wal.Compaction{
+		Sources: sources,
+		Target:  target,
+	})
+}
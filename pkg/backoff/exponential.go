@@ -1,6 +1,7 @@
 package backoff
 
 import (
+	"context"
 	mrand "math/rand/v2"
 	"time"
 )
@@ -15,10 +16,19 @@ func NewExponential(minBackoff, maxBackoff time.Duration) *Exponential {
 	return &Exponential{current: minBackoff, minBackoff: minBackoff, maxBackoff: maxBackoff}
 }
 
-func (b *Exponential) Wait() {
+// Wait sleeps for the current backoff duration and increases it, it returns early with the context
+// error if the context is cancelled.
+func (b *Exponential) Wait(ctx context.Context) error {
 	jitterRange := max(1, int64(b.current/2))
 	jitter := time.Duration(mrand.Int64N(jitterRange))
-	time.Sleep(b.current + jitter)
+
+	timer := time.NewTimer(b.current + jitter)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
 
 	next := b.current * 2
 	if next > b.maxBackoff {
@@ -26,6 +36,7 @@ func (b *Exponential) Wait() {
 	}
 
 	b.current = next
+	return nil
 }
 
 func (b *Exponential) Reset() {
@@ -2,17 +2,27 @@ package blob
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"io"
 	"iter"
 	"os"
 	"path/filepath"
-	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/ZaninAndrea/microdot/pkg/containers"
 )
 
+// Objects being written are stored in temporary files with this prefix, which are hidden from the listings
+const TEMP_FILE_PREFIX = ".tmp-"
+
 type DiskBucket struct {
 	basePath string
+
+	// mu makes the conditional operations atomic, checking the etag and replacing the file
+	// are otherwise two separate steps. It only protects against the writers in the same process.
+	mu sync.Mutex
 }
 
 var _ Bucket = (*DiskBucket)(nil)
@@ -31,61 +41,92 @@ func NewDiskBucket(basePath string) (*DiskBucket, error) {
 	}, nil
 }
 
+// PutObject writes the content to a temporary file which is then moved to its final path, so that
+// readers never observe partially written objects.
 func (b *DiskBucket) PutObject(ctx context.Context, key string, content io.Reader, replaceExisting bool) (retErr error) {
 	fullPath := filepath.Join(b.basePath, key)
-	dir := filepath.Dir(fullPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
-	}
-
-	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
 	if !replaceExisting {
-		flags |= os.O_EXCL
-	}
-
-	f, err := os.OpenFile(fullPath, flags, 0644)
-	if err != nil {
-		if os.IsExist(err) {
+		if _, err := os.Stat(fullPath); err == nil {
 			return OBJECT_ALREADY_EXISTS_ERROR
 		}
+	}
 
+	tempPath, err := b.writeTempFile(fullPath, content)
+	if err != nil {
 		return err
 	}
-	defer func() {
-		closeErr := f.Close()
-		if retErr == nil {
-			retErr = closeErr
+	defer os.Remove(tempPath)
+
+	// Link fails if the destination exists, which makes the creation atomic
+	if !replaceExisting {
+		if err := os.Link(tempPath, fullPath); err != nil {
+			if os.IsExist(err) {
+				return OBJECT_ALREADY_EXISTS_ERROR
+			}
+			return err
 		}
-	}()
+		return nil
+	}
 
-	_, retErr = io.Copy(f, content)
-	return
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return os.Rename(tempPath, fullPath)
 }
 
 func (b *DiskBucket) PutObjectIfMatch(ctx context.Context, key string, content io.Reader, etag string) error {
 	fullPath := filepath.Join(b.basePath, key)
 
+	tempPath, err := b.writeTempFile(fullPath, content)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	currentEtag, err := computeEtag(fullPath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return NO_SUCH_KEY_ERROR
+		}
 		return err
 	}
 	if currentEtag != etag {
 		return ETAG_CHANGED_ERROR
 	}
 
-	return b.PutObject(ctx, key, content, true)
+	return os.Rename(tempPath, fullPath)
 }
 
-func (b *DiskBucket) GetObject(ctx context.Context, key string) (io.ReadCloser, string, error) {
-	fullPath := filepath.Join(b.basePath, key)
+// writeTempFile writes the content to a temporary file in the directory of the object and returns its path.
+func (b *DiskBucket) writeTempFile(fullPath string, content io.Reader) (string, error) {
+	dir := filepath.Dir(fullPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
 
-	// Compute the ETag as the file's modification time in Unix nanoseconds
-	etag, err := computeEtag(fullPath)
+	f, err := os.CreateTemp(dir, TEMP_FILE_PREFIX+"*")
 	if err != nil {
-		return nil, "", err
+		return "", err
 	}
 
-	// Open the file for reading
+	if _, err := io.Copy(f, content); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+func (b *DiskBucket) GetObject(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	fullPath := filepath.Join(b.basePath, key)
+
 	f, err := os.Open(fullPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -94,6 +135,18 @@ func (b *DiskBucket) GetObject(ctx context.Context, key string) (io.ReadCloser,
 		return nil, "", err
 	}
 
+	// The ETag is computed on the opened file, so that it matches the returned content even if the
+	// object is replaced in the meantime
+	etag, err := hashContent(f)
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, "", err
+	}
+
 	return f, etag, nil
 }
 
@@ -135,9 +188,14 @@ func (l *limitReadCloser) Close() error {
 func (b *DiskBucket) DeleteObject(ctx context.Context, key string, ifMatch *string) error {
 	fullPath := filepath.Join(b.basePath, key)
 
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	if ifMatch != nil {
 		currentEtag, err := computeEtag(fullPath)
 		if err != nil {
+			if os.IsNotExist(err) {
+				return NO_SUCH_KEY_ERROR
+			}
 			return err
 		}
 		if currentEtag != *ifMatch {
@@ -159,9 +217,13 @@ func (b *DiskBucket) ListObjects(ctx context.Context, prefix string) iter.Seq[co
 	return func(yield func(containers.Result[string]) bool) {
 		err := filepath.Walk(filepath.Join(b.basePath, prefix), func(path string, info os.FileInfo, err error) error {
 			if err != nil {
+				// A missing prefix has no objects
+				if os.IsNotExist(err) {
+					return nil
+				}
 				return err
 			}
-			if !info.IsDir() {
+			if !info.IsDir() && !strings.HasPrefix(info.Name(), TEMP_FILE_PREFIX) {
 				relPath, err := filepath.Rel(b.basePath, path)
 				if err != nil {
 					return err
@@ -179,10 +241,22 @@ func (b *DiskBucket) ListObjects(ctx context.Context, prefix string) iter.Seq[co
 }
 
 func computeEtag(path string) (string, error) {
-	info, err := os.Stat(path)
+	f, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
+	defer f.Close()
+
+	return hashContent(f)
+}
+
+// hashContent returns the hex-encoded MD5 hash of the content, like the ETag of the S3 objects uploaded
+// in a single part. Unlike the modification time, it changes even if two writes happen in the same clock tick.
+func hashContent(r io.Reader) (string, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
 
-	return strconv.FormatInt(info.ModTime().UnixNano(), 10), nil
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
@@ -0,0 +1,40 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDiskBucketEtag(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := NewDiskBucket(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bucket.PutObject(ctx, "key", strings.NewReader("first"), false); err != nil {
+		t.Fatal(err)
+	}
+	reader, etag, err := bucket.GetObject(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := io.ReadAll(reader); err != nil || string(content) != "first" {
+		t.Fatalf("GetObject() content = %q, %v", content, err)
+	}
+	reader.Close()
+
+	// Consecutive writes change the etag even within the same clock tick, so the stale etag is rejected
+	if err := bucket.PutObjectIfMatch(ctx, "key", strings.NewReader("second"), etag); err != nil {
+		t.Fatalf("PutObjectIfMatch() error = %v", err)
+	}
+	if err := bucket.PutObjectIfMatch(ctx, "key", strings.NewReader("third"), etag); !errors.Is(err, ETAG_CHANGED_ERROR) {
+		t.Errorf("PutObjectIfMatch() with a stale etag error = %v, want %v", err, ETAG_CHANGED_ERROR)
+	}
+	if err := bucket.DeleteObject(ctx, "key", &etag); !errors.Is(err, ETAG_CHANGED_ERROR) {
+		t.Errorf("DeleteObject() with a stale etag error = %v, want %v", err, ETAG_CHANGED_ERROR)
+	}
+}
@@ -0,0 +1,113 @@
+package compression
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+var ErrHighCardinality = fmt.Errorf("too many distinct values for dictionary encoding")
+
+// EncodeDictionary encodes a slice of strings as a dictionary of the distinct values followed by the
+// bit-packed index of each value in the dictionary, which is compact for low-cardinality data.
+// It returns ErrHighCardinality if there are more than maxCardinality distinct values.
+//
+// The encoded data contains:
+// - The dictionary size (uvarint), then each distinct value in order of appearance (uvarint length + bytes)
+// - The value count (uvarint)
+// - The indexes, each using the minimum number of bits needed to represent the dictionary size
+func EncodeDictionary(values []string, maxCardinality int) ([]byte, error) {
+	dictionary := []string{}
+	positions := make(map[string]uint64)
+	indexes := make([]uint64, len(values))
+	for i, value := range values {
+		position, ok := positions[value]
+		if !ok {
+			if len(dictionary) >= maxCardinality {
+				return nil, ErrHighCardinality
+			}
+
+			position = uint64(len(dictionary))
+			positions[value] = position
+			dictionary = append(dictionary, value)
+		}
+		indexes[i] = position
+	}
+
+	encoded := binary.AppendUvarint(nil, uint64(len(dictionary)))
+	for _, value := range dictionary {
+		encoded = binary.AppendUvarint(encoded, uint64(len(value)))
+		encoded = append(encoded, value...)
+	}
+	encoded = binary.AppendUvarint(encoded, uint64(len(values)))
+
+	width := dictionaryIndexWidth(len(dictionary))
+	packed := make([]byte, (len(values)*width+7)/8)
+	for i, index := range indexes {
+		for bit := 0; bit < width; bit++ {
+			if index&(1<<bit) != 0 {
+				position := i*width + bit
+				packed[position/8] |= 1 << (position % 8)
+			}
+		}
+	}
+
+	return append(encoded, packed...), nil
+}
+
+// DecodeDictionary decodes a byte slice encoded with EncodeDictionary back into a slice of strings.
+func DecodeDictionary(encoded []byte) ([]any, error) {
+	dictionarySize, n := binary.Uvarint(encoded)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid dictionary size")
+	}
+	encoded = encoded[n:]
+
+	dictionary := make([]string, 0, min(dictionarySize, uint64(len(encoded))))
+	for range dictionarySize {
+		length, n := binary.Uvarint(encoded)
+		if n <= 0 || uint64(len(encoded)-n) < length {
+			return nil, fmt.Errorf("invalid dictionary value")
+		}
+		dictionary = append(dictionary, string(encoded[n:n+int(length)]))
+		encoded = encoded[n+int(length):]
+	}
+
+	valueCount, n := binary.Uvarint(encoded)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid value count")
+	}
+	encoded = encoded[n:]
+
+	width := dictionaryIndexWidth(len(dictionary))
+	if uint64(len(encoded))*8 < valueCount*uint64(width) {
+		return nil, fmt.Errorf("the dictionary indexes are truncated")
+	}
+
+	decoded := make([]any, valueCount)
+	for i := range decoded {
+		index := 0
+		for bit := 0; bit < width; bit++ {
+			position := i*width + bit
+			if encoded[position/8]&(1<<(position%8)) != 0 {
+				index |= 1 << bit
+			}
+		}
+		if index >= len(dictionary) {
+			return nil, fmt.Errorf("dictionary index %d out of range", index)
+		}
+		decoded[i] = dictionary[index]
+	}
+
+	return decoded, nil
+}
+
+// dictionaryIndexWidth returns the number of bits needed to store the indexes of a dictionary, a
+// dictionary with a single value needs no bits at all.
+func dictionaryIndexWidth(dictionarySize int) int {
+	if dictionarySize <= 1 {
+		return 0
+	}
+
+	return bits.Len(uint(dictionarySize - 1))
+}
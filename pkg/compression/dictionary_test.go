@@ -0,0 +1,80 @@
+package compression_test
+
+import (
+	"errors"
+	"testing"
+	"testing/quick"
+
+	"github.com/ZaninAndrea/microdot/pkg/compression"
+)
+
+func TestDictionaryIdentity(t *testing.T) {
+	f := func(indexes []uint8) bool {
+		// Draw the values from a small set, so that they repeat
+		dictionary := []string{"debug", "info", "warn", "error", "", "fatal"}
+		raw := make([]string, len(indexes))
+		for i, index := range indexes {
+			raw[i] = dictionary[int(index)%len(dictionary)]
+		}
+
+		encoded, err := compression.EncodeDictionary(raw, len(dictionary))
+		if err != nil {
+			t.Logf("Encode failed: %v", err)
+			return false
+		}
+		decoded, err := compression.DecodeDictionary(encoded)
+		if err != nil {
+			t.Logf("Decode failed: %v", err)
+			return false
+		}
+
+		if len(decoded) != len(raw) {
+			t.Logf("Length mismatch: expected %d, got %d", len(raw), len(decoded))
+			return false
+		}
+		for i := range raw {
+			if decoded[i] != raw[i] {
+				t.Logf("Mismatch at index %d: expected %v, got %v", i, raw[i], decoded[i])
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDictionaryHighCardinality(t *testing.T) {
+	_, err := compression.EncodeDictionary([]string{"a", "b", "a", "c"}, 2)
+	if !errors.Is(err, compression.ErrHighCardinality) {
+		t.Errorf("EncodeDictionary() error = %v, want ErrHighCardinality", err)
+	}
+}
+
+func TestDecodeDictionary_Errors(t *testing.T) {
+	valid, err := compression.EncodeDictionary([]string{"a", "b", "c", "a"}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]byte{
+		"Empty":             {},
+		"Truncated value":   {1, 5, 'a'},
+		"Truncated indexes": valid[:len(valid)-1],
+		"Index out of range": {
+			3, 1, 'a', 1, 'b', 1, 'c', // dictionary
+			1,    // value count
+			0b11, // index 3
+		},
+	}
+	for name, encoded := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := compression.DecodeDictionary(encoded); err == nil {
+				t.Errorf("DecodeDictionary(%v) succeeded, want an error", encoded)
+			}
+		})
+	}
+}
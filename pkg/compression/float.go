@@ -0,0 +1,274 @@
+package compression
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// The floats are compressed with the XOR encoding of Gorilla (Facebook's time series database), which
+// works well for metrics since consecutive values often share the sign, the exponent and the first bits
+// of the mantissa. The first value is stored as is, then each value is XORed with the previous one:
+// - If the XOR is zero, a single 0 bit is stored
+// - If the meaningful bits of the XOR fit in the window of the previous one, the bits 10 are stored,
+//   followed by the bits of the XOR in the window
+// - Otherwise the bits 11 are stored, followed by the number of leading zeros (5 bits), the number of
+//   meaningful bits minus one (6 bits) and the meaningful bits, which become the new window
+//
+// The stream is padded to a whole byte with 1 bits, which can't be decoded as a value since a value
+// starting with 11 needs at least 12 bits.
+
+const gorillaLeadingBits = 5
+const gorillaLengthBits = 6
+
+// GorillaEncoder encodes float64 values with the Gorilla XOR encoding. The values of a stream can be
+// encoded in multiple calls, Flush ends the stream and resets the encoder.
+type GorillaEncoder struct {
+	encoded []byte
+	// current contains the bits that don't fill a byte yet, aligned to the most significant bit
+	current     byte
+	currentBits int
+
+	started  bool
+	previous uint64
+	leading  int
+	trailing int
+}
+
+var _ Encoder[float64] = (*GorillaEncoder)(nil)
+
+// Encode encodes the values and returns the bytes that have been completed.
+func (e *GorillaEncoder) Encode(values []float64) []byte {
+	for _, value := range values {
+		e.encodeValue(math.Float64bits(value))
+	}
+
+	encoded := e.encoded
+	e.encoded = nil
+	return encoded
+}
+
+// Flush returns the remaining bits of the stream, padded to a whole byte.
+func (e *GorillaEncoder) Flush() []byte {
+	if e.currentBits > 0 {
+		e.writeBits(math.MaxUint64, 8-e.currentBits)
+	}
+
+	encoded := e.encoded
+	*e = GorillaEncoder{}
+	return encoded
+}
+
+func (e *GorillaEncoder) encodeValue(value uint64) {
+	if !e.started {
+		e.writeBits(value, 64)
+		e.started = true
+		e.previous = value
+		e.leading, e.trailing = math.MaxInt, 0
+		return
+	}
+
+	xor := value ^ e.previous
+	e.previous = value
+	if xor == 0 {
+		e.writeBits(0, 1)
+		return
+	}
+
+	leading := min(bits.LeadingZeros64(xor), 1<<gorillaLeadingBits-1)
+	trailing := bits.TrailingZeros64(xor)
+	if leading >= e.leading && trailing >= e.trailing {
+		e.writeBits(0b10, 2)
+		e.writeBits(xor>>e.trailing, 64-e.leading-e.trailing)
+		return
+	}
+
+	meaningful := 64 - leading - trailing
+	e.writeBits(0b11, 2)
+	e.writeBits(uint64(leading), gorillaLeadingBits)
+	e.writeBits(uint64(meaningful-1), gorillaLengthBits)
+	e.writeBits(xor>>trailing, meaningful)
+	e.leading, e.trailing = leading, trailing
+}
+
+// writeBits appends the count least significant bits of value, starting from the most significant one.
+func (e *GorillaEncoder) writeBits(value uint64, count int) {
+	for count > 0 {
+		// Fill the current byte with as many bits as possible
+		n := min(count, 8-e.currentBits)
+		e.current = e.current<<n | byte(value>>(count-n))&(1<<n-1)
+		e.currentBits += n
+		count -= n
+
+		if e.currentBits == 8 {
+			e.encoded = append(e.encoded, e.current)
+			e.current, e.currentBits = 0, 0
+		}
+	}
+}
+
+// GorillaDecoder decodes float64 values encoded with GorillaEncoder. The encoded stream can be split in
+// multiple calls, the values are returned as soon as all their bits are available.
+type GorillaDecoder struct {
+	buffer []byte
+	// position is the index of the next bit to read in the buffer
+	position int
+
+	started  bool
+	previous uint64
+	leading  int
+	trailing int
+}
+
+var _ Decoder[float64] = (*GorillaDecoder)(nil)
+
+// Decode decodes the values that are complete after appending the encoded bytes to the stream.
+func (d *GorillaDecoder) Decode(encoded []byte) ([]float64, error) {
+	d.buffer = append(d.buffer, encoded...)
+
+	values := []float64{}
+	for {
+		value, ok, err := d.decodeValue()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		values = append(values, math.Float64frombits(value))
+	}
+
+	// Drop the bytes that have been read completely
+	consumed := d.position / 8
+	d.buffer = d.buffer[consumed:]
+	d.position -= consumed * 8
+
+	return values, nil
+}
+
+// Flush checks that the stream ended with the padding and resets the decoder. All the values have
+// already been returned by Decode, so no values are returned.
+func (d *GorillaDecoder) Flush() ([]float64, error) {
+	remaining := len(d.buffer)*8 - d.position
+	if remaining >= 8 {
+		return nil, fmt.Errorf("the float stream is truncated")
+	}
+	for remaining > 0 {
+		bit, _ := d.readBits(1)
+		if bit != 1 {
+			return nil, fmt.Errorf("the float stream is truncated")
+		}
+		remaining--
+	}
+
+	*d = GorillaDecoder{}
+	return []float64{}, nil
+}
+
+// decodeValue decodes the next value, it returns false without consuming any bit if the value isn't
+// complete yet.
+func (d *GorillaDecoder) decodeValue() (uint64, bool, error) {
+	start := d.position
+	value, ok, err := d.readValue()
+	if !ok {
+		d.position = start
+	}
+
+	return value, ok, err
+}
+
+func (d *GorillaDecoder) readValue() (uint64, bool, error) {
+	if !d.started {
+		value, ok := d.readBits(64)
+		if !ok {
+			return 0, false, nil
+		}
+		d.started = true
+		d.previous = value
+		return value, true, nil
+	}
+
+	control, ok := d.readBits(1)
+	if !ok {
+		return 0, false, nil
+	}
+	if control == 0 {
+		return d.previous, true, nil
+	}
+
+	control, ok = d.readBits(1)
+	if !ok {
+		return 0, false, nil
+	}
+	leading, trailing := d.leading, d.trailing
+	if control == 1 {
+		rawLeading, ok := d.readBits(gorillaLeadingBits)
+		if !ok {
+			return 0, false, nil
+		}
+		rawMeaningful, ok := d.readBits(gorillaLengthBits)
+		if !ok {
+			return 0, false, nil
+		}
+		leading = int(rawLeading)
+		trailing = 64 - leading - int(rawMeaningful) - 1
+		if trailing < 0 {
+			return 0, false, fmt.Errorf("invalid float window of %d leading zeros and %d bits", rawLeading, rawMeaningful+1)
+		}
+	}
+
+	meaningful, ok := d.readBits(64 - leading - trailing)
+	if !ok {
+		return 0, false, nil
+	}
+
+	// The window is updated only once the whole value has been read
+	d.leading, d.trailing = leading, trailing
+	d.previous ^= meaningful << trailing
+	return d.previous, true, nil
+}
+
+// readBits reads count bits as the least significant bits of the result, it returns false if the buffer
+// doesn't contain enough bits.
+func (d *GorillaDecoder) readBits(count int) (uint64, bool) {
+	if len(d.buffer)*8-d.position < count {
+		return 0, false
+	}
+
+	var value uint64
+	for count > 0 {
+		// Read as many bits as possible from the current byte
+		available := 8 - d.position%8
+		n := min(count, available)
+		chunk := d.buffer[d.position/8] >> (available - n) & (1<<n - 1)
+		value = value<<n | uint64(chunk)
+		d.position += n
+		count -= n
+	}
+	return value, true
+}
+
+// EncodeGorilla encodes a slice of float64 values with the Gorilla XOR encoding.
+func EncodeGorilla(values []float64) []byte {
+	encoder := &GorillaEncoder{}
+	encoded := encoder.Encode(values)
+	return append(encoded, encoder.Flush()...)
+}
+
+// DecodeGorilla decodes a byte slice encoded with EncodeGorilla back into a slice of float64 values.
+func DecodeGorilla(encoded []byte) ([]any, error) {
+	decoder := &GorillaDecoder{}
+	values, err := decoder.Decode(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Flush(); err != nil {
+		return nil, err
+	}
+
+	decoded := make([]any, len(values))
+	for i, value := range values {
+		decoded[i] = value
+	}
+	return decoded, nil
+}
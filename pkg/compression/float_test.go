@@ -0,0 +1,101 @@
+package compression_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"testing/quick"
+
+	"github.com/ZaninAndrea/microdot/pkg/compression"
+)
+
+func TestGorillaIdentity(t *testing.T) {
+	f := func(raw []float64) bool {
+		// Repeated and close values exercise the shorter encodings
+		raw = append(raw, 0.5, 0.5, 0.75, math.NaN(), math.Inf(-1), -0.0, 1e-300)
+
+		encoded := compression.EncodeGorilla(raw)
+		decoded, err := compression.DecodeGorilla(encoded)
+		if err != nil {
+			t.Logf("Decode failed: %v", err)
+			return false
+		}
+
+		if len(decoded) != len(raw) {
+			t.Logf("Length mismatch: expected %d, got %d", len(raw), len(decoded))
+			return false
+		}
+		for i := range raw {
+			if math.Float64bits(decoded[i].(float64)) != math.Float64bits(raw[i]) {
+				t.Logf("Mismatch at index %d: expected %v, got %v", i, raw[i], decoded[i])
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGorillaStreaming(t *testing.T) {
+	values := []float64{12.5, 12.5, 12.75, 13, 100.25, 0.001, 0.001, 12.5}
+
+	// The values are encoded in multiple calls and decoded a byte at a time
+	encoder := &compression.GorillaEncoder{}
+	encoded := encoder.Encode(values[:3])
+	encoded = append(encoded, encoder.Encode(values[3:])...)
+	encoded = append(encoded, encoder.Flush()...)
+
+	decoder := &compression.GorillaDecoder{}
+	decoded := []float64{}
+	for _, b := range encoded {
+		chunk, err := decoder.Decode([]byte{b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, chunk...)
+	}
+	if _, err := decoder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(decoded) != fmt.Sprint(values) {
+		t.Errorf("decoded %v, want %v", decoded, values)
+	}
+
+	// A stream missing its last bytes is detected
+	if _, err := compression.DecodeGorilla(encoded[:len(encoded)-2]); err == nil {
+		t.Errorf("DecodeGorilla() of a truncated stream succeeded")
+	}
+}
+
+func BenchmarkGorilla(b *testing.B) {
+	// A random walk of latencies with a millisecond resolution, as found in metrics
+	rng := rand.New(rand.NewSource(12345))
+	values := make([]float64, 10000)
+	latency := 100.0
+	for i := range values {
+		latency = math.Max(0, latency+rng.NormFloat64()*5)
+		values[i] = math.Round(latency*1000) / 1000
+	}
+
+	encoded := compression.EncodeGorilla(values)
+	b.Run("Encode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = compression.EncodeGorilla(values)
+		}
+		b.ReportMetric(float64(len(encoded))/float64(len(values)), "bytes/value")
+	})
+
+	b.Run("Decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = compression.DecodeGorilla(encoded)
+		}
+	})
+}